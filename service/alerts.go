@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/olivere/elastic/v7"
+)
+
+// 保存的搜索（地理围栏 + 可选关键词）以 ES percolator 查询的形式存放在 SEARCHES_INDEX；
+// 每条新帖子写入 ES 后都会反向匹配这些查询，命中即在 ALERTS_INDEX 中记录一条提醒。
+const (
+	SEARCHES_INDEX = "saved_searches"
+	ALERTS_INDEX   = "alerts"
+
+	// 保存搜索时默认的围栏半径
+	defaultAlertRadius = "1km"
+	// 单条帖子最多匹配的保存搜索数量
+	maxPercolateMatches = 1000
+)
+
+// searchesMapping：percolator 索引除 query 字段外，还必须声明查询里用到的帖子字段（message/location）
+const searchesMapping = `{
+	"mappings": {
+		"properties": {
+			"query":      { "type": "percolator" },
+			"owner":      { "type": "keyword" },
+			"name":       { "type": "keyword" },
+			"created_at": { "type": "date" },
+			"definition": { "type": "object", "enabled": false },
+			"message":    ` + messageFieldMapping + `,
+			"location":   { "type": "geo_point" }
+		}
+	}
+}`
+
+const alertsMapping = `{
+	"mappings": {
+		"properties": {
+			"owner":       { "type": "keyword" },
+			"search_id":   { "type": "keyword" },
+			"search_name": { "type": "keyword" },
+			"post_id":     { "type": "keyword" },
+			"post":        { "type": "object", "enabled": false },
+			"created_at":  { "type": "date" }
+		}
+	}
+}`
+
+// SearchDefinition 是用户保存的搜索条件：圆形区域（location + radius）或视野（viewport）二选一
+type SearchDefinition struct {
+	Keywords string    `json:"keywords,omitempty"`
+	Location *Location `json:"location,omitempty"`
+	Radius   string    `json:"radius,omitempty"`
+	Viewport *Viewport `json:"viewport,omitempty"`
+}
+
+// SavedSearch 是存入 SEARCHES_INDEX 的文档；Query 为对应的 percolator 查询
+type SavedSearch struct {
+	Owner      string           `json:"owner"`
+	Name       string           `json:"name"`
+	Definition SearchDefinition `json:"definition"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Query      interface{}      `json:"query,omitempty"`
+}
+
+// Alert 记录某条帖子命中了某个用户保存的搜索
+type Alert struct {
+	Owner      string    `json:"owner"`
+	SearchID   string    `json:"search_id"`
+	SearchName string    `json:"search_name,omitempty"`
+	PostID     string    `json:"post_id"`
+	Post       Post      `json:"post"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ensureIndex 在索引不存在时按给定 mapping 创建
+func ensureIndex(ctx context.Context, client *elastic.Client, name, mapping string) error {
+	exists, err := client.IndexExists(name).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	resp, err := client.CreateIndex(name).BodyString(mapping).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !resp.Acknowledged {
+		log.Printf("warning: create index %q not acknowledged by ES", name)
+	}
+	return nil
+}
+
+// savedSearchRequest 是 POST /searches 的请求体；坐标使用指针以区分“缺失”与“0”
+type savedSearchRequest struct {
+	Name     string `json:"name"`
+	Keywords string `json:"keywords"`
+	Location *struct {
+		Lat *float64 `json:"lat"`
+		Lon *float64 `json:"lon"`
+	} `json:"location"`
+	Radius   string `json:"radius"`
+	Viewport *struct {
+		N *float64 `json:"n"`
+		S *float64 `json:"s"`
+		E *float64 `json:"e"`
+		W *float64 `json:"w"`
+	} `json:"viewport"`
+}
+
+// parseSearchDefinition 校验保存搜索的请求体，返回规范化后的定义
+func parseSearchDefinition(in savedSearchRequest) (SearchDefinition, error) {
+	def := SearchDefinition{Keywords: strings.TrimSpace(in.Keywords)}
+	switch {
+	case in.Location != nil && in.Viewport != nil:
+		return def, invalidParam("viewport", "use either location+radius or viewport, not both")
+	case in.Viewport != nil:
+		v := in.Viewport
+		for i, f := range []*float64{v.N, v.S, v.E, v.W} {
+			if f == nil {
+				return def, missingParam("viewport." + []string{"n", "s", "e", "w"}[i])
+			}
+		}
+		vp, err := newViewport(*v.N, *v.S, *v.E, *v.W)
+		if err != nil {
+			return def, err
+		}
+		def.Viewport = &vp
+	case in.Location != nil:
+		loc, err := validateLocation(in.Location.Lat, in.Location.Lon)
+		if err != nil {
+			return def, err
+		}
+		ran := defaultAlertRadius
+		if in.Radius != "" {
+			ran = in.Radius
+		}
+		dist, err := parseDistance("radius", ran)
+		if err != nil {
+			return def, err
+		}
+		def.Location = &loc
+		def.Radius = dist.String()
+	default:
+		return def, missingParam("location")
+	}
+	return def, nil
+}
+
+// percolatorQuery 将保存的搜索条件转换为 ES 查询：区域过滤 + 可选关键词（全部词都要出现）
+func (d SearchDefinition) percolatorQuery() elastic.Query {
+	bq := elastic.NewBoolQuery()
+	if d.Viewport != nil {
+		bq = bq.Filter(viewportQuery("location", *d.Viewport))
+	} else if d.Location != nil {
+		bq = bq.Filter(elastic.NewGeoDistanceQuery("location").
+			Distance(d.Radius).
+			Lat(d.Location.Lat).
+			Lon(d.Location.Lon))
+	}
+	if d.Keywords != "" {
+		bq = bq.Must(keywordQuery(d.Keywords))
+	}
+	return bq
+}
+
+// matchSavedSearches 用新帖子反查所有保存的搜索，并为每个命中的（非作者本人的）搜索写入一条提醒。
+// 提醒 ID 由搜索 ID 与帖子 ID 组成，重复匹配不会产生重复提醒。
+func matchSavedSearches(ctx context.Context, client *elastic.Client, p *Post, id string) error {
+	res, err := client.Search().
+		Index(SEARCHES_INDEX).
+		Query(elastic.NewPercolatorQuery().Field("query").Document(p)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("owner", "name")).
+		Size(maxPercolateMatches).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	matched := 0
+	for _, hit := range res.Hits.Hits {
+		var s SavedSearch
+		if err := json.Unmarshal(hit.Source, &s); err != nil || s.Owner == p.User {
+			continue
+		}
+		alert := Alert{
+			Owner:      s.Owner,
+			SearchID:   hit.Id,
+			SearchName: s.Name,
+			PostID:     id,
+			Post:       *p,
+			CreatedAt:  now,
+		}
+		if _, err := client.Index().
+			Index(ALERTS_INDEX).
+			Id(hit.Id + ":" + id).
+			BodyJson(alert).
+			Do(ctx); err != nil {
+			return err
+		}
+		matched++
+	}
+	if matched > 0 {
+		fmt.Printf("Post id=%s matched %d saved search(es)\n", id, matched)
+	}
+	return nil
+}
+
+// handlerSavedSearches：GET 列出当前用户保存的搜索；POST 新建；DELETE 按 id 删除（仅本人）
+func handlerSavedSearches(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromCtx(r.Context())
+	if username == "" {
+		http.Error(w, "missing user in context", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		res, err := esClient.Search().
+			Index(SEARCHES_INDEX).
+			Query(elastic.NewTermQuery("owner", username)).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Exclude("query")).
+			Sort("created_at", false).
+			Size(100).
+			Do(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		type savedSearchWithID struct {
+			ID string `json:"id"`
+			SavedSearch
+		}
+		out := []savedSearchWithID{}
+		for _, hit := range res.Hits.Hits {
+			var s SavedSearch
+			if err := json.Unmarshal(hit.Source, &s); err == nil {
+				out = append(out, savedSearchWithID{ID: hit.Id, SavedSearch: s})
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPost:
+		var in savedSearchRequest
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, &paramError{Code: errCodeBadBody, Message: "invalid JSON body"})
+			return
+		}
+		def, err := parseSearchDefinition(in)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		src, err := def.percolatorQuery().Source()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s := SavedSearch{
+			Owner:      username,
+			Name:       strings.TrimSpace(in.Name),
+			Definition: def,
+			CreatedAt:  time.Now().UTC(),
+			Query:      src,
+		}
+		id := uuid.New().String()
+		if _, err := esClient.Index().
+			Index(SEARCHES_INDEX).
+			Id(id).
+			BodyJson(s).
+			Refresh("true").
+			Do(r.Context()); err != nil {
+			http.Error(w, "failed to save search: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "ok", "id": id})
+
+	case http.MethodDelete:
+		id := strings.TrimSpace(r.URL.Query().Get("id"))
+		if id == "" {
+			writeError(w, http.StatusBadRequest, missingParam("id"))
+			return
+		}
+		getResp, err := esClient.Get().Index(SEARCHES_INDEX).Id(id).Do(r.Context())
+		if elastic.IsNotFound(err) || (err == nil && !getResp.Found) {
+			// 上一次删除可能在清理提醒之前失败：重试时仍清理本人在该搜索下的提醒
+			if err := deleteSearchAlerts(r.Context(), esClient, username, id); err != nil {
+				log.Printf("delete alerts of saved search %s failed: %v", id, err)
+			}
+			http.Error(w, "saved search not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to load saved search: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var s SavedSearch
+		if err := json.Unmarshal(getResp.Source, &s); err != nil {
+			http.Error(w, "failed to parse saved search", http.StatusInternalServerError)
+			return
+		}
+		if s.Owner != username {
+			http.Error(w, "forbidden: not the owner", http.StatusForbidden)
+			return
+		}
+		// 先删除搜索（不再产生新提醒），再删除它已有的提醒
+		if _, err := esClient.Delete().Index(SEARCHES_INDEX).Id(id).Refresh("true").Do(r.Context()); err != nil {
+			http.Error(w, "delete failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := deleteSearchAlerts(r.Context(), esClient, username, id); err != nil {
+			http.Error(w, "saved search deleted but removing its alerts failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerAlerts：GET /alerts 返回当前用户最近的提醒（按时间倒序，limit 默认 50，最多 500）
+func handlerAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username := usernameFromCtx(r.Context())
+	if username == "" {
+		http.Error(w, "missing user in context", http.StatusUnauthorized)
+		return
+	}
+	size, err := parseLimit("limit", r.URL.Query().Get("limit"), 50, 500)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// 提醒中的帖子是命中时的快照：逐页取回后去掉帖子已不可见的提醒，直到凑满 size 条
+	out := []Alert{}
+	for from := 0; len(out) < size && from < maxResultWindow; from += size {
+		res, err := esClient.Search().
+			Index(ALERTS_INDEX).
+			Query(elastic.NewTermQuery("owner", username)).
+			Sort("created_at", false).
+			From(from).
+			Size(size).
+			Do(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var page []Alert
+		for _, hit := range res.Hits.Hits {
+			var a Alert
+			if err := json.Unmarshal(hit.Source, &a); err == nil {
+				page = append(page, a)
+			}
+		}
+		visible, err := visibleAlerts(r.Context(), esClient, page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		out = append(out, visible...)
+		if len(res.Hits.Hits) < size {
+			break
+		}
+	}
+	if len(out) > size {
+		out = out[:size]
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// visibleAlerts 只保留帖子仍然可见（未删除、未进入回收站、未到期，见 visibleOnly）的提醒
+func visibleAlerts(ctx context.Context, client *elastic.Client, alerts []Alert) ([]Alert, error) {
+	if len(alerts) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, 0, len(alerts))
+	for _, a := range alerts {
+		ids = append(ids, a.PostID)
+	}
+	res, err := client.Search().
+		Index(INDEX).
+		Query(visibleOnly(elastic.NewIdsQuery().Ids(ids...))).
+		FetchSource(false).
+		Size(len(ids)).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	visible := make(map[string]bool, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		visible[hit.Id] = true
+	}
+	var out []Alert
+	for _, a := range alerts {
+		if visible[a.PostID] {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+// deleteSearchAlerts 删除 owner 在保存的搜索 searchID 下的全部提醒
+func deleteSearchAlerts(ctx context.Context, client *elastic.Client, owner, searchID string) error {
+	_, err := client.DeleteByQuery(ALERTS_INDEX).
+		Query(elastic.NewBoolQuery().Filter(
+			elastic.NewTermQuery("owner", owner),
+			elastic.NewTermQuery("search_id", searchID),
+		)).
+		Conflicts("proceed").
+		Refresh("true").
+		Do(ctx)
+	return err
+}
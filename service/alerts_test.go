@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// fakeES 是只认识测试用到的几个接口的 ES：按 "方法 路径" 返回预置的响应，并记录收到的请求
+type fakeES struct {
+	mu        sync.Mutex
+	responses map[string]string // "GET /index/_doc/id" → 响应体；缺失时返回 404
+	requests  []string          // "方法 路径 请求体"
+	// handle 非空时优先处理请求（需要状态的接口），ok=false 时退回 responses
+	handle func(r *http.Request, body string) (status int, resp string, ok bool)
+}
+
+// useFakeES 在测试期间把 esClient 指向 fakeES
+func useFakeES(t *testing.T, responses map[string]string) *fakeES {
+	t.Helper()
+	f := &fakeES{responses: responses}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		key := r.Method + " " + r.URL.Path
+		f.mu.Lock()
+		f.requests = append(f.requests, key+" "+string(body))
+		resp, ok := f.responses[key]
+		handle := f.handle
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if handle != nil {
+			if status, hresp, hok := handle(r, string(body)); hok {
+				w.WriteHeader(status)
+				io.WriteString(w, hresp)
+				return
+			}
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			resp = `{"found": false}`
+		}
+		io.WriteString(w, resp)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := elastic.NewClient(elastic.SetURL(srv.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := esClient
+	t.Cleanup(func() { esClient = old })
+	esClient = client
+	return f
+}
+
+// sent 返回路径为 "方法 路径" 的请求体
+func (f *fakeES) sent(key string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, key+" ") {
+			out = append(out, strings.TrimPrefix(r, key+" "))
+		}
+	}
+	return out
+}
+
+// searchHits 组装 _search 响应；sources 为 ID → _source
+func searchHits(ids []string, sources map[string]interface{}) string {
+	type hit struct {
+		ID     string      `json:"_id"`
+		Source interface{} `json:"_source,omitempty"`
+	}
+	hits := []hit{}
+	for _, id := range ids {
+		hits = append(hits, hit{ID: id, Source: sources[id]})
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"hits": map[string]interface{}{"total": map[string]interface{}{"value": len(hits), "relation": "eq"}, "hits": hits},
+	})
+	return string(b)
+}
+
+func newAlertsMux() *http.ServeMux {
+	mux := newTestMux()
+	mux.HandleFunc("/searches", jwtRequired(handlerSavedSearches))
+	mux.HandleFunc("/alerts", jwtRequired(handlerAlerts))
+	return mux
+}
+
+func TestParseSearchDefinition(t *testing.T) {
+	num := func(v float64) *float64 { return &v }
+	type loc = struct {
+		Lat *float64 `json:"lat"`
+		Lon *float64 `json:"lon"`
+	}
+	type vp = struct {
+		N *float64 `json:"n"`
+		S *float64 `json:"s"`
+		E *float64 `json:"e"`
+		W *float64 `json:"w"`
+	}
+
+	def, err := parseSearchDefinition(savedSearchRequest{Keywords: " lost dog ", Location: &loc{num(43), num(-76)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Keywords != "lost dog" || def.Radius != "1000m" || def.Location == nil {
+		t.Errorf("default radius definition = %+v", def)
+	}
+	def, err = parseSearchDefinition(savedSearchRequest{Viewport: &vp{num(0), num(-20), num(190), num(170)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Viewport == nil || *def.Viewport != (Viewport{North: 0, South: -20, East: -170, West: 170}) {
+		t.Errorf("viewport definition = %+v", def.Viewport)
+	}
+
+	tests := []struct {
+		name  string
+		in    savedSearchRequest
+		field string
+	}{
+		{"neither", savedSearchRequest{}, "location"},
+		{"both", savedSearchRequest{Location: &loc{num(1), num(1)}, Viewport: &vp{num(1), num(0), num(1), num(0)}}, "viewport"},
+		{"missing lat", savedSearchRequest{Location: &loc{nil, num(1)}}, "location.lat"},
+		{"bad radius", savedSearchRequest{Location: &loc{num(1), num(1)}, Radius: "far"}, "radius"},
+		{"missing viewport edge", savedSearchRequest{Viewport: &vp{num(1), num(0), nil, num(0)}}, "viewport.e"},
+	}
+	for _, tt := range tests {
+		_, err := parseSearchDefinition(tt.in)
+		var pe *paramError
+		if !errors.As(err, &pe) || pe.Field != tt.field {
+			t.Errorf("%s: err = %v, want a paramError for %s", tt.name, err, tt.field)
+		}
+	}
+}
+
+func TestDeleteSavedSearchRemovesAlerts(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newAlertsMux()
+	kimi := loginAs(t, mux, "kimi")
+	other := loginAs(t, mux, "other")
+	es := useFakeES(t, map[string]string{
+		"GET /saved_searches/_doc/s1":      `{"_index": "saved_searches", "_id": "s1", "found": true, "_source": {"owner": "kimi", "name": "dogs"}}`,
+		"DELETE /saved_searches/_doc/s1":   `{"_index": "saved_searches", "_id": "s1", "result": "deleted"}`,
+		"POST /alerts/_delete_by_query":    `{"deleted": 2}`,
+		"DELETE /saved_searches/_doc/gone": `{"result": "not_found"}`,
+	})
+
+	if code := doJSON(t, mux, http.MethodDelete, "/searches?id=s1", other, nil, nil); code != http.StatusForbidden {
+		t.Fatalf("delete by another user: status %d, want 403", code)
+	}
+	if n := len(es.sent("POST /alerts/_delete_by_query")); n != 0 {
+		t.Fatalf("another user's delete removed alerts (%d requests)", n)
+	}
+
+	if code := doJSON(t, mux, http.MethodDelete, "/searches?id=s1", kimi, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete: status %d", code)
+	}
+	sent := es.sent("POST /alerts/_delete_by_query")
+	if len(sent) != 1 {
+		t.Fatalf("delete_by_query requests = %v, want 1", sent)
+	}
+	for _, want := range []string{`{"term":{"search_id":"s1"}}`, `{"term":{"owner":"kimi"}}`} {
+		if !strings.Contains(sent[0], want) {
+			t.Errorf("delete_by_query body %s does not contain %s", sent[0], want)
+		}
+	}
+
+	// 搜索已不存在（上次删除中途失败）：仍按本人与搜索 ID 清理提醒
+	if code := doJSON(t, mux, http.MethodDelete, "/searches?id=gone", kimi, nil, nil); code != http.StatusNotFound {
+		t.Errorf("delete of a missing search: status %d, want 404", code)
+	}
+	if sent := es.sent("POST /alerts/_delete_by_query"); len(sent) != 2 || !strings.Contains(sent[1], `"search_id":"gone"`) {
+		t.Errorf("retry did not clean up alerts: %v", sent)
+	}
+}
+
+func TestAlertsHideInvisiblePosts(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newAlertsMux()
+	kimi := loginAs(t, mux, "kimi")
+	alerts := map[string]interface{}{}
+	for _, id := range []string{"p1", "p2", "p3"} {
+		alerts["s1:"+id] = Alert{Owner: "kimi", SearchID: "s1", PostID: id, Post: Post{User: "other", Message: id}}
+	}
+	// fakeES 不执行查询：posts 的 _search 只返回仍然可见的 p1 与 p3
+	es := useFakeES(t, map[string]string{
+		"POST /alerts/_search": searchHits([]string{"s1:p1", "s1:p2", "s1:p3"}, alerts),
+		"POST /posts/_search":  searchHits([]string{"p1", "p3"}, nil),
+	})
+
+	var got []Alert
+	if code := doJSON(t, mux, http.MethodGet, "/alerts", kimi, nil, &got); code != http.StatusOK {
+		t.Fatalf("GET /alerts: status %d", code)
+	}
+	var ids []string
+	for _, a := range got {
+		ids = append(ids, a.PostID)
+	}
+	if strings.Join(ids, ",") != "p1,p3" {
+		t.Errorf("alerts for posts %v, want p1,p3", ids)
+	}
+
+	sent := es.sent("POST /posts/_search")
+	if len(sent) != 1 {
+		t.Fatalf("posts searches = %v, want 1", sent)
+	}
+	for _, want := range []string{`"ids":{"values":["p1","p2","p3"]}`, `"exists":{"field":"deleted_at"}`, `"expires_at"`} {
+		if !strings.Contains(sent[0], want) {
+			t.Errorf("visibility query %s does not contain %s", sent[0], want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// 批量导入（POST /post/bulk）：一次提交大量帖子，适合导入野外调查等离线数据。
+// 请求体可以是 JSON 数组（[{...},{...}]），也可以是 NDJSON（每行一个帖子，Content-Type: application/x-ndjson）；
+// 按首个非空白字符区分：'[' 为数组，否则为 NDJSON。每条帖子的格式与 JSON 方式的 /post 相同，
+// 作者一律为当前登录用户，校验规则（坐标、禁用词）也与 /post 一致。
+// 校验失败的帖子不会写入，其余帖子照常保存；响应中按请求顺序列出每条的结果。
+// 写入通过 PostRepository.SaveBatch 批量完成（ES 后端使用 bulk processor），全部写完后只刷新一次。
+
+const (
+	// maxBulkPosts 是单个请求最多包含的帖子数
+	maxBulkPosts = 10000
+	// maxBulkBodyBytes 是请求体大小上限
+	maxBulkBodyBytes = 32 << 20
+	// maxBulkLineBytes 是 NDJSON 单行大小上限
+	maxBulkLineBytes = 1 << 20
+)
+
+// 单条帖子的处理结果
+const (
+	bulkStatusCreated = "created"
+	bulkStatusFailed  = "failed"
+)
+
+// BulkItemResult 是一条帖子的导入结果；Index 为其在请求中的位置（从 0 开始）
+type BulkItemResult struct {
+	Index  int          `json:"index"`
+	ID     string       `json:"id,omitempty"`
+	Status string       `json:"status"`
+	Error  *errorDetail `json:"error,omitempty"`
+}
+
+// BulkPostResponse 是 /post/bulk 的响应
+type BulkPostResponse struct {
+	Total   int              `json:"total"`
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Items   []BulkItemResult `json:"items"`
+}
+
+// bulkRecord 是请求体中的一条原始记录；Err 非空表示该记录本身无法解析（仅 NDJSON）
+type bulkRecord struct {
+	Data json.RawMessage
+	Err  error
+}
+
+// handlerBulkPost：POST /post/bulk
+func handlerBulkPost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username := usernameFromCtx(r.Context())
+	if username == "" {
+		http.Error(w, "missing user in context", http.StatusUnauthorized)
+		return
+	}
+
+	records, err := readBulkRecords(http.MaxBytesReader(w, r.Body, maxBulkBodyBytes))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, &paramError{Code: errCodeBadBody,
+			Message: fmt.Sprintf("request body exceeds %d bytes", maxBulkBodyBytes)})
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, &paramError{Code: errCodeBadBody, Message: err.Error()})
+		return
+	case len(records) == 0:
+		writeError(w, http.StatusBadRequest, &paramError{Code: errCodeBadBody, Message: "no posts in request body"})
+		return
+	case len(records) > maxBulkPosts:
+		writeError(w, http.StatusRequestEntityTooLarge, outOfRange("posts", fmt.Sprintf("at most %d posts per request", maxBulkPosts)))
+		return
+	}
+
+	resp := BulkPostResponse{Total: len(records), Items: make([]BulkItemResult, len(records))}
+	var (
+		batch []PostWithID
+		index []int // batch[i] 对应的请求位置
+	)
+	for i, rec := range records {
+		resp.Items[i] = BulkItemResult{Index: i, Status: bulkStatusFailed}
+		p, err := parseBulkRecord(rec, username)
+		if err != nil {
+			d := newErrorDetail(http.StatusBadRequest, err)
+			resp.Items[i].Error = &d
+			continue
+		}
+		batch = append(batch, PostWithID{ID: uuid.New().String(), Post: p})
+		index = append(index, i)
+	}
+
+	var (
+		saved    []PostWithID
+		results  []SaveResult
+		writeErr error
+	)
+	if len(batch) > 0 {
+		// sqlite 后端写入与事件在同一事务中：事件写入失败时整批回滚，每条都计为失败
+		_, writeErr = writeWithChanges(r.Context(), func(ctx context.Context) ([]ChangeEvent, error) {
+			results = postRepo.SaveBatch(ctx, batch)
+			var events []ChangeEvent
+			for j, res := range results {
+				if res.Err == nil {
+					events = append(events, newChange(changeCreated, batch[j].ID, &batch[j].Post, username))
+				}
+			}
+			return events, nil
+		})
+	}
+	applied := writeErr == nil || errors.Is(writeErr, errChangesNotRecorded)
+	for j := range batch {
+		item := &resp.Items[index[j]]
+		if !applied || results[j].Err != nil {
+			cause := writeErr
+			if applied {
+				cause = results[j].Err
+			}
+			d := newErrorDetail(http.StatusInternalServerError, cause)
+			item.Error = &d
+			continue
+		}
+		item.ID = batch[j].ID
+		item.Status = bulkStatusCreated
+		saved = append(saved, batch[j])
+		// 使覆盖该位置的搜索缓存失效
+		searchCache.InvalidateAt(batch[j].Location)
+	}
+	resp.Created = len(saved)
+	resp.Failed = resp.Total - resp.Created
+	fmt.Printf("Bulk import by %s saved to %s: %d created, %d failed\n", username, storageBackend, resp.Created, resp.Failed)
+
+	// 反向匹配保存的搜索（仅 ES 后端）：逐条查询较慢，放到后台进行，不阻塞响应
+	if esClient != nil && len(saved) > 0 {
+		go percolateSaved(saved)
+	}
+
+	if errors.Is(writeErr, errChangesNotRecorded) {
+		writeChangesNotRecorded(w, writeErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readBulkRecords 读取请求体中的全部记录：'[' 开头按 JSON 数组解析，否则按 NDJSON 逐行解析（跳过空行）。
+// 数组格式错误无法定位到单条记录，直接返回错误；NDJSON 中无法解析的行作为该条记录的错误返回。
+func readBulkRecords(body io.Reader) ([]bulkRecord, error) {
+	br := bufio.NewReader(body)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []bulkRecord
+	if first == '[' {
+		dec := json.NewDecoder(br)
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("invalid JSON array at element %d: %w", len(records), err)
+			}
+			records = append(records, bulkRecord{Data: raw})
+			if len(records) > maxBulkPosts {
+				return records, nil
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %w", err)
+		}
+		return records, nil
+	}
+
+	sc := bufio.NewScanner(br)
+	sc.Buffer(make([]byte, 64<<10), maxBulkLineBytes)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		rec := bulkRecord{Data: append(json.RawMessage(nil), line...)}
+		if !json.Valid(line) {
+			rec.Err = fmt.Errorf("line is not valid JSON")
+		}
+		records = append(records, rec)
+		if len(records) > maxBulkPosts {
+			return records, nil
+		}
+	}
+	if errors.Is(sc.Err(), bufio.ErrTooLong) {
+		return nil, fmt.Errorf("NDJSON line %d exceeds %d bytes", len(records)+1, maxBulkLineBytes)
+	}
+	return records, sc.Err()
+}
+
+// peekNonSpace 跳过前导空白，返回（但不消费）第一个非空白字节
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
+
+// parseBulkRecord 按 /post 的规则解析并校验一条记录
+func parseBulkRecord(rec bulkRecord, username string) (Post, error) {
+	if rec.Err != nil {
+		return Post{}, &paramError{Code: errCodeBadBody, Message: rec.Err.Error()}
+	}
+	var in postInput
+	if err := json.Unmarshal(rec.Data, &in); err != nil {
+		return Post{}, &paramError{Code: errCodeBadBody, Message: "invalid post object"}
+	}
+	p, err := in.toPost(username)
+	if err != nil {
+		return Post{}, err
+	}
+	if err := preparePost(&p); err != nil {
+		return Post{}, err
+	}
+	return p, nil
+}
+
+// percolateSaved 为批量导入的帖子逐条匹配保存的搜索
+func percolateSaved(posts []PostWithID) {
+	ctx := context.Background()
+	for i := range posts {
+		if err := matchSavedSearches(ctx, esClient, &posts[i].Post, posts[i].ID); err != nil {
+			log.Printf("percolate saved searches for post %s failed: %v", posts[i].ID, err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadBulkRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		records int
+		invalid []int // 作为单条错误返回的记录位置
+		err     string
+	}{
+		{"empty", "  \n", 0, nil, ""},
+		{"array", ` [{"message": "a"}, {"message": "b"}]`, 2, nil, ""},
+		{"empty array", `[]`, 0, nil, ""},
+		{"broken array element", `[{"message": "a"}, {"message": ]`, 0, nil, "element 1"},
+		{"unterminated array", `[{"message": "a"}`, 0, nil, "invalid JSON array"},
+		{"ndjson", "{\"message\": \"a\"}\n\n{\"message\": \"b\"}\r\n", 2, nil, ""},
+		{"ndjson with a bad line", "{\"message\": \"a\"}\n{\"message\": \n{\"message\": \"c\"}", 3, []int{1}, ""},
+		{"ndjson line too long", "{\"message\": \"" + strings.Repeat("x", maxBulkLineBytes) + "\"}", 0, nil, "exceeds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := readBulkRecords(strings.NewReader(tt.body))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != tt.records {
+				t.Fatalf("%d records, want %d", len(records), tt.records)
+			}
+			var invalid []int
+			for i, rec := range records {
+				if rec.Err != nil {
+					invalid = append(invalid, i)
+				}
+			}
+			if len(invalid) != len(tt.invalid) || len(invalid) > 0 && invalid[0] != tt.invalid[0] {
+				t.Errorf("invalid records %v, want %v", invalid, tt.invalid)
+			}
+		})
+	}
+}
+
+// postBulk 以指定 Content-Type 提交原始请求体
+func postBulk(t *testing.T, h http.Handler, token, contentType, body string) (int, BulkPostResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/post/bulk", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var resp BulkPostResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, resp
+}
+
+// 每条记录单独校验：失败的记录带上错误，其余照常写入，作者一律为当前用户
+func TestBulkPostItemErrors(t *testing.T) {
+	bodies := map[string]struct{ contentType, body string }{
+		"ndjson": {"application/x-ndjson", strings.Join([]string{
+			`{"message": "coffee #nyc", "location": {"lat": 40.71, "lon": -74.0}, "user": "mallory"}`,
+			`{"message": "no lat", "location": {"lon": -74.0}}`,
+			`{"message": `,
+			`{"message": "cheap advertisement", "location": {"lat": 40.72, "lon": -74.0}}`,
+			`{"message": "far north", "location": {"lat": 91, "lon": 0}}`,
+			`["not", "an", "object"]`,
+			`{"message": "tea", "location": {"lat": 40.73, "lon": -74.0}}`,
+		}, "\n")},
+		"array": {"application/json", `[
+			{"message": "coffee #nyc", "location": {"lat": 40.71, "lon": -74.0}, "user": "mallory"},
+			{"message": "no lat", "location": {"lon": -74.0}},
+			{"message": {"nested": true}},
+			{"message": "cheap advertisement", "location": {"lat": 40.72, "lon": -74.0}},
+			{"message": "far north", "location": {"lat": 91, "lon": 0}},
+			["not", "an", "object"],
+			{"message": "tea", "location": {"lat": 40.73, "lon": -74.0}}
+		]`},
+	}
+	want := []struct {
+		status, code, field string
+	}{
+		{bulkStatusCreated, "", ""},
+		{bulkStatusFailed, errCodeMissing, "location.lat"},
+		{bulkStatusFailed, errCodeBadBody, ""},
+		{bulkStatusFailed, errCodeInvalid, "message"},
+		{bulkStatusFailed, errCodeOutOfRange, "location.lat"},
+		{bulkStatusFailed, errCodeBadBody, ""},
+		{bulkStatusCreated, "", ""},
+	}
+	for name, req := range bodies {
+		t.Run(name, func(t *testing.T) {
+			useMemoryStorage(t)
+			mux := newTestMux()
+			mux.HandleFunc("/post/bulk", jwtRequired(handlerBulkPost))
+			kimi := loginAs(t, mux, "kimi")
+
+			code, resp := postBulk(t, mux, kimi, req.contentType, req.body)
+			if code != http.StatusOK {
+				t.Fatalf("status %d", code)
+			}
+			if resp.Total != len(want) || resp.Created != 2 || resp.Failed != len(want)-2 || len(resp.Items) != len(want) {
+				t.Fatalf("total/created/failed = %d/%d/%d with %d items", resp.Total, resp.Created, resp.Failed, len(resp.Items))
+			}
+			for i, w := range want {
+				item := resp.Items[i]
+				if item.Index != i || item.Status != w.status {
+					t.Errorf("item %d: %+v, want status %s", i, item, w.status)
+					continue
+				}
+				if w.status == bulkStatusCreated {
+					p, err := postRepo.Get(context.Background(), item.ID)
+					if err != nil || p.User != "kimi" || p.CreatedAt == nil {
+						t.Errorf("item %d: stored post %+v, %v", i, p, err)
+					}
+					continue
+				}
+				if item.ID != "" || item.Error == nil || item.Error.Code != w.code || item.Error.Field != w.field {
+					t.Errorf("item %d: id %q, error %+v, want %s/%s", i, item.ID, item.Error, w.code, w.field)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkPostRequestErrors(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTestMux()
+	mux.HandleFunc("/post/bulk", jwtRequired(handlerBulkPost))
+	kimi := loginAs(t, mux, "kimi")
+
+	tests := []struct {
+		name, body string
+		status     int
+	}{
+		{"empty body", "", http.StatusBadRequest},
+		{"empty array", "[]", http.StatusBadRequest},
+		{"broken array", `[{"message": "a"`, http.StatusBadRequest},
+		{"too many posts", strings.Repeat("{}\n", maxBulkPosts+1), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if code, _ := postBulk(t, mux, kimi, "application/x-ndjson", tt.body); code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.status)
+		}
+	}
+}
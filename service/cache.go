@@ -0,0 +1,197 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 进程内搜索结果缓存（LRU + TTL，条目数有上限）。
+// 地图每次平移都会发起 /search?mode=viewport，这里把视野向外对齐到网格，
+// 让相近的平移共用同一个缓存条目，再在内存中裁剪回真实视野。
+// 发帖/删帖时，使覆盖该位置的条目失效；多实例部署时其他实例的写入只能等 TTL 过期。
+//
+// 相关环境变量：
+//   - SEARCH_CACHE_SIZE：最多缓存的查询数（默认 256，0 表示关闭缓存）
+//   - SEARCH_CACHE_TTL：条目有效期（Go duration 格式，默认 30s）
+var searchCache = newSearchCache(
+	getenvInt("SEARCH_CACHE_SIZE", 256),
+	getenvDuration("SEARCH_CACHE_TTL", 30*time.Second),
+)
+
+// getenvInt 读取整数环境变量，缺省或格式错误时返回默认值
+func getenvInt(k string, def int) int {
+	if n, err := strconv.Atoi(getenvDefault(k, "")); err == nil {
+		return n
+	}
+	return def
+}
+
+// getenvDuration 读取时长环境变量（如 "30s"、"5m"），缺省或格式错误时返回默认值
+func getenvDuration(k string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(getenvDefault(k, "")); err == nil {
+		return d
+	}
+	return def
+}
+
+// cacheEntry 是一条缓存的搜索结果；covers 判断某个位置的写入是否可能影响该结果
+type cacheEntry struct {
+	key     string
+	expires time.Time
+	covers  func(Location) bool
+	results []PostWithID
+	total   int64
+}
+
+// CacheStats 是缓存计数器的快照
+type CacheStats struct {
+	Entries       int     `json:"entries"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	Evictions     int64   `json:"evictions"`
+	Invalidations int64   `json:"invalidations"`
+	HitRatio      float64 `json:"hit_ratio"`
+}
+
+// SearchCache 是按规范化查询参数索引的 LRU 缓存；max <= 0 时关闭
+type SearchCache struct {
+	mu    sync.Mutex
+	max   int
+	ttl   time.Duration
+	ll    *list.List // 最近使用的在前
+	items map[string]*list.Element
+	stats CacheStats
+}
+
+func newSearchCache(max int, ttl time.Duration) *SearchCache {
+	return &SearchCache{max: max, ttl: ttl, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// Enabled 报告缓存是否开启
+func (c *SearchCache) Enabled() bool {
+	return c.max > 0 && c.ttl > 0
+}
+
+// Get 返回未过期的缓存结果，并更新命中/未命中计数
+func (c *SearchCache) Get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if time.Now().Before(e.expires) {
+			c.ll.MoveToFront(el)
+			c.stats.Hits++
+			return e, true
+		}
+		c.removeElement(el)
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// Put 写入一条结果；超过容量时淘汰最久未使用的条目
+func (c *SearchCache) Put(key string, covers func(Location) bool, results []PostWithID, total int64) {
+	if !c.Enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &cacheEntry{key: key, expires: time.Now().Add(c.ttl), covers: covers, results: results, total: total}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	for c.ll.Len() > c.max {
+		c.removeElement(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// InvalidateAt 删除所有覆盖该位置的条目（发帖、删帖后调用）
+func (c *SearchCache) InvalidateAt(loc Location) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*cacheEntry).covers(loc) {
+			c.removeElement(el)
+			c.stats.Invalidations++
+		}
+		el = next
+	}
+}
+
+func (c *SearchCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
+
+// Stats 返回计数器快照
+func (c *SearchCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = c.ll.Len()
+	if n := s.Hits + s.Misses; n > 0 {
+		s.HitRatio = float64(s.Hits) / float64(n)
+	}
+	return s
+}
+
+// cacheKey 使用规范化参数的 JSON 作为缓存键（结构体字段顺序固定，序列化结果稳定）
+func cacheKey(p SearchParams) string {
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+// coverage 返回判断“某位置的写入是否影响该查询结果”的函数：
+// 半径模式看是否在圆内，视野模式看是否在框内；最近邻结果与距离无上限，任何写入都可能影响。
+func (p SearchParams) coverage() func(Location) bool {
+	switch p.Mode {
+	case modeViewport:
+		vp := *p.Viewport
+		return vp.Contains
+	case modeRadius:
+		center, r := *p.Center, p.RangeM
+		return func(loc Location) bool { return haversineMeters(center, loc) <= r }
+	default:
+		return func(Location) bool { return true }
+	}
+}
+
+// snapViewport 将视野向外扩展并对齐到网格。网格边长取 2 的整数次幂（度），约为视野跨度的 1/4，
+// 因此同一缩放级别下的小幅平移会得到相同的对齐结果。
+func snapViewport(vp Viewport) Viewport {
+	east := vp.East
+	if vp.CrossesAntimeridian() {
+		east += 360
+	}
+	span := math.Max(vp.North-vp.South, east-vp.West)
+	cell := math.Pow(2, math.Ceil(math.Log2(math.Max(span/4, 1.0/1024))))
+
+	north := math.Ceil(vp.North/cell) * cell
+	south := math.Floor(vp.South/cell) * cell
+	east = math.Ceil(east/cell) * cell
+	west := math.Floor(vp.West/cell) * cell
+	snapped, err := newViewport(north, south, east, west)
+	if err != nil {
+		return vp
+	}
+	return snapped
+}
+
+// handlerCacheStats：GET /cache/stats 返回搜索缓存的命中/未命中等计数
+func handlerCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, searchCache.Stats())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapViewport(t *testing.T) {
+	tests := []struct {
+		name string
+		vp   Viewport
+		want Viewport
+	}{
+		{"already aligned", Viewport{North: 41, South: 40, East: -73, West: -75}, Viewport{North: 41, South: 40, East: -73, West: -75}},
+		{"small pan inside the cell", Viewport{North: 40.9, South: 40.1, East: -73.2, West: -74.8}, Viewport{North: 41, South: 40, East: -73, West: -75}},
+		{"another pan, same zoom", Viewport{North: 40.8, South: 40.05, East: -73.1, West: -74.6}, Viewport{North: 41, South: 40, East: -73, West: -75}},
+		{"crossing antimeridian", Viewport{North: 0, South: -20, East: -170, West: 170}, Viewport{North: 0, South: -24, East: -168, West: 168}},
+		{"whole world", Viewport{North: 90, South: -90, East: 180, West: -180}, Viewport{North: 90, South: -90, East: 180, West: -180}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snapViewport(tt.vp); got != tt.want {
+				t.Errorf("snapViewport(%+v) = %+v, want %+v", tt.vp, got, tt.want)
+			}
+		})
+	}
+}
+
+// 对齐后的视野必须包含原视野，否则裁剪时会漏掉帖子
+func TestSnapViewportContainsOriginal(t *testing.T) {
+	viewports := []Viewport{
+		{North: 40.9, South: 40.1, East: -73.2, West: -74.8},
+		{North: 0.001, South: -0.001, East: 0.001, West: -0.001},
+		{North: -10, South: -25, East: -175, West: 172},
+		{North: 89.9, South: 60, East: 10, West: -10},
+		{North: 10, South: 0, East: 180, West: 179.9},
+	}
+	for _, vp := range viewports {
+		snapped := snapViewport(vp)
+		for _, corner := range []Location{
+			{Lat: vp.North, Lon: vp.East}, {Lat: vp.North, Lon: vp.West},
+			{Lat: vp.South, Lon: vp.East}, {Lat: vp.South, Lon: vp.West},
+		} {
+			if !snapped.Contains(corner) {
+				t.Errorf("snapViewport(%+v) = %+v does not contain %+v", vp, snapped, corner)
+			}
+		}
+	}
+}
+
+func TestSearchCacheInvalidateAt(t *testing.T) {
+	c := newSearchCache(10, time.Minute)
+	nyc := SearchParams{Mode: modeRadius, Center: &Location{Lat: 40.7, Lon: -74}, RangeM: 20000, Limit: 10}
+	pacific, _ := newViewport(0, -20, 190, 170)
+	fiji := SearchParams{Mode: modeViewport, Viewport: &pacific, Limit: 10}
+	nearest := SearchParams{Mode: modeNearest, Center: &Location{Lat: 0, Lon: 0}, K: 5, Limit: 5}
+	for _, p := range []SearchParams{nyc, fiji, nearest} {
+		c.Put(cacheKey(p), p.coverage(), nil, 0)
+	}
+
+	// 纽约附近的写入：只影响半径查询与最近邻查询
+	c.InvalidateAt(Location{Lat: 40.71, Lon: -74.01})
+	if _, ok := c.Get(cacheKey(nyc)); ok {
+		t.Error("radius entry covering the write was not invalidated")
+	}
+	if _, ok := c.Get(cacheKey(nearest)); ok {
+		t.Error("nearest entry was not invalidated")
+	}
+	if _, ok := c.Get(cacheKey(fiji)); !ok {
+		t.Error("viewport entry far from the write was invalidated")
+	}
+
+	// 日界线西侧的写入：落在跨日界线视野的另一半内
+	c.InvalidateAt(Location{Lat: -14, Lon: -172})
+	if _, ok := c.Get(cacheKey(fiji)); ok {
+		t.Error("antimeridian viewport entry was not invalidated")
+	}
+	if s := c.Stats(); s.Invalidations != 3 || s.Entries != 0 {
+		t.Errorf("stats = %+v, want 3 invalidations and no entries", s)
+	}
+}
+
+func TestSearchCacheExpiryAndEviction(t *testing.T) {
+	c := newSearchCache(2, time.Minute)
+	all := func(Location) bool { return true }
+	c.Put("a", all, nil, 0)
+	c.Put("b", all, nil, 0)
+	c.Get("a") // a 变为最近使用
+	c.Put("c", all, nil, 0)
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("recently used entry was evicted")
+	}
+
+	expired := newSearchCache(2, time.Nanosecond)
+	expired.Put("a", all, nil, 0)
+	time.Sleep(time.Millisecond)
+	if _, ok := expired.Get("a"); ok {
+		t.Error("expired entry was returned")
+	}
+
+	if off := newSearchCache(0, time.Minute); off.Enabled() {
+		t.Error("cache with size 0 should be disabled")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 变更流：帖子的每次写入（发帖、批量导入、编辑、删除、恢复、永久删除、到期清理）在写入成功后
+// 追加一条变更事件。事件按序号（cursor）严格递增，持久保存在存储后端中（ES 为 post_changes 索引，
+// sqlite 为 post_changes 表，memory 为进程内存），下游服务（统计、通知）可以按序读取，并从上次的 cursor 继续。
+//   - GET /changes?since=<cursor>[&limit=100][&wait=30s]：返回序号大于 since 的事件（升序）；
+//     没有新事件时最多等待 wait（长轮询），有新事件立即返回。since=now 表示从当前最新位置开始，
+//     省略时从头读取。响应中的 cursor 用作下一次请求的 since。
+//
+// 只有管理员与 CHANGE_FEED_USERS 中的用户可以读取。
+//
+// 写入与事件经由 writeWithChanges 一起完成：
+//   - sqlite 后端在同一事务中写入帖子与事件，任一失败都整体回滚，接口返回错误
+//   - ES 与 memory 后端先写帖子再追加事件；追加失败的事件进入补写队列（changeOutbox），由后台任务按顺序重试。
+//     队列只在进程内存中：进程在补写成功之前退出时这些事件丢失；队列已满时接口返回错误
+//
+// 相关环境变量：
+//   - CHANGE_FEED_USERS：可读取变更流的用户（逗号分隔），供下游服务使用的只读账号
+//   - CHANGES_POLL_INTERVAL：长轮询期间检查其他实例写入的间隔（默认 1s）
+//   - CHANGES_RETRY_INTERVAL：补写队列的重试间隔（默认 5s）
+
+// CHANGES_INDEX 存放变更事件（ES 后端），文档 ID 为序号；CHANGES_SEQ_INDEX 中的计数文档负责分配序号
+const (
+	CHANGES_INDEX     = "post_changes"
+	CHANGES_SEQ_INDEX = "post_changes_seq"
+)
+
+// changesMapping：帖子内容只存不索引
+const changesMapping = `{
+	"mappings": {
+		"properties": {
+			"seq":     { "type": "long" },
+			"type":    { "type": "keyword" },
+			"post_id": { "type": "keyword" },
+			"user":    { "type": "keyword" },
+			"actor":   { "type": "keyword" },
+			"at":      { "type": "date" },
+			"post":    { "type": "object", "enabled": false }
+		}
+	}
+}`
+
+const changesSeqMapping = `{
+	"mappings": {
+		"properties": {
+			"value": { "type": "long" }
+		}
+	}
+}`
+
+// 变更类型
+const (
+	changeCreated  = "created"
+	changeUpdated  = "updated"
+	changeDeleted  = "deleted"  // 移入回收站
+	changeRestored = "restored" // 从回收站恢复
+	changePurged   = "purged"   // 回收站保留期满，永久删除
+	changeExpired  = "expired"  // 限时帖子到期，永久删除
+)
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+	defaultChangesWait  = 30 * time.Second
+	maxChangesWait      = 60 * time.Second
+	maxChangeOutbox     = 10000 // 补写队列最多容纳的事件数
+)
+
+var (
+	changeFeedUsers      = parseUserSet(getenvDefault("CHANGE_FEED_USERS", ""))
+	changesPollInterval  = getenvDuration("CHANGES_POLL_INTERVAL", time.Second)
+	changesRetryInterval = getenvDuration("CHANGES_RETRY_INTERVAL", 5*time.Second)
+)
+
+// ChangeEvent 是一条变更事件；Post 为写入后的帖子内容，永久删除类事件没有 Post
+type ChangeEvent struct {
+	Seq    int64     `json:"seq"`
+	Type   string    `json:"type"`
+	PostID string    `json:"post_id"`
+	User   string    `json:"user,omitempty"`  // 帖子作者
+	Actor  string    `json:"actor,omitempty"` // 执行操作的用户；后台任务为空
+	At     time.Time `json:"at"`
+	Post   *Post     `json:"post,omitempty"`
+}
+
+// ChangesResponse 是 /changes 的响应
+type ChangesResponse struct {
+	Events []ChangeEvent `json:"events"`
+	Cursor string        `json:"cursor"`
+}
+
+// ChangeLog 是变更事件的持久存储
+type ChangeLog interface {
+	// Append 按顺序追加事件，为每条事件分配递增的序号（写回 events[i].Seq）
+	Append(ctx context.Context, events []ChangeEvent) error
+	// Since 按序号升序返回序号大于 cursor 的事件，至多 limit 条
+	Since(ctx context.Context, cursor int64, limit int) ([]ChangeEvent, error)
+	// Latest 返回当前最大的序号（没有事件时为 0）
+	Latest(ctx context.Context) (int64, error)
+}
+
+// changeLog 在 openRepositories 中随存储后端一起初始化
+var changeLog ChangeLog
+
+// parseUserSet 解析逗号分隔的用户名列表（统一转为小写）
+func parseUserSet(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.ToLower(strings.TrimSpace(u)); u != "" {
+			set[u] = true
+		}
+	}
+	return set
+}
+
+// newChange 生成一条事件；purged / expired 事件不携带帖子内容
+func newChange(typ, id string, p *Post, actor string) ChangeEvent {
+	e := ChangeEvent{Type: typ, PostID: id, Actor: actor, At: time.Now().UTC()}
+	if p != nil {
+		e.User = p.User
+		if typ != changePurged && typ != changeExpired {
+			c := clonePost(*p)
+			e.Post = &c
+		}
+	}
+	return e
+}
+
+// transactor 由能把帖子写入与变更追加放进同一事务的存储实现（sqlite）
+type transactor interface {
+	// InTx 在一个事务中执行 fn：fn 中经由 ctx 进行的写入一起提交，fn 返回错误时一起回滚
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// writeWithChanges 执行帖子写入 write 并追加它返回的事件，返回已生效的写入所对应的事件：
+//   - 存储支持事务时两者在同一事务中提交；write 或追加失败时整体回滚，不返回事件
+//   - 否则由 recordChanges 在写入后追加；write 部分失败（如批量写入）时仍记录并返回已生效部分的事件
+//
+// 调用方据返回的事件决定写入后的处理（删除图片、使缓存失效等），据错误决定响应
+func writeWithChanges(ctx context.Context, write func(ctx context.Context) ([]ChangeEvent, error)) ([]ChangeEvent, error) {
+	tx, ok := postRepo.(transactor)
+	if !ok {
+		events, err := write(ctx)
+		if rerr := recordChanges(ctx, events...); err == nil {
+			err = rerr
+		}
+		return events, err
+	}
+	var events []ChangeEvent
+	err := tx.InTx(ctx, func(ctx context.Context) error {
+		var err error
+		if events, err = write(ctx); err != nil || len(events) == 0 || changeLog == nil {
+			return err
+		}
+		if err := changeLog.Append(ctx, events); err != nil {
+			return fmt.Errorf("record change: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	changeWaiters.notify()
+	return events, nil
+}
+
+// errChangesNotRecorded：写入已经生效，但事件既没有追加成功，也无法放入补写队列
+var errChangesNotRecorded = errors.New("change event not recorded")
+
+// writeChangesNotRecorded 为 errChangesNotRecorded 写好 500 响应，说明写入本身已经生效，客户端不应重试
+func writeChangesNotRecorded(w http.ResponseWriter, err error) {
+	http.Error(w, "write applied, but "+err.Error(), http.StatusInternalServerError)
+}
+
+// recordChanges 追加已生效的写入的事件并唤醒等待中的 /changes 请求。
+// 追加失败的事件放入补写队列；队列中还有事件时新事件直接排在后面，保持事件顺序。只有队列已满时返回错误
+func recordChanges(ctx context.Context, events ...ChangeEvent) error {
+	if len(events) == 0 || changeLog == nil {
+		return nil
+	}
+	if changeOutbox.len() == 0 {
+		err := changeLog.Append(ctx, events)
+		if err == nil {
+			changeWaiters.notify()
+			return nil
+		}
+		log.Printf("[changes] append %d event(s) (%s %s ...) failed, queued for retry: %v", len(events), events[0].Type, events[0].PostID, err)
+	}
+	return changeOutbox.add(events)
+}
+
+// changeQueue 是等待补写的事件，按产生顺序排列
+type changeQueue struct {
+	mu      sync.Mutex
+	events  []ChangeEvent
+	flushMu sync.Mutex // 同一时间只有一个 flush
+}
+
+var changeOutbox = &changeQueue{}
+
+func (q *changeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
+
+func (q *changeQueue) add(events []ChangeEvent) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.events)+len(events) > maxChangeOutbox {
+		return fmt.Errorf("%w: retry queue is full (%d event(s) waiting)", errChangesNotRecorded, len(q.events))
+	}
+	q.events = append(q.events, events...)
+	return nil
+}
+
+// flush 按顺序补写队列中的事件，遇到失败时停止，返回剩余的事件数。
+// 追加请求失败时部分事件可能其实已经写入（ES 批量写入），重试会使它们重复出现
+func (q *changeQueue) flush(ctx context.Context) (int, error) {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	for {
+		q.mu.Lock()
+		batch := append([]ChangeEvent(nil), q.events[:min(len(q.events), maxChangesLimit)]...)
+		q.mu.Unlock()
+		if len(batch) == 0 {
+			return 0, nil
+		}
+		if err := changeLog.Append(ctx, batch); err != nil {
+			return q.len(), err
+		}
+		q.mu.Lock()
+		q.events = q.events[len(batch):]
+		q.mu.Unlock()
+		changeWaiters.notify()
+	}
+}
+
+// runChangeOutbox 定期补写追加失败的事件
+func runChangeOutbox(ctx context.Context) {
+	interval := changesRetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if changeOutbox.len() == 0 {
+			continue
+		}
+		if left, err := changeOutbox.flush(ctx); err != nil {
+			log.Printf("[changes] retry failed, %d event(s) waiting: %v", left, err)
+		} else {
+			log.Printf("[changes] queued events recorded")
+		}
+	}
+}
+
+// changeNotifier 在本实例追加事件时唤醒所有等待者
+type changeNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+var changeWaiters = &changeNotifier{}
+
+// wait 返回在下一次 notify 时关闭的 channel
+func (n *changeNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *changeNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// handlerChanges：GET /changes
+func handlerChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username := usernameFromCtx(r.Context())
+	if username == "" {
+		http.Error(w, "missing user in context", http.StatusUnauthorized)
+		return
+	}
+	if !isAdminFromCtx(r.Context()) && !changeFeedUsers[strings.ToLower(username)] {
+		http.Error(w, "forbidden: change feed is limited to admins and CHANGE_FEED_USERS", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	limit, err := parseLimit("limit", q.Get("limit"), defaultChangesLimit, maxChangesLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	wait := defaultChangesWait
+	if raw := q.Get("wait"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, invalidParam("wait", `must be a duration like "30s"`))
+			return
+		}
+		if d < 0 || d > maxChangesWait {
+			writeError(w, http.StatusBadRequest, outOfRange("wait", "must be between 0s and "+maxChangesWait.String()))
+			return
+		}
+		wait = d
+	}
+	var cursor int64
+	switch raw := strings.TrimSpace(q.Get("since")); raw {
+	case "":
+	case "now":
+		if cursor, err = changeLog.Latest(r.Context()); err != nil {
+			http.Error(w, "failed to read change feed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		if cursor, err = strconv.ParseInt(raw, 10, 64); err != nil || cursor < 0 {
+			writeError(w, http.StatusBadRequest, invalidParam("since", `must be a cursor returned by /changes or "now"`))
+			return
+		}
+	}
+
+	// 长轮询：先注册等待再查询，避免错过两者之间追加的事件；其他实例写入的事件靠定期查询发现
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	poll := changesPollInterval
+	if poll <= 0 {
+		poll = time.Second
+	}
+	for {
+		woken := changeWaiters.wait()
+		events, err := changeLog.Since(r.Context(), cursor, limit)
+		if err != nil {
+			http.Error(w, "failed to read change feed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(events) > 0 {
+			cursor = events[len(events)-1].Seq
+		}
+		if len(events) > 0 || wait == 0 {
+			writeJSON(w, http.StatusOK, ChangesResponse{Events: nonNilEvents(events), Cursor: strconv.FormatInt(cursor, 10)})
+			return
+		}
+		select {
+		case <-woken:
+		case <-time.After(poll):
+		case <-deadline.C:
+			writeJSON(w, http.StatusOK, ChangesResponse{Events: []ChangeEvent{}, Cursor: strconv.FormatInt(cursor, 10)})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// nonNilEvents 保证响应中的 events 为 [] 而不是 null
+func nonNilEvents(events []ChangeEvent) []ChangeEvent {
+	if events == nil {
+		return []ChangeEvent{}
+	}
+	return events
+}
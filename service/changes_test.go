@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// changeIDs 返回事件的 "类型:帖子 ID"
+func changeIDs(events []ChangeEvent) []string {
+	out := make([]string, 0, len(events))
+	for _, e := range events {
+		out = append(out, e.Type+":"+e.PostID)
+	}
+	return out
+}
+
+// 下游按 cursor 分段读取，并在重启后从保存的 cursor 继续：不遗漏、不重复
+func TestChangeLogResume(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "changes.db")
+	open := map[string]func(t *testing.T) ChangeLog{
+		"memory": func() func(t *testing.T) ChangeLog {
+			l := &memoryChangeLog{}
+			return func(t *testing.T) ChangeLog { return l }
+		}(),
+		// 每次重新打开数据库文件，相当于服务重启
+		"sqlite": func(t *testing.T) ChangeLog {
+			db, err := openSQLite(ctx, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return &sqliteChangeLog{db: db}
+		},
+	}
+	for name, open := range open {
+		t.Run(name, func(t *testing.T) {
+			l := open(t)
+			if seq, err := l.Latest(ctx); err != nil || seq != 0 {
+				t.Fatalf("Latest of an empty log = %d, %v", seq, err)
+			}
+			first := []ChangeEvent{newChange(changeCreated, "a", &Post{User: "kimi"}, "kimi"), newChange(changeCreated, "b", &Post{User: "kimi"}, "kimi")}
+			if err := l.Append(ctx, first); err != nil {
+				t.Fatal(err)
+			}
+			if first[0].Seq != 1 || first[1].Seq != 2 {
+				t.Fatalf("assigned seqs %d, %d", first[0].Seq, first[1].Seq)
+			}
+			if err := l.Append(ctx, []ChangeEvent{newChange(changeUpdated, "a", &Post{User: "kimi"}, "kimi")}); err != nil {
+				t.Fatal(err)
+			}
+
+			page, err := l.Since(ctx, 0, 2)
+			if err != nil || !reflect.DeepEqual(changeIDs(page), []string{"created:a", "created:b"}) {
+				t.Fatalf("first page = %v, %v", changeIDs(page), err)
+			}
+			cursor := page[len(page)-1].Seq
+
+			l = open(t)
+			if err := l.Append(ctx, []ChangeEvent{newChange(changeExpired, "b", &Post{User: "kimi"}, "")}); err != nil {
+				t.Fatal(err)
+			}
+			rest, err := l.Since(ctx, cursor, 10)
+			if err != nil || !reflect.DeepEqual(changeIDs(rest), []string{"updated:a", "expired:b"}) {
+				t.Fatalf("resumed from %d = %v, %v", cursor, changeIDs(rest), err)
+			}
+			if rest[0].Seq != 3 || rest[1].Seq != 4 || rest[0].Post == nil || rest[1].Post != nil {
+				t.Errorf("resumed events = %+v", rest)
+			}
+			if seq, err := l.Latest(ctx); err != nil || seq != 4 {
+				t.Errorf("Latest = %d, %v, want 4", seq, err)
+			}
+			if tail, err := l.Since(ctx, 4, 10); err != nil || len(tail) != 0 {
+				t.Errorf("Since(latest) = %v, %v, want nothing", changeIDs(tail), err)
+			}
+		})
+	}
+}
+
+// flakyChangeLog 在 fail 为 true 时拒绝追加
+type flakyChangeLog struct {
+	ChangeLog
+	mu   sync.Mutex
+	fail bool
+}
+
+func (l *flakyChangeLog) setFail(fail bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fail = fail
+}
+
+func (l *flakyChangeLog) Append(ctx context.Context, events []ChangeEvent) error {
+	l.mu.Lock()
+	fail := l.fail
+	l.mu.Unlock()
+	if fail {
+		return errors.New("change log unavailable")
+	}
+	return l.ChangeLog.Append(ctx, events)
+}
+
+// useChangeOutbox 在测试期间使用空的补写队列
+func useChangeOutbox(t *testing.T) {
+	old := changeOutbox
+	t.Cleanup(func() { changeOutbox = old })
+	changeOutbox = &changeQueue{}
+}
+
+func newPost(message string) map[string]interface{} {
+	return map[string]interface{}{"message": message, "location": map[string]float64{"lat": 40.71, "lon": -74.0}}
+}
+
+// sqlite：事件与帖子在同一事务中，事件写不进去时帖子也不保存
+func TestSQLiteWriteRollsBackWithoutChange(t *testing.T) {
+	useMemoryStorage(t)
+	lite := newTestSQLite(t)
+	log := &flakyChangeLog{ChangeLog: &sqliteChangeLog{db: lite.db}}
+	postRepo, changeLog = lite, log
+	mux := newTestMux()
+	kimi := loginAs(t, mux, "kimi")
+
+	log.setFail(true)
+	if code := doJSON(t, mux, http.MethodPost, "/post", kimi, newPost("lost"), nil); code != http.StatusInternalServerError {
+		t.Fatalf("POST with the change log down: status %d, want 500", code)
+	}
+	if all := scanAll(t); len(all) != 0 {
+		t.Fatalf("post saved without its change event: %+v", all)
+	}
+
+	log.setFail(false)
+	if code := doJSON(t, mux, http.MethodPost, "/post", kimi, newPost("kept"), nil); code != http.StatusOK {
+		t.Fatalf("POST: status %d", code)
+	}
+	all := scanAll(t)
+	events, err := changeLog.Since(context.Background(), 0, 10)
+	if err != nil || len(all) != 1 || len(events) != 1 || events[0].PostID != all[0].ID {
+		t.Errorf("posts %+v, events %+v, %v: want one post with one event", all, events, err)
+	}
+
+	// 批量写入：单条失败只回滚这一条（保存点嵌套在同一事务中），成功的每条一个事件
+	mux.HandleFunc("/post/bulk", jwtRequired(handlerBulkPost))
+	body := `{"message": "one", "location": {"lat": 1, "lon": 1}}` + "\n" + `{"message": "no location"}` + "\n" +
+		`{"message": "two", "location": {"lat": 2, "lon": 2}}`
+	if code, resp := postBulk(t, mux, kimi, "application/x-ndjson", body); code != http.StatusOK || resp.Created != 2 {
+		t.Fatalf("bulk: status %d, %+v", code, resp)
+	}
+	if events, err := changeLog.Since(context.Background(), 1, 10); err != nil || len(events) != 2 || len(scanAll(t)) != 3 {
+		t.Errorf("after bulk: events %v, %v", changeIDs(events), err)
+	}
+}
+
+// 其他后端：追加失败的事件进入补写队列，之后的事件排在后面，恢复后按顺序补写
+func TestChangeOutboxKeepsOrder(t *testing.T) {
+	useMemoryStorage(t)
+	useChangeOutbox(t)
+	log := &flakyChangeLog{ChangeLog: changeLog}
+	changeLog = log
+	mux := newTestMux()
+	kimi := loginAs(t, mux, "kimi")
+	seedPosts(t, at("p", 40.71, -74.0, "original"))
+
+	log.setFail(true)
+	if code := doJSON(t, mux, http.MethodPatch, "/post/p", kimi, map[string]string{"message": "edited"}, nil); code != http.StatusOK {
+		t.Fatalf("PATCH with the change log down: status %d", code)
+	}
+	log.setFail(false)
+	// 变更流已恢复，但队列中还有更早的事件：这条也要排队
+	if code := doJSON(t, mux, http.MethodDelete, "/delete?id=p", kimi, nil, nil); code != http.StatusOK {
+		t.Fatalf("DELETE: status %d", code)
+	}
+	if events, _ := changeLog.Since(context.Background(), 0, 10); len(events) != 0 {
+		t.Fatalf("events recorded ahead of the queue: %v", changeIDs(events))
+	}
+
+	if left, err := changeOutbox.flush(context.Background()); err != nil || left != 0 {
+		t.Fatalf("flush = %d, %v", left, err)
+	}
+	events, err := changeLog.Since(context.Background(), 0, 10)
+	if err != nil || !reflect.DeepEqual(changeIDs(events), []string{"updated:p", "deleted:p"}) {
+		t.Errorf("events after flush = %v, %v", changeIDs(events), err)
+	}
+}
+
+func TestChangeOutboxFull(t *testing.T) {
+	useMemoryStorage(t)
+	useChangeOutbox(t)
+	changeLog = &flakyChangeLog{ChangeLog: changeLog, fail: true}
+	changeOutbox.events = make([]ChangeEvent, maxChangeOutbox)
+	mux := newTestMux()
+	kimi := loginAs(t, mux, "kimi")
+
+	// 帖子已经保存，但事件无处存放：返回 500 而不是 200
+	if code := doJSON(t, mux, http.MethodPost, "/post", kimi, newPost("unrecorded"), nil); code != http.StatusInternalServerError {
+		t.Errorf("POST with a full queue: status %d, want 500", code)
+	}
+	if all := scanAll(t); len(all) != 1 {
+		t.Errorf("stored %d posts, want the post kept", len(all))
+	}
+	if err := recordChanges(context.Background(), newChange(changeCreated, "x", nil, "")); !errors.Is(err, errChangesNotRecorded) {
+		t.Errorf("recordChanges = %v, want errChangesNotRecorded", err)
+	}
+}
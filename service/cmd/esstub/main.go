@@ -0,0 +1,108 @@
+// esstub 是一个假的 Elasticsearch：每个响应固定延迟 -delay，地理查询（geo_distance / geo_bounding_box）总是返回同一批帖子，
+// 其他查询返回空结果（后台任务因此不会删改这批帖子）。
+// 它只实现服务启动与 /search 用到的接口，配合 cmd/searchbench 测量服务自身（客户端、编解码、中间件）的开销，
+// 不依赖真实集群的负载与网络。
+//
+// 用法（内置用户 bench，密码 bench）：
+//
+//	go run ./cmd/esstub -addr :19200 -delay 2ms &
+//	ES_URLS=http://localhost:19200 SEARCH_CACHE_SIZE=0 go run . &
+//	go run ./cmd/searchbench -user bench -password bench -n 400 -c 8
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	benchUser     = "bench"
+	benchPassword = "bench"
+)
+
+func main() {
+	addr := flag.String("addr", ":19200", "listen address")
+	delay := flag.Duration("delay", 2*time.Millisecond, "latency added to every response")
+	hitCount := flag.Int("hits", 20, "posts returned by every search")
+	flag.Parse()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(benchPassword), bcrypt.MinCost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	user, _ := json.Marshal(map[string]interface{}{
+		"_index": "users", "_id": benchUser, "found": true,
+		"_source": map[string]string{"username": benchUser, "password": string(hash)},
+	})
+
+	hits := make([]string, 0, *hitCount)
+	for i := 0; i < *hitCount; i++ {
+		hits = append(hits, fmt.Sprintf(`{"_index":"posts_v1","_id":"p%d","_score":1,"_source":{"user":"u","message":"hello %d","location":{"lat":40.7,"lon":-74}}}`, i, i))
+	}
+	searchResult := fmt.Sprintf(`{"took":1,"hits":{"total":{"value":%d,"relation":"eq"},"hits":[%s]}}`, len(hits), strings.Join(hits, ","))
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(*delay)
+		w.Header().Set("Content-Type", "application/json")
+		p := r.URL.Path
+		switch {
+		case p == "/":
+			fmt.Fprint(w, `{"version":{"number":"7.17.0"},"tagline":"You Know, for Search"}`)
+		case strings.HasPrefix(p, "/_alias/"):
+			// 每个别名都指向 <alias>_v1，mapping 的 _meta.version 足够大，启动时不会触发迁移
+			a := strings.TrimPrefix(p, "/_alias/")
+			fmt.Fprintf(w, `{"%s_v1":{"aliases":{"%s":{}}}}`, a, a)
+		case strings.HasSuffix(p, "/_mapping") && r.Method == http.MethodGet:
+			index := strings.TrimSuffix(strings.TrimPrefix(p, "/"), "/_mapping")
+			fmt.Fprintf(w, `{"%s":{"mappings":{"_meta":{"version":1000000}}}}`, index)
+		case p == "/users/_doc/"+benchUser:
+			w.Write(user)
+		case strings.Contains(p, "/_doc/") && r.Method == http.MethodGet:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"found":false}`)
+		case strings.HasSuffix(p, "/_mget"):
+			fmt.Fprint(w, `{"docs":[]}`)
+		case strings.HasPrefix(p, "/_tasks/"):
+			fmt.Fprint(w, `{"completed":true,"task":{"status":{}}}`)
+		case strings.HasSuffix(p, "/_update_by_query"):
+			fmt.Fprint(w, `{"task":"n:1"}`)
+		case strings.HasSuffix(p, "/_search") && r.URL.Query().Get("scroll") != "":
+			fmt.Fprint(w, `{"_scroll_id":"s","hits":{"total":{"value":0,"relation":"eq"},"hits":[]}}`)
+		case strings.HasPrefix(p, "/_search/scroll"):
+			fmt.Fprint(w, `{"succeeded":true}`)
+		case strings.HasSuffix(p, "/_search"):
+			b, _ := io.ReadAll(r.Body)
+			if strings.Contains(string(b), `"geo_`) {
+				fmt.Fprint(w, searchResult)
+			} else {
+				fmt.Fprint(w, `{"took":1,"hits":{"total":{"value":0,"relation":"eq"},"hits":[]}}`)
+			}
+		case strings.HasSuffix(p, "/_bulk"):
+			b, _ := io.ReadAll(r.Body)
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			items := make([]string, 0, len(lines)/2)
+			for i := 0; i+1 < len(lines); i += 2 {
+				var action map[string]map[string]string
+				_ = json.Unmarshal([]byte(lines[i]), &action)
+				for op, meta := range action {
+					items = append(items, fmt.Sprintf(`{"%s":{"_id":"%s","status":200,"result":"updated"}}`, op, meta["_id"]))
+				}
+			}
+			fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items, ","))
+		case strings.Contains(p, "/_doc/") || strings.Contains(p, "/_create/") || strings.Contains(p, "/_update/"):
+			fmt.Fprint(w, `{"_index":"stub","_id":"x","_version":1,"_seq_no":1,"_primary_term":1,"result":"created"}`)
+		default:
+			fmt.Fprint(w, `{"acknowledged":true}`)
+		}
+	})
+	log.Printf("esstub listening on %s (delay %s)", *addr, *delay)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
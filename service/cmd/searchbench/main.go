@@ -0,0 +1,139 @@
+// searchbench 对运行中的服务反复发起 /search 请求，统计延迟分布，用于对比不同版本或配置的性能。
+//
+// 用法（先关闭搜索缓存，避免测到的只是缓存命中：SEARCH_CACHE_SIZE=0）：
+//
+//	go run ./cmd/searchbench -user kimi -password secret -n 500 -c 8 \
+//	    -query "lat=40.7&lon=-74&range=20km"
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+func main() {
+	base := flag.String("url", "http://localhost:8080", "service base URL")
+	token := flag.String("token", os.Getenv("TOKEN"), "JWT (defaults to $TOKEN; or use -user/-password to log in)")
+	user := flag.String("user", "", "username to log in with when -token is empty")
+	password := flag.String("password", "", "password for -user")
+	query := flag.String("query", "lat=40.7&lon=-74&range=20km", "query string sent to /search")
+	n := flag.Int("n", 200, "number of measured requests")
+	c := flag.Int("c", 4, "concurrent workers")
+	warmup := flag.Int("warmup", 10, "unmeasured requests sent first")
+	flag.Parse()
+
+	if *token == "" {
+		t, err := login(*base, *user, *password)
+		if err != nil {
+			log.Fatalf("login: %v", err)
+		}
+		*token = t
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	do := func() (time.Duration, error) {
+		req, err := http.NewRequest(http.MethodGet, *base+"/search?"+*query, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+*token)
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return time.Since(start), nil
+	}
+
+	for i := 0; i < *warmup; i++ {
+		if _, err := do(); err != nil {
+			log.Fatalf("warmup request failed: %v", err)
+		}
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		failed    int
+		wg        sync.WaitGroup
+	)
+	jobs := make(chan struct{})
+	started := time.Now()
+	for w := 0; w < *c; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				d, err := do()
+				mu.Lock()
+				if err != nil {
+					failed++
+				} else {
+					latencies = append(latencies, d)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < *n; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	if len(latencies) == 0 {
+		log.Fatalf("all %d requests failed", failed)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, d := range latencies {
+		sum += d
+	}
+	pct := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Printf("requests: %d ok, %d failed, concurrency %d, %.1f req/s\n",
+		len(latencies), failed, *c, float64(len(latencies))/elapsed.Seconds())
+	fmt.Printf("latency:  mean %v  p50 %v  p90 %v  p99 %v  max %v\n",
+		(sum / time.Duration(len(latencies))).Round(time.Microsecond),
+		pct(0.50).Round(time.Microsecond), pct(0.90).Round(time.Microsecond),
+		pct(0.99).Round(time.Microsecond), latencies[len(latencies)-1].Round(time.Microsecond))
+}
+
+// login 调用 /login 换取 JWT
+func login(base, user, password string) (string, error) {
+	if user == "" {
+		return "", fmt.Errorf("either -token or -user is required")
+	}
+	body, _ := json.Marshal(map[string]string{"username": user, "password": password})
+	resp, err := http.Post(base+"/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Token, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// 乐观并发控制：帖子的每次写入都会产生新的版本（ES 为 _seq_no / _primary_term，sqlite / memory 为写入序号），
+// 以 ETag 响应头返回给客户端。编辑、删除与恢复接口接受 If-Match 请求头：
+//   - If-Match 与帖子当前版本不符时返回 412 Precondition Failed，不做任何修改
+//   - 这些接口的写入始终以读取时的版本为条件；读取之后、写入之前帖子被其他请求修改时，
+//     带 If-Match 的请求返回 412，不带的返回 409 Conflict（客户端可重新读取后重试）
+// GET /post/{id} 同样返回 ETag，并支持 If-None-Match（未变化时返回 304）。
+
+// PostVersion 是帖子的版本；sqlite / memory 后端的 PrimaryTerm 恒为 0
+type PostVersion struct {
+	SeqNo       int64
+	PrimaryTerm int64
+}
+
+// ETag 返回版本对应的强校验 ETag（带引号）
+func (v PostVersion) ETag() string {
+	return fmt.Sprintf(`"%d-%d"`, v.SeqNo, v.PrimaryTerm)
+}
+
+// matchesETag 判断 If-Match / If-None-Match 形式的 ETag 列表中是否包含 etag；"*" 匹配任意版本。
+// 按强比较处理：W/ 开头的弱 ETag 不会匹配
+func matchesETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch 检查 If-Match 请求头；不满足时写好 412 响应并返回 false
+func checkIfMatch(w http.ResponseWriter, r *http.Request, ver PostVersion) bool {
+	h := r.Header.Get("If-Match")
+	if h == "" || matchesETag(h, ver.ETag()) {
+		return true
+	}
+	w.Header().Set("ETag", ver.ETag())
+	http.Error(w, "precondition failed: post has been modified", http.StatusPreconditionFailed)
+	return false
+}
+
+// writeVersionConflict 在条件写入失败（帖子在读取后被修改）时写好响应
+func writeVersionConflict(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("If-Match") != "" {
+		http.Error(w, "precondition failed: post has been modified", http.StatusPreconditionFailed)
+		return
+	}
+	http.Error(w, "conflict: post was modified concurrently; reload and retry", http.StatusConflict)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchesETag(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"3-0"`, true},
+		{`"2-0"`, false},
+		{`*`, true},
+		{`"1-0", "3-0"`, true},
+		{`"1-0","2-0"`, false},
+		{`W/"3-0"`, false}, // 强比较：弱 ETag 不匹配
+		{`3-0`, false},
+	}
+	for _, tt := range tests {
+		if got := matchesETag(tt.header, `"3-0"`); got != tt.want {
+			t.Errorf("matchesETag(%s) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// withHeader 发送带条件请求头的 JSON 请求，返回完整的响应
+func withHeader(t *testing.T, h http.Handler, method, target, token, header, value string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, target, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	if value != "" {
+		req.Header.Set(header, value)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIfMatchPreconditions(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTestMux()
+	kimi := loginAs(t, mux, "kimi")
+	seedPosts(t, at("p", 40.71, -74.0, "original"))
+
+	rec := withHeader(t, mux, http.MethodGet, "/post/p", kimi, "", "", nil)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET: status %d, ETag %q", rec.Code, etag)
+	}
+	if rec := withHeader(t, mux, http.MethodGet, "/post/p", kimi, "If-None-Match", etag, nil); rec.Code != http.StatusNotModified {
+		t.Errorf("GET with If-None-Match: status %d, want 304", rec.Code)
+	}
+
+	// 版本不符：412，附带当前 ETag，帖子不变
+	edit := map[string]string{"message": "edited"}
+	rec = withHeader(t, mux, http.MethodPatch, "/post/p", kimi, "If-Match", `"999-0"`, edit)
+	if rec.Code != http.StatusPreconditionFailed || rec.Header().Get("ETag") != etag {
+		t.Fatalf("PATCH with a stale If-Match: status %d, ETag %q, want 412 and %s", rec.Code, rec.Header().Get("ETag"), etag)
+	}
+	if p, _ := postRepo.Get(context.Background(), "p"); p.Message != "original" {
+		t.Errorf("post changed by a failed precondition: %q", p.Message)
+	}
+
+	// 版本相符：写入成功，返回新的 ETag；旧 ETag 随即失效
+	rec = withHeader(t, mux, http.MethodPatch, "/post/p", kimi, "If-Match", etag, edit)
+	newTag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || newTag == "" || newTag == etag {
+		t.Fatalf("PATCH with the current If-Match: status %d, ETag %q", rec.Code, newTag)
+	}
+	if rec := withHeader(t, mux, http.MethodDelete, "/delete?id=p", kimi, "If-Match", etag, nil); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with the replaced ETag: status %d, want 412", rec.Code)
+	}
+	if rec := withHeader(t, mux, http.MethodDelete, "/delete?id=p", kimi, "If-Match", newTag, nil); rec.Code != http.StatusOK {
+		t.Errorf("DELETE with the current ETag: status %d", rec.Code)
+	}
+}
+
+// racingRepo 在 race 开启时，每次 GetVersioned 读取之后立即模拟另一个请求写入同一帖子
+type racingRepo struct {
+	PostRepository
+	race bool
+}
+
+func (r *racingRepo) GetVersioned(ctx context.Context, id string) (*Post, PostVersion, error) {
+	p, ver, err := r.PostRepository.GetVersioned(ctx, id)
+	if err == nil && r.race {
+		other := *p
+		other.Message = "written concurrently"
+		if err := r.PostRepository.Save(ctx, id, &other); err != nil {
+			return nil, PostVersion{}, err
+		}
+	}
+	return p, ver, err
+}
+
+// 读取之后、条件写入之前帖子被修改：带 If-Match 返回 412，不带返回 409，均不覆盖对方的写入
+func TestConcurrentWriteConflict(t *testing.T) {
+	for _, tt := range []struct {
+		name, method, target string
+		body                 interface{}
+	}{
+		{"edit", http.MethodPatch, "/post/p", map[string]string{"message": "edited"}},
+		{"delete", http.MethodDelete, "/delete?id=p", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryStorage(t)
+			repo := &racingRepo{PostRepository: postRepo}
+			postRepo = repo
+			mux := newTestMux()
+			kimi := loginAs(t, mux, "kimi")
+			seedPosts(t, at("p", 40.71, -74.0, "original"))
+			etag := withHeader(t, mux, http.MethodGet, "/post/p", kimi, "", "", nil).Header().Get("ETag")
+
+			repo.race = true
+			if rec := withHeader(t, mux, tt.method, tt.target, kimi, "", "", tt.body); rec.Code != http.StatusConflict {
+				t.Errorf("without If-Match: status %d, want 409", rec.Code)
+			}
+			if rec := withHeader(t, mux, tt.method, tt.target, kimi, "If-Match", "*", tt.body); rec.Code != http.StatusPreconditionFailed {
+				t.Errorf("with If-Match *: status %d, want 412", rec.Code)
+			}
+			repo.race = false
+
+			p, err := postRepo.Get(context.Background(), "p")
+			if err != nil || p.Message != "written concurrently" || p.DeletedAt != nil {
+				t.Errorf("post after conflicts = %+v, %v, want the concurrent write kept", p, err)
+			}
+			if rec := withHeader(t, mux, http.MethodGet, "/post/p", kimi, "If-None-Match", etag, nil); rec.Code != http.StatusOK {
+				t.Errorf("GET with the pre-race ETag: status %d, want 200", rec.Code)
+			}
+		})
+	}
+}
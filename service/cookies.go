@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 网页会话（Cookie 模式）：/login 请求体带 "session": "cookie" 时，令牌不出现在响应体中（脚本读不到），而是写入 Cookie：
+//   - gc_access：访问令牌（HttpOnly），jwtRequired 在请求没有 Authorization 头时读取它
+//   - gc_refresh：刷新令牌（HttpOnly），/token/refresh 与 /logout 在请求体没有 refresh_token 时读取它
+//   - gc_csrf：CSRF 令牌（脚本可读），同时以 csrf_token 出现在响应体中；每次登录与刷新都会更换
+//
+// Cookie 均为 HttpOnly（gc_csrf 除外）、SameSite=Strict、Path=/；默认还带 Secure，名称带 __Host- 前缀
+// （浏览器只接受本站以 Secure、Path=/、不带 Domain 设置的这类 Cookie，子域无法注入或覆盖）。
+// 以 Cookie 认证的 POST / PUT / PATCH / DELETE 请求（/post、/delete 以及其他写操作、/token/refresh、/logout）
+// 必须在 X-CSRF-Token 头中带上与 gc_csrf Cookie 相同的值（double-submit），否则返回 403。
+// 带 Authorization: Bearer 头的 API 客户端不受影响。
+// Cookie 模式的 /login 还要求请求来自本站页面（必须带 Sec-Fetch-Site 或 Origin 且与本站一致），防止他站把浏览器登录到攻击者的账号（login CSRF）。
+//
+// 相关环境变量：
+//   - COOKIE_SECURE：默认 "1"，总是带 Secure；"0" 总是不带（仅用于本地 http 开发）；
+//     "auto" 按请求判断：直接以 TLS 访问或 X-Forwarded-Proto 为 https（TLS 在代理处终止）时才带 Secure
+
+var cookieSecureMode = getenvDefault("COOKIE_SECURE", "1")
+
+const (
+	accessCookie  = "gc_access"
+	refreshCookie = "gc_refresh"
+	csrfCookie    = "gc_csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// 登录请求中的 session 取值
+const (
+	sessionModeBearer = "bearer"
+	sessionModeCookie = "cookie"
+)
+
+// cookieSecure 判断本次请求的会话 Cookie 是否带 Secure（见 COOKIE_SECURE）
+func cookieSecure(r *http.Request) bool {
+	switch cookieSecureMode {
+	case "0":
+		return false
+	case "auto":
+		return requestIsHTTPS(r)
+	}
+	return true
+}
+
+// requestIsHTTPS 判断客户端是否经 https 访问：直接 TLS，或代理设置的 X-Forwarded-Proto（取第一跳）
+func requestIsHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// cookieName 返回 Cookie 的实际名称（Secure 时带 __Host- 前缀）
+func cookieName(r *http.Request, base string) string {
+	if cookieSecure(r) {
+		return "__Host-" + base
+	}
+	return base
+}
+
+// cookieValue 读取 Cookie，不存在时返回空字符串
+func cookieValue(r *http.Request, base string) string {
+	c, err := r.Cookie(cookieName(r, base))
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+func setCookie(w http.ResponseWriter, r *http.Request, base, value string, maxAge time.Duration, httpOnly bool) {
+	c := &http.Cookie{
+		Name:     cookieName(r, base),
+		Value:    value,
+		Path:     "/",
+		HttpOnly: httpOnly,
+		Secure:   cookieSecure(r),
+		SameSite: http.SameSiteStrictMode,
+	}
+	if maxAge > 0 {
+		c.MaxAge = int(maxAge / time.Second)
+	} else {
+		c.MaxAge = -1 // 立即删除
+	}
+	http.SetCookie(w, c)
+}
+
+// writeTokens 写出 /login 与 /token/refresh 的响应：Bearer 模式原样返回令牌；
+// Cookie 模式把令牌写入 Cookie，响应体只带有效期与新的 CSRF 令牌
+func writeTokens(w http.ResponseWriter, r *http.Request, resp TokenResponse, cookieMode bool) {
+	if cookieMode {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, "cannot mint token", http.StatusInternalServerError)
+			return
+		}
+		csrf := base64.RawURLEncoding.EncodeToString(b)
+		setCookie(w, r, accessCookie, resp.Token, accessTokenTTL, true)
+		setCookie(w, r, refreshCookie, resp.RefreshToken, refreshTokenTTL, true)
+		setCookie(w, r, csrfCookie, csrf, refreshTokenTTL, false)
+		resp.Token, resp.TokenType, resp.RefreshToken = "", "", ""
+		resp.CSRFToken = csrf
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// clearSessionCookies 删除会话 Cookie（注销或刷新失败时）
+func clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	for _, base := range []string{accessCookie, refreshCookie} {
+		setCookie(w, r, base, "", 0, true)
+	}
+	setCookie(w, r, csrfCookie, "", 0, false)
+}
+
+// hasSessionCookies 判断请求是否带有会话 Cookie
+func hasSessionCookies(r *http.Request) bool {
+	return cookieValue(r, accessCookie) != "" || cookieValue(r, refreshCookie) != "" || cookieValue(r, csrfCookie) != ""
+}
+
+// bearerOrCookieToken 返回请求中的访问令牌：优先 Authorization: Bearer 头，其次 gc_access Cookie
+func bearerOrCookieToken(r *http.Request) (token string, fromCookie bool) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if strings.HasPrefix(h, "Bearer ") {
+			return strings.TrimPrefix(h, "Bearer "), false
+		}
+		return "", false
+	}
+	if v := cookieValue(r, accessCookie); v != "" {
+		return v, true
+	}
+	return "", false
+}
+
+// stateChanging 判断请求方法是否会修改数据（需要 CSRF 校验）
+func stateChanging(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// csrfValid 检查 X-CSRF-Token 头是否与 gc_csrf Cookie 一致（常量时间比较）
+func csrfValid(r *http.Request) bool {
+	cookie, header := cookieValue(r, csrfCookie), r.Header.Get(csrfHeader)
+	return cookie != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
+
+// sameOriginRequest 判断请求是否来自本站页面：优先看 Sec-Fetch-Site，其次比较 Origin 与 Host；
+// 两个头都没有时无法判断来源，拒绝（只用于 Cookie 模式，浏览器发出的 POST 总会带其中之一）
+func sameOriginRequest(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+	}
+	return false
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useCookieSecureMode 在测试期间设置 COOKIE_SECURE
+func useCookieSecureMode(t *testing.T, mode string) {
+	t.Helper()
+	old := cookieSecureMode
+	t.Cleanup(func() { cookieSecureMode = old })
+	cookieSecureMode = mode
+}
+
+func TestCookieSecure(t *testing.T) {
+	plain := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	direct := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	direct.TLS = &tls.ConnectionState{}
+	proxied := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	proxied.Header.Set("X-Forwarded-Proto", "HTTPS")
+	chained := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	chained.Header.Set("X-Forwarded-Proto", "https, http")
+	downgraded := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	downgraded.Header.Set("X-Forwarded-Proto", "http, https")
+
+	tests := []struct {
+		mode string
+		r    *http.Request
+		want bool
+	}{
+		{"auto", plain, false},
+		{"auto", direct, true},
+		{"auto", proxied, true},
+		{"auto", chained, true},
+		{"auto", downgraded, false},
+		{"1", plain, true},
+		{"", plain, true},
+		{"yes", plain, true},
+		{"0", direct, false},
+		{"0", proxied, false},
+	}
+	useCookieSecureMode(t, "auto")
+	for _, tt := range tests {
+		cookieSecureMode = tt.mode
+		if got := cookieSecure(tt.r); got != tt.want {
+			t.Errorf("COOKIE_SECURE=%s, TLS=%v, X-Forwarded-Proto=%q: secure = %v, want %v",
+				tt.mode, tt.r.TLS != nil, tt.r.Header.Get("X-Forwarded-Proto"), got, tt.want)
+		}
+		wantName := accessCookie
+		if tt.want {
+			wantName = "__Host-" + accessCookie
+		}
+		if got := cookieName(tt.r, accessCookie); got != wantName {
+			t.Errorf("cookieName = %q, want %q", got, wantName)
+		}
+	}
+}
+
+func TestSameOriginRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		site, origin string
+		want         bool
+	}{
+		{"no headers", "", "", false},
+		{"same-origin", "same-origin", "", true},
+		{"typed into the address bar", "none", "", true},
+		{"same-site subdomain", "same-site", "", false},
+		{"cross-site", "cross-site", "http://example.com", false},
+		{"matching Origin", "", "http://example.com", true},
+		{"matching Origin, other case", "", "http://EXAMPLE.com", true},
+		{"other Origin", "", "https://evil.test", false},
+		{"other port", "", "http://example.com:8080", false},
+		{"opaque Origin", "", "null", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/login", nil)
+		if tt.site != "" {
+			r.Header.Set("Sec-Fetch-Site", tt.site)
+		}
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := sameOriginRequest(r); got != tt.want {
+			t.Errorf("%s: sameOriginRequest = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCSRFValid(t *testing.T) {
+	useCookieSecureMode(t, "auto")
+	tests := []struct {
+		name           string
+		cookie, header string
+		want           bool
+	}{
+		{"matching", "abc", "abc", true},
+		{"different", "abc", "abd", false},
+		{"prefix", "abc", "ab", false},
+		{"missing header", "abc", "", false},
+		{"missing cookie", "", "abc", false},
+		{"both missing", "", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/post", nil)
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+		}
+		if tt.header != "" {
+			r.Header.Set(csrfHeader, tt.header)
+		}
+		if got := csrfValid(r); got != tt.want {
+			t.Errorf("%s: csrfValid = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// browser 模拟浏览器：保存响应设置的 Cookie，并在之后的请求中带上
+type browser struct {
+	t       *testing.T
+	h       http.Handler
+	base    string // 例如 http://example.com
+	proto   string // 代理设置的 X-Forwarded-Proto
+	cookies map[string]*http.Cookie
+}
+
+func newBrowser(t *testing.T, h http.Handler, base, proto string) *browser {
+	return &browser{t: t, h: h, base: base, proto: proto, cookies: map[string]*http.Cookie{}}
+}
+
+func (b *browser) do(method, path string, body interface{}, header map[string]string) *httptest.ResponseRecorder {
+	b.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			b.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, b.base+path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if b.proto != "" {
+		req.Header.Set("X-Forwarded-Proto", b.proto)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	for _, c := range b.cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	b.h.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+		} else {
+			b.cookies[c.Name] = c
+		}
+	}
+	return rec
+}
+
+// login 以 Cookie 模式注册并登录，返回响应体中的 CSRF 令牌
+func (b *browser) login(username string) string {
+	b.t.Helper()
+	creds := map[string]string{"username": username, "password": "secret"}
+	if rec := b.do(http.MethodPost, "/signup", creds, nil); rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+		b.t.Fatalf("signup: status %d", rec.Code)
+	}
+	creds["session"] = sessionModeCookie
+	rec := b.do(http.MethodPost, "/login", creds, map[string]string{"Sec-Fetch-Site": "same-origin"})
+	if rec.Code != http.StatusOK {
+		b.t.Fatalf("cookie login: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp TokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		b.t.Fatal(err)
+	}
+	if resp.Token != "" || resp.RefreshToken != "" {
+		b.t.Errorf("cookie login leaked tokens in the body: %+v", resp)
+	}
+	if resp.CSRFToken == "" {
+		b.t.Fatal("cookie login returned no csrf_token")
+	}
+	return resp.CSRFToken
+}
+
+func TestCookieSessionOverHTTP(t *testing.T) {
+	useMemoryStorage(t)
+	useCookieSecureMode(t, "auto")
+	b := newBrowser(t, newTokenMux(), "http://example.com", "")
+	csrf := b.login("kimi")
+
+	for _, name := range []string{accessCookie, refreshCookie, csrfCookie} {
+		c := b.cookies[name]
+		if c == nil {
+			t.Fatalf("cookie %s not set (got %v)", name, b.cookies)
+		}
+		if c.Secure || c.SameSite != http.SameSiteStrictMode || c.Path != "/" || c.HttpOnly != (name != csrfCookie) {
+			t.Errorf("cookie %s has attributes %+v", name, c)
+		}
+	}
+	if b.cookies[csrfCookie].Value != csrf {
+		t.Error("csrf cookie differs from csrf_token in the body")
+	}
+
+	post := map[string]interface{}{"message": "coffee", "location": map[string]float64{"lat": 40.7, "lon": -74}}
+	if rec := b.do(http.MethodGet, "/trash", nil, nil); rec.Code != http.StatusOK {
+		t.Errorf("GET with cookie: status %d", rec.Code)
+	}
+	if rec := b.do(http.MethodPost, "/post", post, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("POST without %s: status %d, want 403", csrfHeader, rec.Code)
+	}
+	if rec := b.do(http.MethodPost, "/post", post, map[string]string{csrfHeader: "forged"}); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with a wrong %s: status %d, want 403", csrfHeader, rec.Code)
+	}
+	if rec := b.do(http.MethodPost, "/post", post, map[string]string{csrfHeader: csrf}); rec.Code != http.StatusOK {
+		t.Errorf("POST with %s: status %d", csrfHeader, rec.Code)
+	}
+
+	// 刷新：同样需要 CSRF 令牌，成功后更换全部 Cookie 与 CSRF 令牌
+	oldAccess := b.cookies[accessCookie].Value
+	if rec := b.do(http.MethodPost, "/token/refresh", nil, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("refresh without %s: status %d, want 403", csrfHeader, rec.Code)
+	}
+	rec := b.do(http.MethodPost, "/token/refresh", nil, map[string]string{csrfHeader: csrf})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("cookie refresh: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var refreshed TokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &refreshed); err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.CSRFToken == "" || refreshed.CSRFToken == csrf || b.cookies[csrfCookie].Value != refreshed.CSRFToken {
+		t.Error("refresh did not rotate the csrf token")
+	}
+	if b.cookies[accessCookie].Value == oldAccess {
+		t.Error("refresh did not rotate the access cookie")
+	}
+	if rec := b.do(http.MethodPost, "/post", post, map[string]string{csrfHeader: csrf}); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with the old csrf token: status %d, want 403", rec.Code)
+	}
+	csrf = refreshed.CSRFToken
+
+	// 注销：清除 Cookie
+	if rec := b.do(http.MethodPost, "/logout", nil, map[string]string{csrfHeader: csrf}); rec.Code != http.StatusOK {
+		t.Fatalf("logout: status %d", rec.Code)
+	}
+	if len(b.cookies) != 0 {
+		t.Errorf("cookies left after logout: %v", b.cookies)
+	}
+	if rec := b.do(http.MethodGet, "/trash", nil, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET after logout: status %d, want 401", rec.Code)
+	}
+}
+
+// 访问 Cookie 过期后注销：凭刷新 Cookie 吊销会话，并清除所有 Cookie
+func TestCookieLogoutAfterAccessExpired(t *testing.T) {
+	useMemoryStorage(t)
+	useCookieSecureMode(t, "0")
+	mux := newTokenMux()
+	b := newBrowser(t, mux, "http://example.com", "")
+	csrf := b.login("kimi")
+	refreshToken := b.cookies[refreshCookie].Value
+	b.cookies[accessCookie].Value = expiredCopy(t, b.cookies[accessCookie].Value)
+
+	if rec := b.do(http.MethodPost, "/logout", nil, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("logout without %s: status %d, want 403", csrfHeader, rec.Code)
+	}
+	if rec := b.do(http.MethodPost, "/logout", nil, map[string]string{csrfHeader: csrf}); rec.Code != http.StatusOK {
+		t.Fatalf("logout with an expired access cookie: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(b.cookies) != 0 {
+		t.Errorf("cookies left after logout: %v", b.cookies)
+	}
+	if _, code := refresh(t, mux, refreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: status %d, want 401", code)
+	}
+}
+
+func TestCookieSessionBehindHTTPSProxy(t *testing.T) {
+	useMemoryStorage(t)
+	useCookieSecureMode(t, "auto")
+	b := newBrowser(t, newTokenMux(), "http://example.com", "https")
+	csrf := b.login("kimi")
+	for _, name := range []string{accessCookie, refreshCookie, csrfCookie} {
+		c := b.cookies["__Host-"+name]
+		if c == nil || !c.Secure {
+			t.Fatalf("secure cookie __Host-%s not set (got %v)", name, b.cookies)
+		}
+	}
+	post := map[string]interface{}{"message": "coffee", "location": map[string]float64{"lat": 40.7, "lon": -74}}
+	if rec := b.do(http.MethodPost, "/post", post, map[string]string{csrfHeader: csrf}); rec.Code != http.StatusOK {
+		t.Errorf("POST with %s: status %d", csrfHeader, rec.Code)
+	}
+
+	// 同一组 Cookie 经 http 到达时按不带前缀的名称查找，不会被当作会话
+	b.proto = ""
+	if rec := b.do(http.MethodGet, "/trash", nil, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("__Host- cookies over http: status %d, want 401", rec.Code)
+	}
+}
+
+// Bearer 客户端不需要 CSRF 令牌，即使同时带着 Cookie
+func TestBearerIgnoresCSRF(t *testing.T) {
+	useMemoryStorage(t)
+	useCookieSecureMode(t, "auto")
+	mux := newTokenMux()
+	b := newBrowser(t, mux, "http://example.com", "")
+	b.login("kimi")
+	bearer := loginAs(t, mux, "other")
+
+	post := map[string]interface{}{"message": "coffee", "location": map[string]float64{"lat": 40.7, "lon": -74}}
+	if rec := b.do(http.MethodPost, "/post", post, map[string]string{"Authorization": "Bearer " + bearer}); rec.Code != http.StatusOK {
+		t.Errorf("bearer POST with cookies present: status %d", rec.Code)
+	}
+	if rec := b.do(http.MethodPost, "/post", post, map[string]string{"Authorization": "Basic a2ltaTpzZWNyZXQ="}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("non-bearer Authorization falls back to cookies: status %d, want 401", rec.Code)
+	}
+}
+
+func TestCookieLoginRejectsCrossSite(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTokenMux()
+	loginAs(t, mux, "kimi")
+
+	tests := []struct {
+		session string
+		header  map[string]string
+		want    int
+	}{
+		{sessionModeCookie, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{sessionModeCookie, map[string]string{"Origin": "https://evil.test"}, http.StatusForbidden},
+		{sessionModeCookie, map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+		{sessionModeCookie, nil, http.StatusForbidden},
+		{sessionModeBearer, nil, http.StatusOK},
+		{sessionModeBearer, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+		{"jar", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		b := newBrowser(t, mux, "http://example.com", "")
+		creds := map[string]string{"username": "kimi", "password": "secret", "session": tt.session}
+		rec := b.do(http.MethodPost, "/login", creds, tt.header)
+		if rec.Code != tt.want {
+			t.Errorf("session=%s %v: status %d, want %d", tt.session, tt.header, rec.Code, tt.want)
+		}
+		if rec.Code != http.StatusOK && len(b.cookies) != 0 {
+			t.Errorf("session=%s %v: cookies set on a rejected login", tt.session, tt.header)
+		}
+		if tt.session == sessionModeBearer && strings.Contains(rec.Header().Get("Set-Cookie"), accessCookie) {
+			t.Error("bearer login set a session cookie")
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 帖子编辑：作者（或管理员）可修改正文、位置与图片。
+//   - GET   /post/{id}：读取单个帖子（回收站中的帖子只有作者与管理员可见，已到期的帖子不可见）
+//   - PATCH /post/{id}：JSON（{"message":..,"location":{..},"url":..}，只改出现的字段；"url":"" 去掉图片）
+//     或 multipart/form-data（message、lat+lon、image 文件，remove_image=1 去掉图片）
+//   - GET   /post/{id}/history：按版本号升序返回全部修订（0 号为原帖）
+//
+// 每次编辑都按发帖规则重新提取标签、检测语言、反向地理编码，并重新做禁用词检查；
+// 帖子带上 edited / edited_at / revision 标记，搜索结果中可以看到。
+// 以上接口都返回 ETag，编辑支持 If-Match（见 concurrency.go）。
+// 修订记录的 ID 由帖子 ID 与版本号组成：帖子以读取时的版本为条件写入成功后再写修订，
+// 同一版本号只会有一个编辑者；修订写入失败只记录日志（重复写入同一修订是幂等的）。
+
+// REVISIONS_INDEX 存放帖子的修订历史（ES 后端）
+const REVISIONS_INDEX = "post_revisions"
+
+// revisionsMapping：只按 post_id 查询，正文无需分词
+const revisionsMapping = `{
+	"mappings": {
+		"properties": {
+			"post_id":   { "type": "keyword" },
+			"revision":  { "type": "integer" },
+			"edited_by": { "type": "keyword" },
+			"edited_at": { "type": "date" },
+			"message":   { "type": "text", "index": false },
+			"location":  { "type": "geo_point" },
+			"url":       { "type": "keyword", "index": false }
+		}
+	}
+}`
+
+// PostRevision 是帖子某个版本的内容；EditedBy / EditedAt 为产生该版本的编辑（0 号版本即原帖，没有编辑时间）
+type PostRevision struct {
+	PostID   string     `json:"post_id"`
+	Revision int        `json:"revision"`
+	EditedBy string     `json:"edited_by"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	Message  string     `json:"message"`
+	Location Location   `json:"location"`
+	Url      string     `json:"url,omitempty"`
+}
+
+// PostHistory 是 /post/{id}/history 的响应
+type PostHistory struct {
+	ID        string         `json:"id"`
+	Revision  int            `json:"revision"`
+	Revisions []PostRevision `json:"revisions"`
+}
+
+// revisionOf 记录帖子当前内容
+func revisionOf(id string, p *Post, by string, at *time.Time) PostRevision {
+	return PostRevision{
+		PostID: id, Revision: p.Revision, EditedBy: by, EditedAt: at,
+		Message: p.Message, Location: p.Location, Url: p.Url,
+	}
+}
+
+// revisionID 是修订记录的存储 ID
+func revisionID(postID string, revision int) string {
+	return postID + ":" + strconv.Itoa(revision)
+}
+
+// postEdit 是一次编辑请求中出现的字段（nil 表示不修改）；Image 为 multipart 中的新图片，校验通过后才上传
+type postEdit struct {
+	Message  *string
+	Location *Location
+	Url      *string
+	Image    *multipart.FileHeader
+}
+
+// handlerPostByID 分发 /post/{id} 与 /post/{id}/history
+func handlerPostByID(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/post/"), "/")
+	id, sub, _ := strings.Cut(rest, "/")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		handlerGetPost(w, r, id)
+	case sub == "" && r.Method == http.MethodPatch:
+		handlerEditPost(w, r, id)
+	case sub == "history" && r.Method == http.MethodGet:
+		handlerPostHistory(w, r, id)
+	case sub == "" || sub == "history":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handlerGetPost：GET /post/{id}，If-None-Match 与当前版本相同时返回 304
+func handlerGetPost(w http.ResponseWriter, r *http.Request, id string) {
+	username := usernameFromCtx(r.Context())
+	if username == "" {
+		http.Error(w, "missing user in context", http.StatusUnauthorized)
+		return
+	}
+	p, ver, err := postRepo.GetVersioned(r.Context(), id)
+	if errors.Is(err, ErrPostNotFound) || (err == nil && p.expired(time.Now())) ||
+		(err == nil && p.DeletedAt != nil && p.User != username && !isAdminFromCtx(r.Context())) {
+		http.Error(w, "post not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load post: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", ver.ETag())
+	if h := r.Header.Get("If-None-Match"); h != "" && matchesETag(h, ver.ETag()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, PostWithID{ID: id, Post: *p})
+}
+
+// loadEditablePost 读取帖子及其版本，并检查当前用户是否为作者或管理员；已删除或已到期的帖子视为不存在。
+// 出错时已写好响应，返回 nil。
+func loadEditablePost(w http.ResponseWriter, r *http.Request, id string) (*Post, PostVersion) {
+	username := usernameFromCtx(r.Context())
+	if username == "" {
+		http.Error(w, "missing user in context", http.StatusUnauthorized)
+		return nil, PostVersion{}
+	}
+	p, ver, err := postRepo.GetVersioned(r.Context(), id)
+	if errors.Is(err, ErrPostNotFound) || (err == nil && (p.DeletedAt != nil || p.expired(time.Now()))) {
+		http.Error(w, "post not found", http.StatusNotFound)
+		return nil, PostVersion{}
+	}
+	if err != nil {
+		http.Error(w, "failed to load post: "+err.Error(), http.StatusInternalServerError)
+		return nil, PostVersion{}
+	}
+	if p.User != username && !isAdminFromCtx(r.Context()) {
+		http.Error(w, "forbidden: not the owner or admin", http.StatusForbidden)
+		return nil, PostVersion{}
+	}
+	return p, ver
+}
+
+// handlerEditPost：PATCH /post/{id}
+func handlerEditPost(w http.ResponseWriter, r *http.Request, id string) {
+	p, ver := loadEditablePost(w, r, id)
+	if p == nil {
+		return
+	}
+	if !checkIfMatch(w, r, ver) {
+		return
+	}
+	username := usernameFromCtx(r.Context())
+
+	edit, err := parsePostEdit(r)
+	if err != nil {
+		var pe *paramError
+		if errors.As(err, &pe) {
+			writeError(w, http.StatusBadRequest, err)
+		} else {
+			log.Printf("edit post %s: %v", id, err)
+			http.Error(w, "upload failed", http.StatusInternalServerError)
+		}
+		return
+	}
+	if edit.Message == nil && edit.Location == nil && edit.Url == nil && edit.Image == nil {
+		writeError(w, http.StatusBadRequest, &paramError{Code: errCodeMissing, Message: "nothing to change: send message, location or image"})
+		return
+	}
+
+	updated := *p
+	if edit.Message != nil {
+		updated.Message = *edit.Message
+	}
+	if edit.Location != nil {
+		updated.Location = *edit.Location
+		// 位置变了，旧的城市信息不再适用
+		updated.City, updated.Region, updated.Country = "", "", ""
+	}
+	if edit.Url != nil {
+		updated.Url = *edit.Url
+	}
+	if edit.Image == nil && updated.Message == p.Message && updated.Location == p.Location && updated.Url == p.Url {
+		// 内容没有变化：不产生新版本
+		w.Header().Set("ETag", ver.ETag())
+		writeJSON(w, http.StatusOK, PostWithID{ID: id, Post: *p})
+		return
+	}
+	if err := preparePost(&updated); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// 新图片在校验通过后才上传；帖子写入失败时删除它，避免留下无人引用的文件
+	if edit.Image != nil {
+		if updated.Url, err = uploadImage(r, edit.Image); err != nil {
+			log.Printf("edit post %s: %v", id, err)
+			http.Error(w, "upload failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	updated.Edited = true
+	updated.EditedAt = &now
+	updated.Revision = p.Revision + 1
+
+	// errChangesNotRecorded 表示帖子已经更新：照常完成后续处理，最后返回错误
+	newVer, err := updatePost(r.Context(), &updated, id, ver, username)
+	applied := err == nil || errors.Is(err, errChangesNotRecorded)
+	if !applied && edit.Image != nil {
+		discardUpload(updated.Url)
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		writeVersionConflict(w, r)
+		return
+	}
+	if !applied {
+		http.Error(w, "failed to save post: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if updated.Location != p.Location {
+		searchCache.InvalidateAt(p.Location)
+	}
+
+	// 首次编辑时先补记原帖（0 号版本），再记录新版本
+	var revs []PostRevision
+	if p.Revision == 0 {
+		revs = append(revs, revisionOf(id, p, p.User, nil))
+	}
+	revs = append(revs, revisionOf(id, &updated, username, &now))
+	for _, rev := range revs {
+		if err := postRepo.AddRevision(r.Context(), rev); err != nil {
+			log.Printf("record revision %d of post %s failed: %v", rev.Revision, id, err)
+		}
+	}
+	// 被替换或去掉的旧图片：修订历史仍引用它时保留（见 URLInUse），否则删除
+	if p.Url != "" && p.Url != updated.Url {
+		if _, err := removeUnusedMedia(r.Context(), p.Url); err != nil {
+			log.Printf("edit post %s: remove old image %s: %v", id, p.Url, err)
+		}
+	}
+	log.Printf("post %s edited by %s (revision %d)", id, username, updated.Revision)
+	if err != nil {
+		writeChangesNotRecorded(w, err)
+		return
+	}
+	w.Header().Set("ETag", newVer.ETag())
+	writeJSON(w, http.StatusOK, PostWithID{ID: id, Post: updated})
+}
+
+// parsePostEdit 解析 JSON 或 multipart 编辑请求；multipart 中的图片只取出，不上传
+func parsePostEdit(r *http.Request) (postEdit, error) {
+	var edit postEdit
+	if strings.Contains(strings.ToLower(r.Header.Get("Content-Type")), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return edit, &paramError{Code: errCodeBadBody, Message: "invalid multipart form"}
+		}
+		form := r.MultipartForm.Value
+		if v, ok := form["message"]; ok && len(v) > 0 {
+			edit.Message = &v[0]
+		}
+		_, hasLat := form["lat"]
+		_, hasLon := form["lon"]
+		if hasLat || hasLon {
+			loc, err := parseLocation(r.FormValue("lat"), r.FormValue("lon"))
+			if err != nil {
+				return edit, err
+			}
+			edit.Location = &loc
+		}
+		if r.FormValue("remove_image") == "1" {
+			empty := ""
+			edit.Url = &empty
+		}
+		if files := r.MultipartForm.File["image"]; len(files) > 0 {
+			edit.Image = files[0]
+			edit.Url = nil // 新图片优先于 remove_image
+		}
+		return edit, nil
+	}
+
+	var in struct {
+		Message  *string `json:"message"`
+		Location *struct {
+			Lat *float64 `json:"lat"`
+			Lon *float64 `json:"lon"`
+		} `json:"location"`
+		Url *string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		return edit, &paramError{Code: errCodeBadBody, Message: "invalid JSON body"}
+	}
+	edit.Message, edit.Url = in.Message, in.Url
+	if in.Location != nil {
+		loc, err := validateLocation(in.Location.Lat, in.Location.Lon)
+		if err != nil {
+			return edit, err
+		}
+		edit.Location = &loc
+	}
+	return edit, nil
+}
+
+// uploadImage 按当前配置（GCS 或本地目录）上传图片，返回图片地址
+func uploadImage(r *http.Request, hdr *multipart.FileHeader) (string, error) {
+	file, err := hdr.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if useGCS {
+		return saveToGCS(r.Context(), BUCKET_NAME, file, hdr.Filename)
+	}
+	return saveToLocal(r.Context(), localUploadDir, file, hdr.Filename)
+}
+
+// discardUpload 删除本次请求上传、但没有写入帖子的图片（与到期清理相同，仍被引用时保留）；
+// 请求可能已取消，因此使用独立的超时
+func discardUpload(url string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := removeUnusedMedia(ctx, url); err != nil {
+		log.Printf("discard uploaded image %s: %v", url, err)
+	}
+}
+
+// handlerPostHistory：GET /post/{id}/history
+func handlerPostHistory(w http.ResponseWriter, r *http.Request, id string) {
+	p, ver := loadEditablePost(w, r, id)
+	if p == nil {
+		return
+	}
+	revs, err := postRepo.ListRevisions(r.Context(), id)
+	if err != nil {
+		http.Error(w, "failed to load history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 只返回不超过当前版本的记录：存储中可能有版本号高于 p.Revision 的修订（帖子写入失败、或导入以较早的版本覆盖了帖子之后），它们不属于当前历史
+	out := make([]PostRevision, 0, len(revs)+1)
+	for _, rev := range revs {
+		if rev.Revision <= p.Revision {
+			out = append(out, rev)
+		}
+	}
+	if len(out) == 0 {
+		// 从未编辑过：历史只有原帖
+		out = append(out, revisionOf(id, p, p.User, nil))
+	}
+	w.Header().Set("ETag", ver.ETag())
+	writeJSON(w, http.StatusOK, PostHistory{ID: id, Revision: p.Revision, Revisions: out})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// 限时帖子：发帖时可指定 expires_at（RFC 3339 时间）或 ttl（"90m"、"2h" 这样的时长，或秒数），
+// 如 “餐车在这里停到下午 3 点”。到期的帖子立即从 /search、/tags、/suggest 与 GET /post/{id} 中消失，
+// 后台清理任务定期永久删除到期的帖子（连同修订历史）及其图片；已在回收站中的帖子不受影响，
+// 仍按 TRASH_RETENTION 保留（恢复后因已到期而不可见，随即由本任务删除），保留期满后由回收站清理任务删除。
+//
+// 相关环境变量：
+//   - POST_MAX_TTL：允许的最长有效期（默认 720h 即 30 天）
+//   - EXPIRY_REAP_INTERVAL：清理任务的执行间隔（默认 1m）
+
+var (
+	postMaxTTL         = getenvDuration("POST_MAX_TTL", 30*24*time.Hour)
+	expiryReapInterval = getenvDuration("EXPIRY_REAP_INTERVAL", time.Minute)
+)
+
+// reapBatchSize 是清理任务每批处理的帖子数
+const reapBatchSize = 500
+
+// expired 判断帖子在 now 时是否已到期
+func (p *Post) expired(now time.Time) bool {
+	return p.ExpiresAt != nil && !p.ExpiresAt.After(now)
+}
+
+// parseExpiry 解析发帖请求中的 expires_at / ttl（两者至多给一个），返回到期时间；都为空时返回 nil
+func parseExpiry(expiresAt, ttl string) (*time.Time, error) {
+	expiresAt, ttl = strings.TrimSpace(expiresAt), strings.TrimSpace(ttl)
+	if expiresAt == "" && ttl == "" {
+		return nil, nil
+	}
+	if expiresAt != "" && ttl != "" {
+		return nil, invalidParam("ttl", "use either expires_at or ttl, not both")
+	}
+
+	now := time.Now().UTC()
+	var t time.Time
+	field := "ttl"
+	if expiresAt != "" {
+		field = "expires_at"
+		v, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, invalidParam(field, "must be an RFC 3339 timestamp, e.g. 2026-10-18T15:00:00Z")
+		}
+		t = v.UTC()
+	} else {
+		var d time.Duration
+		if secs, err := strconv.ParseInt(ttl, 10, 64); err == nil {
+			d = time.Duration(secs) * time.Second
+		} else if d, err = time.ParseDuration(ttl); err != nil {
+			return nil, invalidParam(field, `must be a duration like "90m" or a number of seconds`)
+		}
+		t = now.Add(d)
+	}
+	if !t.After(now) {
+		return nil, outOfRange(field, "must be in the future")
+	}
+	if postMaxTTL > 0 && t.Sub(now) > postMaxTTL {
+		return nil, outOfRange(field, fmt.Sprintf("must be at most %s from now", postMaxTTL))
+	}
+	return &t, nil
+}
+
+// ttlString 将 JSON 中的 ttl（字符串或数字）转为 parseExpiry 接受的文本
+func ttlString(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	if string(raw) == "null" {
+		return ""
+	}
+	return string(raw)
+}
+
+// dropExpired 去掉结果中已到期的帖子（缓存的搜索结果可能在缓存期间到期）
+func dropExpired(posts []PostWithID, total int64, now time.Time) ([]PostWithID, int64) {
+	out := posts[:0:0]
+	for _, p := range posts {
+		if p.expired(now) {
+			total--
+			continue
+		}
+		out = append(out, p)
+	}
+	return out, total
+}
+
+// runExpiryReaper 定期永久删除到期的帖子
+func runExpiryReaper(ctx context.Context) {
+	interval := expiryReapInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	log.Printf("[reaper] deleting expired posts every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := reapExpired(ctx); err != nil {
+			log.Printf("[reaper] failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reapExpired 执行一次清理：分批删除到期的帖子，再删除它们（含修订历史）引用、且不再被其他帖子或修订引用的图片
+func reapExpired(ctx context.Context) error {
+	now := time.Now()
+	var posts, media, failed int
+	for {
+		batch, err := postRepo.ListExpired(ctx, now, reapBatchSize)
+		if err != nil {
+			return err
+		}
+		deleted := 0
+		for _, p := range batch {
+			// 修订历史随帖子一起删除，先记下其中的图片
+			revs, err := postRepo.ListRevisions(ctx, p.ID)
+			if err != nil {
+				log.Printf("[reaper] read revisions of post %s: %v", p.ID, err)
+				failed++
+				continue
+			}
+			events, err := writeWithChanges(ctx, func(ctx context.Context) ([]ChangeEvent, error) {
+				if err := postRepo.Delete(ctx, p.ID); err != nil {
+					return nil, err
+				}
+				return []ChangeEvent{newChange(changeExpired, p.ID, &p.Post, "")}, nil
+			})
+			if errors.Is(err, ErrPostNotFound) {
+				// 已被其他实例的清理任务或用户删除（ES 的搜索结果可能滞后），由对方记录变更并清理图片
+				continue
+			}
+			if len(events) == 0 {
+				log.Printf("[reaper] delete post %s: %v", p.ID, err)
+				failed++
+				continue
+			}
+			if err != nil {
+				log.Printf("[reaper] post %s deleted: %v", p.ID, err)
+			}
+			deleted++
+			searchCache.InvalidateAt(p.Location)
+			urls := []string{p.Url}
+			for _, rev := range revs {
+				urls = append(urls, rev.Url)
+			}
+			media += removeMediaOf(ctx, "[reaper]", p.ID, urls...)
+		}
+		posts += deleted
+		// 本批没有删掉任何帖子（全部失败）时停止，等下一轮再试，避免反复读取同一批
+		if len(batch) < reapBatchSize || deleted == 0 {
+			break
+		}
+		log.Printf("[reaper] progress: %d expired post(s) deleted, %d image(s) removed", posts, media)
+	}
+	if posts > 0 || failed > 0 {
+		log.Printf("[reaper] done: %d expired post(s) deleted, %d image(s) removed, %d failed", posts, media, failed)
+	}
+	return nil
+}
+
+// removeUnusedMedia 在没有帖子再引用图片 url 时删除它，返回是否删除了文件。
+// 其他帖子可能引用同一张图片（如导入或 JSON 发帖时指定的 url），此时保留
+func removeUnusedMedia(ctx context.Context, url string) (bool, error) {
+	if url == "" {
+		return false, nil
+	}
+	inUse, err := postRepo.URLInUse(ctx, url)
+	if err != nil {
+		return false, fmt.Errorf("check references: %w", err)
+	}
+	if inUse {
+		return false, nil
+	}
+	return deleteMedia(ctx, url)
+}
+
+// removeMediaOf 清理已删除帖子引用过的图片（当前图片与修订历史中的图片，跳过重复），返回删除的文件数；
+// 失败只记录日志（logPrefix 标明调用方），仍被其他帖子引用的图片保留
+func removeMediaOf(ctx context.Context, logPrefix, postID string, urls ...string) int {
+	removed := 0
+	seen := map[string]bool{}
+	for _, url := range urls {
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		if ok, err := removeUnusedMedia(ctx, url); err != nil {
+			log.Printf("%s image %s of post %s: %v", logPrefix, url, postID, err)
+		} else if ok {
+			removed++
+		}
+	}
+	return removed
+}
+
+// deleteMedia 删除本服务上传的图片（/uploads/ 下的本地文件或 BUCKET_NAME 中的对象）；
+// 其他地址的图片不归本服务管理，返回 false
+func deleteMedia(ctx context.Context, rawURL string) (bool, error) {
+	gcsPrefix := fmt.Sprintf("https://storage.googleapis.com/%s/", BUCKET_NAME)
+	switch {
+	case strings.HasPrefix(rawURL, "/uploads/"):
+		name := path.Base(rawURL)
+		err := os.Remove(filepath.Join(localUploadDir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(rawURL, gcsPrefix):
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return false, err
+		}
+		defer client.Close()
+		err = client.Bucket(BUCKET_NAME).Object(strings.TrimPrefix(rawURL, gcsPrefix)).Delete(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	old := postMaxTTL
+	t.Cleanup(func() { postMaxTTL = old })
+	postMaxTTL = 24 * time.Hour
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name, expiresAt, ttl string
+		want                 time.Duration // 相对 now 的到期时间，0 表示不过期
+		field, code          string
+	}{
+		{"none", "", "", 0, "", ""},
+		{"duration", "", "90m", 90 * time.Minute, "", ""},
+		{"seconds", "", " 3600 ", time.Hour, "", ""},
+		{"at the limit", "", "24h", 24 * time.Hour, "", ""},
+		{"timestamp", now.Add(2 * time.Hour).Format(time.RFC3339), "", 2 * time.Hour, "", ""},
+		{"both", now.Add(time.Hour).Format(time.RFC3339), "1h", 0, "ttl", errCodeInvalid},
+		{"bad duration", "", "soon", 0, "ttl", errCodeInvalid},
+		{"bad timestamp", "tomorrow", "", 0, "expires_at", errCodeInvalid},
+		{"zero ttl", "", "0", 0, "ttl", errCodeOutOfRange},
+		{"negative ttl", "", "-5m", 0, "ttl", errCodeOutOfRange},
+		{"past timestamp", now.Add(-time.Minute).Format(time.RFC3339), "", 0, "expires_at", errCodeOutOfRange},
+		{"ttl over the limit", "", "25h", 0, "ttl", errCodeOutOfRange},
+		{"timestamp over the limit", now.Add(48 * time.Hour).Format(time.RFC3339), "", 0, "expires_at", errCodeOutOfRange},
+	}
+	for _, tt := range tests {
+		got, err := parseExpiry(tt.expiresAt, tt.ttl)
+		if tt.field != "" {
+			var pe *paramError
+			if !errors.As(err, &pe) || pe.Field != tt.field || pe.Code != tt.code {
+				t.Errorf("%s: err = %v, want %s for %s", tt.name, err, tt.code, tt.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.want == 0 {
+			if got != nil {
+				t.Errorf("%s: expires at %v, want no expiry", tt.name, got)
+			}
+			continue
+		}
+		if got == nil || got.Sub(now) < tt.want-time.Second || got.Sub(now) > tt.want+time.Second {
+			t.Errorf("%s: expires at %v, want about now+%s", tt.name, got, tt.want)
+		}
+	}
+
+	postMaxTTL = 0 // 不限
+	if _, err := parseExpiry("", "8760h"); err != nil {
+		t.Errorf("ttl with no limit: %v", err)
+	}
+}
+
+// goneRepo 模拟另一个实例已经删掉 gone 中的帖子，而本实例读到的到期列表还没有反映出来
+type goneRepo struct {
+	PostRepository
+	gone map[string]bool
+}
+
+func (r *goneRepo) Delete(ctx context.Context, id string) error {
+	if r.gone[id] {
+		return ErrPostNotFound
+	}
+	return r.PostRepository.Delete(ctx, id)
+}
+
+// 清理任务只删除不在回收站中的到期帖子，每条记一个 expired 事件；已被别处删除的帖子不重复记录
+func TestReapExpired(t *testing.T) {
+	useMemoryStorage(t)
+	past, future, deleted := time.Now().Add(-time.Minute), time.Now().Add(time.Hour), time.Now()
+	expired, raced, trashed, live, forever := at("expired", 1, 1, "expired"), at("raced", 1, 1, "raced"),
+		at("trashed", 1, 1, "trashed"), at("live", 1, 1, "live"), at("forever", 1, 1, "forever")
+	expired.ExpiresAt, raced.ExpiresAt, trashed.ExpiresAt, live.ExpiresAt = &past, &past, &past, &future
+	trashed.DeletedAt, trashed.DeletedBy = &deleted, "kimi"
+	seedPosts(t, expired, raced, trashed, live, forever)
+	postRepo = &goneRepo{PostRepository: postRepo, gone: map[string]bool{"raced": true}}
+
+	if err := reapExpired(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{"expired": false, "trashed": true, "live": true, "forever": true} {
+		_, err := postRepo.Get(context.Background(), id)
+		if exists := err == nil; exists != want {
+			t.Errorf("%s: exists = %v, want %v (err %v)", id, exists, want, err)
+		}
+	}
+	events, err := changeLog.Since(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != changeExpired || events[0].PostID != "expired" {
+		t.Errorf("events = %+v, want one expired event for post expired", events)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// 共享的 ES 客户端：启动时创建一次（esClient），所有处理函数与存储复用同一个连接池，
+// 节点可用性由后台健康检查维护。此前每个请求都会新建客户端，而 elastic.NewClient 会先做一次
+// 健康检查往返并重新建立 TCP 连接，白白增加了每个请求的延迟。
+//
+// 相关环境变量：
+//   - ES_URLS：逗号分隔的节点地址（默认 ES_URL）
+//   - ES_USERNAME / ES_PASSWORD：可选的 Basic 认证
+//   - ES_TIMEOUT：单个 HTTP 请求的超时（默认 10s；reindex 等长任务改为异步提交并轮询，不受此限制）
+//   - ES_RETRIES：连接失败或 502/503/504 时的最大重试次数（默认 3，指数退避）
+//   - ES_HEALTHCHECK_INTERVAL：后台健康检查间隔（默认 60s，0 表示关闭）
+//   - ES_MAX_IDLE_CONNS：每个节点保留的空闲连接数（默认 64）
+//   - ES_SNIFF：设为 "1" 时嗅探集群中的其他节点（默认关闭；ES 位于 NAT/容器之后时嗅探到的地址通常不可达）
+
+// esConfig 是创建 ES 客户端的配置
+type esConfig struct {
+	URLs                []string
+	Username, Password  string
+	Timeout             time.Duration
+	Retries             int
+	HealthcheckInterval time.Duration
+	Sniff               bool
+	MaxIdleConns        int
+}
+
+// esConfigFromEnv 从环境变量读取 ES 客户端配置
+func esConfigFromEnv() esConfig {
+	var urls []string
+	for _, u := range strings.Split(getenvDefault("ES_URLS", ES_URL), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return esConfig{
+		URLs:                urls,
+		Username:            os.Getenv("ES_USERNAME"),
+		Password:            os.Getenv("ES_PASSWORD"),
+		Timeout:             getenvDuration("ES_TIMEOUT", 10*time.Second),
+		Retries:             getenvInt("ES_RETRIES", 3),
+		HealthcheckInterval: getenvDuration("ES_HEALTHCHECK_INTERVAL", 60*time.Second),
+		Sniff:               os.Getenv("ES_SNIFF") == "1",
+		MaxIdleConns:        getenvInt("ES_MAX_IDLE_CONNS", 64),
+	}
+}
+
+// newESClient 按配置创建长期复用的客户端
+func newESClient(cfg esConfig) (*elastic.Client, error) {
+	// 默认 Transport 每个节点只保留 2 个空闲连接，并发稍高就会不断新建连接
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConns
+	opts := []elastic.ClientOptionFunc{
+		elastic.SetURL(cfg.URLs...),
+		elastic.SetSniff(cfg.Sniff),
+		elastic.SetHttpClient(&http.Client{Timeout: cfg.Timeout, Transport: transport}),
+		elastic.SetHealthcheck(cfg.HealthcheckInterval > 0),
+		elastic.SetErrorLog(log.New(os.Stderr, "[es] ", log.LstdFlags)),
+	}
+	if cfg.HealthcheckInterval > 0 {
+		opts = append(opts, elastic.SetHealthcheckInterval(cfg.HealthcheckInterval))
+	}
+	if cfg.Retries > 0 {
+		opts = append(opts,
+			elastic.SetRetrier(elastic.NewBackoffRetrier(esBackoff{max: cfg.Retries, base: 100 * time.Millisecond, cap: 5 * time.Second})),
+			elastic.SetRetryStatusCodes(http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout),
+		)
+	}
+	if cfg.Username != "" {
+		opts = append(opts, elastic.SetBasicAuth(cfg.Username, cfg.Password))
+	}
+	client, err := elastic.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("ES client ready: urls=%v timeout=%s retries=%d healthcheck=%s sniff=%v",
+		cfg.URLs, cfg.Timeout, cfg.Retries, cfg.HealthcheckInterval, cfg.Sniff)
+	return client, nil
+}
+
+// esBackoff 是有次数上限的指数退避：第 n 次重试前等待 base*2^(n-1)，最多 cap
+type esBackoff struct {
+	max       int
+	base, cap time.Duration
+}
+
+func (b esBackoff) Next(retry int) (time.Duration, bool) {
+	if retry > b.max {
+		return 0, false
+	}
+	d := time.Duration(float64(b.base) * math.Pow(2, float64(retry-1)))
+	if d > b.cap {
+		d = b.cap
+	}
+	return d, true
+}
+
+// taskPollInterval 是轮询异步任务状态的间隔
+const taskPollInterval = 2 * time.Second
+
+// waitForTask 轮询 reindex / update_by_query 等异步任务直到完成，返回新建与更新的文档数
+func waitForTask(ctx context.Context, client *elastic.Client, taskID string) (created, updated int64, err error) {
+	for {
+		res, err := client.TasksGetTask().TaskId(taskID).Do(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		if res.Completed {
+			if res.Error != nil {
+				return 0, 0, fmt.Errorf("task %s failed: %s", taskID, res.Error.Reason)
+			}
+			var status struct {
+				Created int64 `json:"created"`
+				Updated int64 `json:"updated"`
+			}
+			if res.Task != nil {
+				if b, err := json.Marshal(res.Task.Status); err == nil {
+					_ = json.Unmarshal(b, &status)
+				}
+			}
+			return status.Created, status.Updated, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
+		case <-time.After(taskPollInterval):
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Viewport 表示地图视野的四至（北/南纬度，东/西经度），均为规范化之后的值：
+// 纬度位于 [-90, 90]，经度位于 [-180, 180]。West > East 表示视野跨越了 180° 经线（日界线）。
+type Viewport struct {
+	North float64 `json:"n"`
+	South float64 `json:"s"`
+	East  float64 `json:"e"`
+	West  float64 `json:"w"`
+}
+
+// BoundingBox 是一个不跨日界线的矩形区域（West <= East）
+type BoundingBox struct {
+	North, South, East, West float64
+}
+
+// parseViewport 从查询参数 n/s/e/w 解析视野，并完成校验与规范化：
+//   - 四个参数都必须是有限数字
+//   - 纬度超出 [-90, 90] 时截断到两极（Leaflet 在高纬度可能给出略超范围的值）
+//   - 南边界大于北边界视为参数错误
+//   - 经度可以是地图平移后得到的任意值（如 190 或 -200），统一折回 [-180, 180]；
+//     经度跨度 >= 360 时视为覆盖全球
+func parseViewport(q url.Values) (Viewport, error) {
+	var raw [4]float64
+	for i, k := range []string{"n", "s", "e", "w"} {
+		str := strings.TrimSpace(q.Get(k))
+		if str == "" {
+			return Viewport{}, missingParam(k)
+		}
+		v, err := strconv.ParseFloat(str, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return Viewport{}, invalidParam(k, "must be a number")
+		}
+		raw[i] = v
+	}
+	return newViewport(raw[0], raw[1], raw[2], raw[3])
+}
+
+// newViewport 校验并规范化四至（规则见 parseViewport），供查询参数与 JSON 请求体共用
+func newViewport(north, south, east, west float64) (Viewport, error) {
+	north = clampLat(north)
+	south = clampLat(south)
+	if south > north {
+		return Viewport{}, invalidParam("s", "must not be greater than n")
+	}
+
+	switch {
+	case east-west >= 360:
+		// 视野宽于整个地球（缩放到最小级别时常见）
+		return Viewport{North: north, South: south, East: 180, West: -180}, nil
+	case east == west:
+		// 零宽视野（一条经线）：两条边按同一规则折回，避免 ±180 被分别折成 180 与 -180 而变成全球
+		lon := wrapLon(east, true)
+		return Viewport{North: north, South: south, East: lon, West: lon}, nil
+	case east >= west:
+		// Leaflet 跨日界线平移时给出未折回的经度（如 w=170, e=190），折回后 w > e
+		return Viewport{North: north, South: south, East: wrapLon(east, true), West: wrapLon(west, false)}, nil
+	default:
+		// "w > e" 形式的跨日界线视野（如 w=170, e=-170）：两条边同样折回（如 w=200, e=190 即 w=-160, e=-170）；
+		// 折回方向与上一种情况相反，使 w=180, e=-180 仍是日界线上的零宽视野而不是全球
+		return Viewport{North: north, South: south, East: wrapLon(east, false), West: wrapLon(west, true)}, nil
+	}
+}
+
+// earthRadiusMeters 是计算球面距离时使用的地球平均半径
+const earthRadiusMeters = 6371008.8
+
+// haversineMeters 返回两点之间的大圆距离（米）
+func haversineMeters(a, b Location) float64 {
+	toRad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * toRad
+	dLon := (b.Lon - a.Lon) * toRad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*toRad)*math.Cos(b.Lat*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// viewportAround 返回以 loc 为中心、向四个方向各延伸 d 的视野（高纬度或 d 很大时自动截断/覆盖全球）
+func viewportAround(loc Location, d Distance) Viewport {
+	dLat := float64(d) / earthRadiusMeters * 180 / math.Pi
+	cosLat := math.Max(math.Cos(loc.Lat*math.Pi/180), 1e-6)
+	dLon := math.Min(180, dLat/cosLat)
+	vp, _ := newViewport(loc.Lat+dLat, loc.Lat-dLat, loc.Lon+dLon, loc.Lon-dLon)
+	return vp
+}
+
+// circleBounds 返回能完全包住以 loc 为中心、半径 d 的球面圆的最小视野，用作空间索引的粗筛范围。
+// 经度半宽取 asin(sin(d/R)/cos(lat))（比 viewportAround 的近似值更宽）；圆覆盖极点时经度取全球。
+func circleBounds(loc Location, d Distance) Viewport {
+	angular := float64(d) / earthRadiusMeters
+	dLat := angular * 180 / math.Pi
+	north, south := loc.Lat+dLat, loc.Lat-dLat
+	world := Viewport{North: clampLat(north), South: clampLat(south), East: 180, West: -180}
+	if north >= 90 || south <= -90 || angular >= math.Pi/2 {
+		return world
+	}
+	s := math.Sin(angular) / math.Cos(loc.Lat*math.Pi/180)
+	if s >= 1 {
+		return world
+	}
+	dLon := math.Asin(s) * 180 / math.Pi
+	vp, err := newViewport(north, south, loc.Lon+dLon, loc.Lon-dLon)
+	if err != nil {
+		return world
+	}
+	return vp
+}
+
+// clampLat 将纬度截断到 [-90, 90]
+func clampLat(lat float64) float64 {
+	return math.Max(-90, math.Min(90, lat))
+}
+
+// wrapLon 将任意经度折回 [-180, 180]。
+// 恰好落在 ±180 上时，东边界取 180、西边界取 -180，避免把整幅视野误判为跨日界线。
+func wrapLon(lon float64, isEast bool) float64 {
+	w := math.Mod(lon+180, 360)
+	if w < 0 {
+		w += 360
+	}
+	w -= 180
+	if w == -180 && isEast {
+		return 180
+	}
+	return w
+}
+
+// CrossesAntimeridian 报告视野是否跨越 180° 经线
+func (v Viewport) CrossesAntimeridian() bool {
+	return v.West > v.East
+}
+
+// Boxes 将视野拆分为不跨日界线的矩形：普通视野返回一个，跨日界线时拆成东西两半
+func (v Viewport) Boxes() []BoundingBox {
+	if !v.CrossesAntimeridian() {
+		return []BoundingBox{{North: v.North, South: v.South, East: v.East, West: v.West}}
+	}
+	return []BoundingBox{
+		{North: v.North, South: v.South, East: 180, West: v.West},
+		{North: v.North, South: v.South, East: v.East, West: -180},
+	}
+}
+
+// Contains 判断某点是否落在视野内（考虑跨日界线）
+func (v Viewport) Contains(loc Location) bool {
+	for _, b := range v.Boxes() {
+		if loc.Lat <= b.North && loc.Lat >= b.South && loc.Lon <= b.East && loc.Lon >= b.West {
+			return true
+		}
+	}
+	return false
+}
+
+// viewportQuery 根据视野构造 ES 查询：跨日界线时用 bool/should 组合两个 geo_bounding_box
+func viewportQuery(field string, v Viewport) elastic.Query {
+	boxes := v.Boxes()
+	if len(boxes) == 1 {
+		return boxQuery(field, boxes[0])
+	}
+	bq := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+	for _, b := range boxes {
+		bq = bq.Should(boxQuery(field, b))
+	}
+	return bq
+}
+
+func boxQuery(field string, b BoundingBox) elastic.Query {
+	return elastic.NewGeoBoundingBoxQuery(field).
+		TopLeft(b.North, b.West).
+		BottomRight(b.South, b.East)
+}
+
+// nearestSort 按到查询点的弧面距离（米）升序排序，用于 mode=nearest
+func nearestSort(field string, loc Location) elastic.Sorter {
+	return elastic.NewGeoDistanceSort(field).
+		Point(loc.Lat, loc.Lon).
+		Unit("m").
+		DistanceType("arc").
+		Asc()
+}
+
+// sortDistance 从命中结果的 sort 值中取出距离（仅在使用 nearestSort 时存在）
+func sortDistance(hit *elastic.SearchHit, sorter elastic.Sorter) *float64 {
+	if sorter == nil || len(hit.Sort) == 0 {
+		return nil
+	}
+	if d, ok := hit.Sort[0].(float64); ok {
+		return &d
+	}
+	return nil
+}
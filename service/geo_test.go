@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWrapLon(t *testing.T) {
+	tests := []struct {
+		lon    float64
+		isEast bool
+		want   float64
+	}{
+		{0, true, 0},
+		{179.5, false, 179.5},
+		{190, true, -170},
+		{-190, false, 170},
+		{540, false, -180},
+		{180, true, 180},
+		{180, false, -180},
+		{-180, true, 180},
+		{-180, false, -180},
+		{360, true, 0},
+		{-725, false, -5},
+	}
+	for _, tt := range tests {
+		if got := wrapLon(tt.lon, tt.isEast); got != tt.want {
+			t.Errorf("wrapLon(%v, east=%v) = %v, want %v", tt.lon, tt.isEast, got, tt.want)
+		}
+	}
+}
+
+func TestNewViewport(t *testing.T) {
+	tests := []struct {
+		name                     string
+		north, south, east, west float64
+		want                     Viewport
+		crosses                  bool
+	}{
+		{"plain", 41, 40, -73, -75, Viewport{North: 41, South: 40, East: -73, West: -75}, false},
+		{"latitude clamped", 95, -100, 10, 0, Viewport{North: 90, South: -90, East: 10, West: 0}, false},
+		{"wider than the world", 10, 0, 200, -200, Viewport{North: 10, South: 0, East: 180, West: -180}, false},
+		{"exactly the world", 10, 0, 180, -180, Viewport{North: 10, South: 0, East: 180, West: -180}, false},
+		{"unwrapped pan across antimeridian", 0, -20, 190, 170, Viewport{North: 0, South: -20, East: -170, West: 170}, true},
+		{"already wrapped antimeridian", 0, -20, -170, 170, Viewport{North: 0, South: -20, East: -170, West: 170}, true},
+		{"panned a full turn", 41, 40, 287, 285, Viewport{North: 41, South: 40, East: -73, West: -75}, false},
+		{"zero width at 180", 10, 0, 180, 180, Viewport{North: 10, South: 0, East: 180, West: 180}, false},
+		{"zero width at -180", 10, 0, -180, -180, Viewport{North: 10, South: 0, East: 180, West: 180}, false},
+		{"zero width elsewhere", 10, 0, 30, 30, Viewport{North: 10, South: 0, East: 30, West: 30}, false},
+		{"single point", 5, 5, 5, 5, Viewport{North: 5, South: 5, East: 5, West: 5}, false},
+		{"w > e, both out of range", 10, 0, 190, 200, Viewport{North: 10, South: 0, East: -170, West: -160}, true},
+		{"w > e, west out of range", 10, 0, -200, 170, Viewport{North: 10, South: 0, East: 160, West: 170}, true},
+		{"w > e, east out of range", 10, 0, -170, 190, Viewport{North: 10, South: 0, East: -170, West: -170}, false},
+		{"w > e on the antimeridian", 10, 0, -180, 180, Viewport{North: 10, South: 0, East: -180, West: 180}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newViewport(tt.north, tt.south, tt.east, tt.west)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got.CrossesAntimeridian() != tt.crosses {
+				t.Errorf("CrossesAntimeridian() = %v, want %v", got.CrossesAntimeridian(), tt.crosses)
+			}
+		})
+	}
+}
+
+func TestNewViewportErrors(t *testing.T) {
+	tests := []struct {
+		name                     string
+		north, south, east, west float64
+		field                    string
+	}{
+		{"south above north", 10, 20, 5, 0, "s"},
+		{"south above north, crossing", 10, 20, -170, 170, "s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newViewport(tt.north, tt.south, tt.east, tt.west)
+			var pe *paramError
+			if !errors.As(err, &pe) {
+				t.Fatalf("err = %v, want a paramError", err)
+			}
+			if pe.Field != tt.field {
+				t.Errorf("field = %q, want %q", pe.Field, tt.field)
+			}
+		})
+	}
+}
+
+func TestViewportContains(t *testing.T) {
+	zeroWidth, _ := newViewport(10, 0, -180, -180)
+	crossing, _ := newViewport(0, -20, 190, 170)
+	tests := []struct {
+		name string
+		vp   Viewport
+		loc  Location
+		want bool
+	}{
+		{"zero width at 180 keeps the meridian", zeroWidth, Location{Lat: 5, Lon: 180}, true},
+		{"zero width at 180 excludes the rest of the world", zeroWidth, Location{Lat: 5, Lon: 0}, false},
+		{"crossing, east half", crossing, Location{Lat: -10, Lon: 175}, true},
+		{"crossing, west half", crossing, Location{Lat: -10, Lon: -175}, true},
+		{"crossing, outside", crossing, Location{Lat: -10, Lon: 0}, false},
+		{"crossing, too far north", crossing, Location{Lat: 5, Lon: 175}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.vp.Contains(tt.loc); got != tt.want {
+			t.Errorf("%s: Contains(%+v) = %v, want %v", tt.name, tt.loc, got, tt.want)
+		}
+	}
+}
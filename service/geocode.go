@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 离线反向地理编码：启动时从 GeoNames 城市表（如 cities15000.txt）加载地名，
+// 发帖时把坐标转换为最近城市的 city / region / country，写入 ES 以便展示和过滤。
+//
+// 相关环境变量：
+//   - GAZETTEER_FILE：GeoNames 城市表路径（未设置则不启用反向地理编码）
+//   - GAZETTEER_ADMIN1_FILE：可选的 admin1CodesASCII.txt，用于把 "US.NY" 转成 "New York"
+var (
+	gazetteerFile       = os.Getenv("GAZETTEER_FILE")
+	gazetteerAdmin1File = os.Getenv("GAZETTEER_ADMIN1_FILE")
+)
+
+// maxReverseGeocodeMeters：最近城市超过该距离时不做标注（例如远洋、荒野）
+const maxReverseGeocodeMeters = 50_000
+
+// gazetteer 是启动时加载的全局地名表；为 nil 表示未启用
+var gazetteer *Gazetteer
+
+// Place 是地名表中的一个城市
+type Place struct {
+	ID         int64    `json:"id"` // GeoNames geonameid，可用于 place_id= 精确指定
+	Name       string   `json:"name"`
+	Region     string   `json:"region,omitempty"` // 一级行政区名称（无 admin1 文件时为代码，如 "NY"）
+	Country    string   `json:"country"`          // ISO 3166-1 两位国家代码
+	Location   Location `json:"location"`
+	Population int64    `json:"population,omitempty"`
+	regionCode string   // admin1 代码（如 "NY"），用于 "Syracuse, NY" 这类限定
+}
+
+// gridKey 是 1°×1° 网格单元的坐标
+type gridKey struct{ lat, lon int }
+
+// Gazetteer 保存所有城市，并按 1° 网格建立空间索引以加速最近邻查找；
+// names 是名称（含 ASCII 名与别名，统一小写）到城市下标的倒排索引，用于正向地理编码
+type Gazetteer struct {
+	places []Place
+	grid   map[gridKey][]int
+	names  map[string][]int
+	byID   map[int64]int
+}
+
+func cellOf(loc Location) gridKey {
+	return gridKey{int(math.Floor(loc.Lat)), int(math.Floor(loc.Lon))}
+}
+
+// loadGazetteer 读取 GeoNames 城市表（制表符分隔，字段顺序见 GeoNames readme）：
+// 0 geonameid, 1 name, 2 asciiname, 3 alternatenames, 4 latitude, 5 longitude,
+// 8 country code, 10 admin1 code, 14 population
+func loadGazetteer(citiesPath, admin1Path string) (*Gazetteer, error) {
+	admin1 := map[string]string{}
+	if admin1Path != "" {
+		var err error
+		if admin1, err = loadAdmin1Names(admin1Path); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(citiesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g := &Gazetteer{grid: map[gridKey][]int{}, names: map[string][]int{}, byID: map[int64]int{}}
+	sc := bufio.NewScanner(f)
+	// alternatenames 字段可能很长
+	sc.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		cols := strings.Split(sc.Text(), "\t")
+		if len(cols) < 15 {
+			continue
+		}
+		lat, errLat := strconv.ParseFloat(cols[4], 64)
+		lon, errLon := strconv.ParseFloat(cols[5], 64)
+		if errLat != nil || errLon != nil {
+			return nil, fmt.Errorf("%s:%d: invalid coordinates", citiesPath, line)
+		}
+		id, _ := strconv.ParseInt(cols[0], 10, 64)
+		pop, _ := strconv.ParseInt(cols[14], 10, 64)
+		region := cols[10]
+		if name, ok := admin1[cols[8]+"."+cols[10]]; ok {
+			region = name
+		}
+		p := Place{
+			ID:         id,
+			Name:       cols[1],
+			Region:     region,
+			Country:    cols[8],
+			Location:   Location{Lat: lat, Lon: lon},
+			Population: pop,
+			regionCode: cols[10],
+		}
+		idx := len(g.places)
+		g.grid[cellOf(p.Location)] = append(g.grid[cellOf(p.Location)], idx)
+		g.byID[id] = idx
+		// 同一城市的多个名称可能归一化后相同，只登记一次
+		seen := map[string]bool{}
+		for _, n := range append([]string{cols[1], cols[2]}, strings.Split(cols[3], ",")...) {
+			if key := normalizePlaceName(n); key != "" && !seen[key] {
+				seen[key] = true
+				g.names[key] = append(g.names[key], idx)
+			}
+		}
+		g.places = append(g.places, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// loadAdmin1Names 读取 admin1CodesASCII.txt："US.NY<TAB>New York<TAB>..."
+func loadAdmin1Names(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		cols := strings.Split(sc.Text(), "\t")
+		if len(cols) >= 2 {
+			out[cols[0]] = cols[1]
+		}
+	}
+	return out, sc.Err()
+}
+
+// Len 返回已加载的城市数量
+func (g *Gazetteer) Len() int {
+	return len(g.places)
+}
+
+// Reverse 返回距离 loc 最近、且不超过 maxMeters 的城市及其距离（米）
+func (g *Gazetteer) Reverse(loc Location, maxMeters float64) (Place, float64, bool) {
+	// 需要检查的纬度/经度网格范围（高纬度地区经度方向需要更多格子）
+	dLat := int(math.Ceil(maxMeters / 111_000))
+	cosLat := math.Max(math.Cos(loc.Lat*math.Pi/180), 0.01)
+	dLon := int(math.Min(180, math.Ceil(maxMeters/(111_000*cosLat))))
+
+	c := cellOf(loc)
+	best, bestDist := -1, maxMeters
+	for la := c.lat - dLat; la <= c.lat+dLat; la++ {
+		for lo := c.lon - dLon; lo <= c.lon+dLon; lo++ {
+			// 经度跨越 ±180 时折回另一侧
+			wrapped := ((lo+180)%360+360)%360 - 180
+			for _, i := range g.grid[gridKey{la, wrapped}] {
+				if d := haversineMeters(loc, g.places[i].Location); d <= bestDist {
+					best, bestDist = i, d
+				}
+			}
+		}
+	}
+	if best < 0 {
+		return Place{}, 0, false
+	}
+	return g.places[best], bestDist, true
+}
+
+// reverseGeocode 为帖子补充 city / region / country；未启用地名表或附近没有城市时保持为空
+func reverseGeocode(p *Post) {
+	if gazetteer == nil {
+		return
+	}
+	if place, _, ok := gazetteer.Reverse(p.Location, maxReverseGeocodeMeters); ok {
+		p.City = place.Name
+		p.Region = place.Region
+		p.Country = place.Country
+	}
+}
+
+// normalizePlaceName 统一地名的大小写与空白，作为名称索引的键
+func normalizePlaceName(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// Lookup 按名称查找城市，按人口降序返回最多 limit 个候选。
+// 名称可带逗号分隔的限定词，如 "Syracuse, NY" 或 "Paris, FR"：每个限定词需匹配地区名、地区代码或国家代码之一。
+func (g *Gazetteer) Lookup(query string, limit int) []Place {
+	parts := strings.Split(query, ",")
+	idxs := g.names[normalizePlaceName(parts[0])]
+
+	var out []Place
+	for _, i := range idxs {
+		p := g.places[i]
+		ok := true
+		for _, q := range parts[1:] {
+			q = normalizePlaceName(q)
+			if q != "" && q != strings.ToLower(p.Region) && q != strings.ToLower(p.regionCode) && q != strings.ToLower(p.Country) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			out = append(out, p)
+		}
+	}
+	sort.SliceStable(out, func(a, b int) bool { return out[a].Population > out[b].Population })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// ByID 按 GeoNames ID 查找城市
+func (g *Gazetteer) ByID(id int64) (Place, bool) {
+	i, ok := g.byID[id]
+	if !ok {
+		return Place{}, false
+	}
+	return g.places[i], true
+}
+
+// 正向地理编码的候选数量上限，以及判定“明显最佳”所需的人口倍数：
+// 例如 "Brooklyn" 时纽约的 Brooklyn 人口远超其他同名小镇，直接采用；否则返回候选让用户选择。
+const (
+	maxPlaceCandidates = 10
+	dominantPopulation = 10
+)
+
+// errGeocodingDisabled 表示没有加载地名表（未设置 GAZETTEER_FILE）；/search 的 place= 与 /geocode 都返回 503
+var errGeocodingDisabled = errors.New("geocoding is not enabled on this server (no gazetteer loaded)")
+
+// errAmbiguousPlace 表示地名有多个同等可能的候选
+type errAmbiguousPlace struct {
+	Candidates []Place
+}
+
+func (e *errAmbiguousPlace) Error() string {
+	return fmt.Sprintf("place is ambiguous (%d candidates)", len(e.Candidates))
+}
+
+// resolvePlace 解析 /search 的 place= 或 place_id= 参数；都未提供时返回 (nil, nil)。
+// 找不到时返回 *paramError，名称有歧义时返回 *errAmbiguousPlace，没有地名表时返回 errGeocodingDisabled。
+func resolvePlace(q url.Values) (*Place, error) {
+	name := strings.TrimSpace(q.Get("place"))
+	rawID := strings.TrimSpace(q.Get("place_id"))
+	if name == "" && rawID == "" {
+		return nil, nil
+	}
+	if gazetteer == nil {
+		return nil, errGeocodingDisabled
+	}
+	if rawID != "" {
+		id, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil {
+			return nil, invalidParam("place_id", "must be an integer")
+		}
+		p, ok := gazetteer.ByID(id)
+		if !ok {
+			return nil, invalidParam("place_id", "unknown place")
+		}
+		return &p, nil
+	}
+
+	cands := gazetteer.Lookup(name, maxPlaceCandidates)
+	switch {
+	case len(cands) == 0:
+		return nil, invalidParam("place", "no place found with this name")
+	case len(cands) == 1 || (cands[0].Population > 0 && cands[0].Population >= dominantPopulation*cands[1].Population):
+		return &cands[0], nil
+	default:
+		return nil, &errAmbiguousPlace{Candidates: cands}
+	}
+}
+
+// writeSearchError 将搜索参数错误写回客户端：地名有歧义时返回 300 和候选列表，没有地名表时返回 503，其余为结构化 400
+func writeSearchError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errGeocodingDisabled) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if amb, ok := err.(*errAmbiguousPlace); ok {
+		writeJSON(w, http.StatusMultipleChoices, map[string]interface{}{
+			"error": map[string]string{
+				"code":    "ambiguous_place",
+				"field":   "place",
+				"message": amb.Error() + "; retry with place_id or a qualifier such as \"Springfield, IL\"",
+			},
+			"candidates": amb.Candidates,
+		})
+		return
+	}
+	writeError(w, http.StatusBadRequest, err)
+}
+
+// handlerGeocode：GET /geocode?q=Brooklyn&limit=10 返回按人口排序的候选城市
+func handlerGeocode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	name := strings.TrimSpace(query.Get("q"))
+	if name == "" {
+		writeError(w, http.StatusBadRequest, missingParam("q"))
+		return
+	}
+	limit, err := parseLimit("limit", query.Get("limit"), maxPlaceCandidates, 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if gazetteer == nil {
+		writeError(w, http.StatusServiceUnavailable, errGeocodingDisabled)
+		return
+	}
+	out := gazetteer.Lookup(name, limit)
+	if out == nil {
+		out = []Place{}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testCities 是 GeoNames 城市表的片段（只填 loadGazetteer 用到的列）
+var testCities = []struct {
+	id         int64
+	name, alt  string
+	lat, lon   float64
+	cc, admin1 string
+	population int64
+}{
+	{5110302, "Brooklyn", "Bruklin,Brooklyn Borough", 40.6501, -73.9496, "US", "NY", 2736074},
+	{4348599, "Brooklyn", "", 39.2298, -76.6134, "US", "MD", 14373},
+	{5140405, "Syracuse", "", 43.0481, -76.1474, "US", "NY", 142327},
+	{2523083, "Siracusa", "Syracuse,Siracusa", 37.0755, 15.2866, "IT", "15", 122291},
+	{2198148, "Suva", "", -18.1416, 178.4415, "FJ", "C", 77366},
+	{2207100, "Vuna", "", -16.8833, -179.9, "FJ", "03", 1000},
+	{4099753, "Paris", "", 35.2920, -93.7299, "US", "AR", 3532},
+	{2988507, "Paris", "Paris,Paree", 48.8534, 2.3488, "FR", "11", 2138551},
+}
+
+// writeGazetteer 把 testCities 写成临时的城市表与 admin1 文件并加载
+func writeGazetteer(t *testing.T) *Gazetteer {
+	t.Helper()
+	dir := t.TempDir()
+	var rows []string
+	for _, c := range testCities {
+		cols := make([]string, 19)
+		cols[0] = strconv.FormatInt(c.id, 10)
+		cols[1], cols[2], cols[3] = c.name, c.name, c.alt
+		cols[4] = strconv.FormatFloat(c.lat, 'f', -1, 64)
+		cols[5] = strconv.FormatFloat(c.lon, 'f', -1, 64)
+		cols[8], cols[10] = c.cc, c.admin1
+		cols[14] = strconv.FormatInt(c.population, 10)
+		rows = append(rows, strings.Join(cols, "\t"))
+	}
+	cities := filepath.Join(dir, "cities.txt")
+	if err := os.WriteFile(cities, []byte(strings.Join(rows, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	admin1 := filepath.Join(dir, "admin1.txt")
+	if err := os.WriteFile(admin1, []byte("US.NY\tNew York\tNew York\t5128638\nFR.11\tÎle-de-France\tIle-de-France\t3012874\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := loadGazetteer(cities, admin1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Len() != len(testCities) {
+		t.Fatalf("loaded %d places, want %d", g.Len(), len(testCities))
+	}
+	return g
+}
+
+func TestGazetteerReverse(t *testing.T) {
+	g := writeGazetteer(t)
+	tests := []struct {
+		name     string
+		loc      Location
+		max      float64
+		wantID   int64
+		wantOK   bool
+		wantRegn string
+	}{
+		{"nearest city", Location{Lat: 40.6782, Lon: -73.9442}, maxReverseGeocodeMeters, 5110302, true, "New York"},
+		{"region code without admin1 name", Location{Lat: 39.23, Lon: -76.61}, maxReverseGeocodeMeters, 4348599, true, "MD"},
+		{"too far from any city", Location{Lat: 30, Lon: -40}, maxReverseGeocodeMeters, 0, false, ""},
+		{"limit applies", Location{Lat: 40.9, Lon: -73.9496}, 10_000, 0, false, ""},
+		{"across the antimeridian", Location{Lat: -16.88, Lon: 179.95}, maxReverseGeocodeMeters, 2207100, true, "03"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, dist, ok := g.Reverse(tt.loc, tt.max)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v (got %+v at %.0f m)", ok, tt.wantOK, p, dist)
+			}
+			if !ok {
+				return
+			}
+			if p.ID != tt.wantID || p.Region != tt.wantRegn {
+				t.Errorf("got %d (%s), want %d (%s)", p.ID, p.Region, tt.wantID, tt.wantRegn)
+			}
+			if dist > tt.max {
+				t.Errorf("distance %.0f m exceeds %v", dist, tt.max)
+			}
+		})
+	}
+}
+
+func TestGazetteerLookup(t *testing.T) {
+	g := writeGazetteer(t)
+	tests := []struct {
+		query string
+		limit int
+		want  []int64
+	}{
+		{"Brooklyn", 10, []int64{5110302, 4348599}},
+		{"  brooklyn  ", 1, []int64{5110302}},
+		{"Brooklyn, MD", 10, []int64{4348599}},
+		{"Brooklyn, new york", 10, []int64{5110302}},
+		{"Syracuse", 10, []int64{5140405, 2523083}},
+		{"Syracuse, IT", 10, []int64{2523083}},
+		{"Paree", 10, []int64{2988507}},
+		{"Paris, Île-de-France", 10, []int64{2988507}},
+		{"Paris, US", 10, []int64{4099753}},
+		{"Bruklin", 10, []int64{5110302}},
+		{"Atlantis", 10, nil},
+		{"Brooklyn, XX", 10, nil},
+	}
+	for _, tt := range tests {
+		var got []int64
+		for _, p := range g.Lookup(tt.query, tt.limit) {
+			got = append(got, p.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestGazetteerByID(t *testing.T) {
+	g := writeGazetteer(t)
+	if p, ok := g.ByID(2198148); !ok || p.Name != "Suva" {
+		t.Errorf("ByID(2198148) = %+v, %v", p, ok)
+	}
+	if _, ok := g.ByID(1); ok {
+		t.Error("ByID(1) found a place")
+	}
+}
+
+func TestReverseGeocodePost(t *testing.T) {
+	old := gazetteer
+	t.Cleanup(func() { gazetteer = old })
+
+	gazetteer = nil
+	p := Post{Location: Location{Lat: 40.6782, Lon: -73.9442}}
+	reverseGeocode(&p)
+	if p.City != "" {
+		t.Errorf("without a gazetteer City = %q, want empty", p.City)
+	}
+
+	gazetteer = writeGazetteer(t)
+	reverseGeocode(&p)
+	if p.City != "Brooklyn" || p.Region != "New York" || p.Country != "US" {
+		t.Errorf("got %q / %q / %q", p.City, p.Region, p.Country)
+	}
+}
+
+// 没有地名表时 /search 的 place= 与 /geocode 一致返回 503
+func TestPlaceSearchStatus(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTestMux()
+	mux.HandleFunc("/geocode", jwtRequired(handlerGeocode))
+	token := loginAs(t, mux, "kimi")
+	old := gazetteer
+	t.Cleanup(func() { gazetteer = old })
+
+	gazetteer = nil
+	for _, target := range []string{"/search?place=Brooklyn", "/search?place_id=5110302", "/geocode?q=Brooklyn"} {
+		if code := doJSON(t, mux, http.MethodGet, target, token, nil, nil); code != http.StatusServiceUnavailable {
+			t.Errorf("%s without a gazetteer: status %d, want 503", target, code)
+		}
+	}
+
+	gazetteer = writeGazetteer(t)
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/search?place=Brooklyn", http.StatusOK},
+		{"/search?place_id=5110302", http.StatusOK},
+		{"/search?place=Syracuse", http.StatusMultipleChoices},
+		{"/search?place=Atlantis", http.StatusBadRequest},
+		{"/search?place_id=1", http.StatusBadRequest},
+		{"/geocode?q=Brooklyn", http.StatusOK},
+		{"/geocode", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code := doJSON(t, mux, http.MethodGet, tt.target, token, nil, nil); code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.target, code, tt.status)
+		}
+	}
+}
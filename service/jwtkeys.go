@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT 签名密钥：从配置加载，可同时存在多个密钥，token 头中的 kid 指明使用的密钥。
+// 新 token 总是用最新的密钥签名，校验时接受所有未退役的密钥，因此轮换密钥不会让已登录的用户掉线：
+//  1. 追加一个新密钥（列表最后一个未退役的密钥即最新），新 token 开始使用它
+//  2. 等旧 token 全部过期（ACCESS_TOKEN_TTL）后，把旧密钥标记为 retired 或删除，用它签名的 token 随即失效
+//
+// 算法固定为 HS256，其他 alg（包括 none）一律拒绝。
+//
+// 相关环境变量（按优先级取第一个设置了的）：
+//   - JWT_KEYS_FILE：JSON 密钥文件 {"keys": [{"kid": "2026-10", "secret": "...", "retired": false}, ...]}，
+//     按从旧到新排列；收到 SIGHUP 时重新加载
+//   - JWT_KEYS：kid1:secret1,kid2:secret2（从旧到新）
+//   - JWT_SECRET：单个密钥（kid 为 "default"）
+//
+// 都未设置时启动失败。本地开发可设置 JWT_ALLOW_EPHEMERAL=1，改用进程启动时随机生成的密钥
+// （重启后或多实例之间 token 互不通用）。
+
+// jwtAlg 是唯一接受的签名算法
+var jwtAlg = jwt.SigningMethodHS256
+
+// minSecretLen 是 HS256 建议的最短密钥长度（字节），更短的密钥只给出警告
+const minSecretLen = 32
+
+// signingKey 是一个 JWT 签名密钥
+type signingKey struct {
+	ID      string `json:"kid"`
+	Secret  string `json:"secret"`
+	Retired bool   `json:"retired,omitempty"`
+}
+
+// keyRing 是一组加载好的密钥（加载后不再修改，整体替换）
+type keyRing struct {
+	keys   []signingKey
+	source string
+}
+
+var jwtKeys atomic.Pointer[keyRing]
+
+// signing 返回用于签发新 token 的密钥：最后一个未退役的密钥
+func (k *keyRing) signing() signingKey {
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if !k.keys[i].Retired {
+			return k.keys[i]
+		}
+	}
+	return signingKey{}
+}
+
+// lookup 按 kid 查找未退役的密钥
+func (k *keyRing) lookup(kid string) (signingKey, bool) {
+	for _, key := range k.keys {
+		if key.ID == kid && !key.Retired {
+			return key, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// active 返回全部未退役密钥，用于校验没有 kid 的旧 token
+func (k *keyRing) active() jwt.VerificationKeySet {
+	var set jwt.VerificationKeySet
+	for _, key := range k.keys {
+		if !key.Retired {
+			set.Keys = append(set.Keys, []byte(key.Secret))
+		}
+	}
+	return set
+}
+
+// loadSigningKeys 按 JWT_KEYS_FILE / JWT_KEYS / JWT_SECRET 的顺序加载密钥
+func loadSigningKeys() (*keyRing, error) {
+	var ring keyRing
+	switch {
+	case os.Getenv("JWT_KEYS_FILE") != "":
+		path := os.Getenv("JWT_KEYS_FILE")
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var file struct {
+			Keys []signingKey `json:"keys"`
+		}
+		if err := json.Unmarshal(b, &file); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		ring = keyRing{keys: file.Keys, source: path}
+	case os.Getenv("JWT_KEYS") != "":
+		for _, item := range strings.Split(os.Getenv("JWT_KEYS"), ",") {
+			kid, secret, ok := strings.Cut(strings.TrimSpace(item), ":")
+			if !ok {
+				return nil, fmt.Errorf("JWT_KEYS: %q is not kid:secret", item)
+			}
+			ring.keys = append(ring.keys, signingKey{ID: kid, Secret: secret})
+		}
+		ring.source = "JWT_KEYS"
+	case os.Getenv("JWT_SECRET") != "":
+		ring = keyRing{keys: []signingKey{{ID: "default", Secret: os.Getenv("JWT_SECRET")}}, source: "JWT_SECRET"}
+	case os.Getenv("JWT_ALLOW_EPHEMERAL") != "1":
+		return nil, errors.New("no signing key configured: set JWT_KEYS_FILE, JWT_KEYS or JWT_SECRET " +
+			"(or JWT_ALLOW_EPHEMERAL=1 to use a random key for local development)")
+	default:
+		b := make([]byte, minSecretLen)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		log.Printf("[auth] WARNING: JWT_ALLOW_EPHEMERAL=1 and no JWT_KEYS_FILE / JWT_KEYS / JWT_SECRET set; using a random signing key. " +
+			"Tokens will not survive a restart or work across instances")
+		return &keyRing{keys: []signingKey{{ID: "ephemeral", Secret: string(b)}}, source: "random"}, nil
+	}
+
+	seen := map[string]bool{}
+	for _, key := range ring.keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, fmt.Errorf("%s: every key needs a kid and a secret", ring.source)
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("%s: duplicate kid %q", ring.source, key.ID)
+		}
+		seen[key.ID] = true
+		if len(key.Secret) < minSecretLen && !key.Retired {
+			log.Printf("[auth] WARNING: JWT key %q is shorter than %d bytes", key.ID, minSecretLen)
+		}
+	}
+	if ring.signing().ID == "" {
+		return nil, fmt.Errorf("%s: no active (non-retired) key", ring.source)
+	}
+	return &ring, nil
+}
+
+// initSigningKeys 在启动时加载密钥；使用密钥文件时，收到 SIGHUP 会重新加载（失败则保留原有密钥）
+func initSigningKeys() error {
+	ring, err := loadSigningKeys()
+	if err != nil {
+		return err
+	}
+	setSigningKeys(ring)
+	if os.Getenv("JWT_KEYS_FILE") == "" {
+		return nil
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			ring, err := loadSigningKeys()
+			if err != nil {
+				log.Printf("[auth] reload JWT keys failed, keeping current keys: %v", err)
+				continue
+			}
+			setSigningKeys(ring)
+		}
+	}()
+	return nil
+}
+
+func setSigningKeys(ring *keyRing) {
+	jwtKeys.Store(ring)
+	var ids []string
+	for _, key := range ring.keys {
+		if !key.Retired {
+			ids = append(ids, key.ID)
+		}
+	}
+	log.Printf("[auth] JWT keys from %s: signing with %q, accepting %v", ring.source, ring.signing().ID, ids)
+}
+
+// signToken 用最新的密钥签名，并在头中写入 kid
+func signToken(claims jwt.Claims) (string, error) {
+	key := jwtKeys.Load().signing()
+	token := jwt.NewWithClaims(jwtAlg, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString([]byte(key.Secret))
+}
+
+// jwtKeyfunc 校验算法并按 kid 选择密钥；没有 kid 的 token（轮换前签发）依次尝试全部未退役的密钥
+func jwtKeyfunc(token *jwt.Token) (interface{}, error) {
+	if token.Method != jwtAlg {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	ring := jwtKeys.Load()
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return ring.active(), nil
+	}
+	key, ok := ring.lookup(kid)
+	if !ok {
+		return nil, errors.New("unknown or retired key id " + kid)
+	}
+	return []byte(key.Secret), nil
+}
+
+// parseToken 解析并校验 token（只接受 HS256）
+func parseToken(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, jwtKeyfunc, jwt.WithValidMethods([]string{jwtAlg.Alg()}))
+}
+
+// parseTokenIgnoringExpiry 只校验签名，不检查过期时间等声明；仅供 /logout 找到过期令牌所属的会话
+func parseTokenIgnoringExpiry(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, jwtKeyfunc, jwt.WithValidMethods([]string{jwtAlg.Alg()}), jwt.WithoutClaimsValidation())
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oldSecret = "old-secret-old-secret-old-secret-old"
+	newSecret = "new-secret-new-secret-new-secret-new"
+)
+
+// setKeyEnv 清空密钥相关的变量后只设置 name（name 为空时全部不设置）
+func setKeyEnv(t *testing.T, name, value string) {
+	t.Helper()
+	for _, v := range []string{"JWT_KEYS_FILE", "JWT_KEYS", "JWT_SECRET", "JWT_ALLOW_EPHEMERAL"} {
+		t.Setenv(v, "")
+	}
+	if name != "" {
+		t.Setenv(name, value)
+	}
+}
+
+// useKeyRing 在测试期间替换全局密钥
+func useKeyRing(t *testing.T, keys ...signingKey) {
+	t.Helper()
+	old := jwtKeys.Load()
+	t.Cleanup(func() { jwtKeys.Store(old) })
+	jwtKeys.Store(&keyRing{keys: keys, source: "test"})
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	rotated := writeFile("rotated.json", `{"keys": [
+		{"kid": "2026-09", "secret": "`+oldSecret+`", "retired": true},
+		{"kid": "2026-10", "secret": "`+newSecret+`"}]}`)
+	allRetired := writeFile("retired.json", `{"keys": [{"kid": "a", "secret": "`+oldSecret+`", "retired": true}]}`)
+	broken := writeFile("broken.json", `{"keys": [`)
+
+	tests := []struct {
+		name, env, value string
+		signing          string
+		err              string
+	}{
+		{"keys file", "JWT_KEYS_FILE", rotated, "2026-10", ""},
+		{"keys file with only retired keys", "JWT_KEYS_FILE", allRetired, "", "no active"},
+		{"broken keys file", "JWT_KEYS_FILE", broken, "", "parse"},
+		{"missing keys file", "JWT_KEYS_FILE", filepath.Join(dir, "missing.json"), "", "no such file"},
+		{"key list, newest last", "JWT_KEYS", "a:" + oldSecret + ", b:" + newSecret, "b", ""},
+		{"key list without secret", "JWT_KEYS", "a", "", "not kid:secret"},
+		{"empty secret", "JWT_KEYS", "a:", "", "needs a kid and a secret"},
+		{"duplicate kid", "JWT_KEYS", "a:" + oldSecret + ",a:" + newSecret, "", "duplicate kid"},
+		{"single secret", "JWT_SECRET", oldSecret, "default", ""},
+		{"nothing set", "", "", "", "no signing key configured"},
+		{"random key for development", "JWT_ALLOW_EPHEMERAL", "1", "ephemeral", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setKeyEnv(t, tt.env, tt.value)
+			ring, err := loadSigningKeys()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ring.signing().ID; got != tt.signing {
+				t.Errorf("signing kid = %q, want %q", got, tt.signing)
+			}
+		})
+	}
+
+	// JWT_KEYS_FILE 优先于其他变量
+	setKeyEnv(t, "JWT_KEYS_FILE", rotated)
+	t.Setenv("JWT_SECRET", oldSecret)
+	if ring, err := loadSigningKeys(); err != nil || ring.source != rotated {
+		t.Errorf("source = %v, %v, want %s", ring, err, rotated)
+	}
+}
+
+// signWith 用指定密钥签名；kid 为空时不写 kid 头（轮换前签发的 token）
+func signWith(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"username": "kimi",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	useKeyRing(t, signingKey{ID: "old", Secret: oldSecret})
+	oldToken, err := signToken(jwt.MapClaims{"username": "kimi", "exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. 追加新密钥：新 token 使用新密钥，旧 token 仍然有效
+	useKeyRing(t, signingKey{ID: "old", Secret: oldSecret}, signingKey{ID: "new", Secret: newSecret})
+	newToken, err := signToken(jwt.MapClaims{"username": "kimi", "exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, _, err := jwt.NewParser().ParseUnverified(newToken, jwt.MapClaims{}); err != nil || tok.Header["kid"] != "new" {
+		t.Fatalf("new token not signed with the newest key")
+	}
+	for name, s := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := parseToken(s); err != nil {
+			t.Errorf("%s token rejected after adding a key: %v", name, err)
+		}
+	}
+
+	// 2. 退役旧密钥：用它签名的 token 随即失效
+	useKeyRing(t, signingKey{ID: "old", Secret: oldSecret, Retired: true}, signingKey{ID: "new", Secret: newSecret})
+	if _, err := parseToken(oldToken); err == nil {
+		t.Error("token signed with a retired key was accepted")
+	}
+	if _, err := parseToken(newToken); err != nil {
+		t.Errorf("token signed with the active key rejected: %v", err)
+	}
+}
+
+func TestJWTKeyfuncRejects(t *testing.T) {
+	useKeyRing(t, signingKey{ID: "old", Secret: oldSecret, Retired: true}, signingKey{ID: "new", Secret: newSecret})
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"known kid", signWith(t, jwt.SigningMethodHS256, "new", []byte(newSecret)), true},
+		{"no kid, active key", signWith(t, jwt.SigningMethodHS256, "", []byte(newSecret)), true},
+		{"no kid, retired key", signWith(t, jwt.SigningMethodHS256, "", []byte(oldSecret)), false},
+		{"unknown kid", signWith(t, jwt.SigningMethodHS256, "other", []byte(newSecret)), false},
+		{"kid of another key", signWith(t, jwt.SigningMethodHS256, "new", []byte(oldSecret)), false},
+		{"HS512", signWith(t, jwt.SigningMethodHS512, "new", []byte(newSecret)), false},
+		{"alg none", signWith(t, jwt.SigningMethodNone, "new", jwt.UnsafeAllowNoneSignatureType), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseToken(tt.token)
+			if (err == nil) != tt.ok {
+				t.Errorf("parseToken err = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
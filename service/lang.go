@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"unicode"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// 多语言全文检索：message 字段保留默认的 standard 分析器，另外增加两个子字段：
+//   - message.en ：english 分析器（词干化、英文停用词），"dogs" 能匹配 "dog"
+//   - message.cjk：cjk 分析器（二元切分），中文/日文/韩文没有空格也能按词片段匹配
+//   - message.suggest：search_as_you_type（edge-ngram 前缀子字段），供 /suggest 按输入前缀补全
+// 写入时按字符所属文字检测帖子语言（lang 字段），查询时按关键词的语言选择子字段。
+
+// 语言代码（lang 字段取值）
+const (
+	langEnglish  = "en"
+	langChinese  = "zh"
+	langJapanese = "ja"
+	langKorean   = "ko"
+	langUnknown  = "und"
+)
+
+// messageFieldMapping 是 message 多字段的 mapping 片段，posts 与 saved_searches 两个索引共用
+// （percolator 索引中的字段定义必须和帖子一致，保存的关键词查询才能匹配子字段）
+const messageFieldMapping = `{
+	"type": "text",
+	"fields": {
+		"en":      { "type": "text", "analyzer": "english" },
+		"cjk":     { "type": "text", "analyzer": "cjk" },
+		"suggest": { "type": "search_as_you_type" }
+	}
+}`
+
+// detectLanguage 按文字系统粗略判断文本语言：
+// 含假名视为日文、含谚文视为韩文、汉字为主视为中文，其余以拉丁字母为主视为英文。
+func detectLanguage(text string) string {
+	var han, kana, hangul, latin int
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r):
+			kana++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+	cjk := han + kana + hangul
+	switch {
+	case cjk == 0 && latin == 0:
+		return langUnknown
+	case kana > 0 && cjk >= latin/4:
+		return langJapanese
+	case hangul > 0 && cjk >= latin/4:
+		return langKorean
+	// 一个汉字大致相当于几个拉丁字母，中英混排时汉字较少也按中文处理
+	case han > 0 && han*4 >= latin:
+		return langChinese
+	case latin > 0:
+		return langEnglish
+	default:
+		return langUnknown
+	}
+}
+
+// isCJK 判断语言代码是否属于中日韩
+func isCJK(lang string) bool {
+	return lang == langChinese || lang == langJapanese || lang == langKorean
+}
+
+// keywordQuery 根据关键词本身的语言选择要查询的 message 子字段：
+// 中日韩关键词查 message.cjk（二元切分），其他查 message.en（词干化），并都附带原始 message 字段。
+// 所有关键词都需命中（operator=and）。
+func keywordQuery(text string) elastic.Query {
+	fields := []string{"message", "message.en"}
+	if isCJK(detectLanguage(text)) {
+		fields = []string{"message", "message.cjk"}
+	}
+	return elastic.NewMultiMatchQuery(text, fields...).
+		Type("most_fields").
+		Operator("and")
+}
+
+// backfillPostLanguages 是 lang 字段的数据迁移：为还没有 lang 的旧帖子检测语言并部分更新。
+// 更新会让 ES 重新索引整篇文档，从而同时填充新增的 message.en / message.cjk 子字段。
+// 只处理缺少 lang 的文档，可在每次启动时安全重复执行。
+func backfillPostLanguages(ctx context.Context, client *elastic.Client) error {
+	scroll := client.Scroll(INDEX).
+		Query(elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("lang"))).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("message")).
+		Size(500)
+	defer scroll.Clear(context.Background())
+
+	total := 0
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		bulk := client.Bulk().Index(INDEX)
+		for _, hit := range res.Hits.Hits {
+			var p Post
+			if err := json.Unmarshal(hit.Source, &p); err != nil {
+				continue
+			}
+			bulk.Add(elastic.NewBulkUpdateRequest().Id(hit.Id).Doc(map[string]string{"lang": detectLanguage(p.Message)}))
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		resp, err := bulk.Do(ctx)
+		if err != nil {
+			return err
+		}
+		total += len(resp.Succeeded())
+		if failed := resp.Failed(); len(failed) > 0 {
+			log.Printf("[migrate] lang backfill: %d update(s) failed, first: %v", len(failed), failed[0].Error)
+		}
+		log.Printf("[migrate] lang backfill: %d post(s) updated so far", total)
+	}
+	if total > 0 {
+		log.Printf("[migrate] lang backfill done: %d post(s) updated", total)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", langUnknown},
+		{"12345 !!! 🎉", langUnknown},
+		{"coffee in manhattan", langEnglish},
+		{"Café au lait à Paris", langEnglish},
+		{"今天天气很好", langChinese},
+		{"在 NYC 喝咖啡", langChinese},
+		{"北京 is nice", langChinese},
+		{"I love 北京 and many other cities around the whole world", langEnglish},
+		{"東京でコーヒーを飲む", langJapanese},
+		{"カフェ", langJapanese},
+		{"서울에서 커피", langKorean},
+		{"Seoul 커피", langKorean},
+	}
+	for _, tt := range tests {
+		if got := detectLanguage(tt.text); got != tt.want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestIsCJK(t *testing.T) {
+	for lang, want := range map[string]bool{
+		langChinese: true, langJapanese: true, langKorean: true,
+		langEnglish: false, langUnknown: false,
+	} {
+		if got := isCJK(lang); got != want {
+			t.Errorf("isCJK(%q) = %v, want %v", lang, got, want)
+		}
+	}
+}
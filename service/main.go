@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,7 +11,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -18,7 +18,6 @@ import (
 	"cloud.google.com/go/storage"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"github.com/olivere/elastic/v7"
 )
 
 // Location 结构体表示地理位置，包含纬度和经度
@@ -29,16 +28,37 @@ type Location struct {
 
 // Post 结构体表示一条用户发的帖子，包含用户名、消息和地理位置
 type Post struct {
-	User     string   `json:"user"`          // 用户名
-	Message  string   `json:"message"`       // 帖子内容
-	Location Location `json:"location"`      // 帖子对应的地理位置
-	Url      string   `json:"url,omitempty"` // 图片在GCS中的公开访问地址
+	User     string   `json:"user"`           // 用户名
+	Message  string   `json:"message"`        // 帖子内容
+	Location Location `json:"location"`       // 帖子对应的地理位置
+	Url      string   `json:"url,omitempty"`  // 图片在GCS中的公开访问地址
+	Tags     []string `json:"tags,omitempty"` // 从消息中提取的 #标签（小写、去重）
+	// 反向地理编码得到的最近城市（需配置 GAZETTEER_FILE）
+	City    string `json:"city,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Country string `json:"country,omitempty"`
+	// 写入时检测的语言（en/zh/ja/ko/und），决定全文检索使用的子字段
+	Lang string `json:"lang,omitempty"`
+	// 发帖时间：各存储后端的搜索结果都按它排列（最新在前），编辑不会改变；
+	// 引入该字段之前的帖子没有发帖时间，排在最后
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// 编辑标记：Revision 为已编辑次数，各版本内容保存在修订历史中（见 edit.go）
+	Edited   bool       `json:"edited,omitempty"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	Revision int        `json:"revision,omitempty"`
+	// 软删除：删除时间与操作人；已删除的帖子不出现在搜索中，保留期后永久删除（见 trash.go）
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+	// 限时帖子的到期时间：到期后不再出现在搜索中，并由后台任务删除（见 ephemeral.go）
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 // PostWithID 用于在搜索响应中携带 ES 文档 ID（便于前端删除等操作）。
 type PostWithID struct {
 	ID string `json:"id"`
 	Post
+	// DistanceMeters 仅在 mode=nearest 时返回：帖子到查询点的距离（米）
+	DistanceMeters *float64 `json:"distance_m,omitempty"`
 }
 
 const (
@@ -94,36 +114,62 @@ func getenvDefault(k, def string) string {
 // 简化版 JWT 示例（课程项目）
 // =====================
 
-// 定义签名秘钥（生产环境应改为安全的随机字符串）
-var mySigningKey = []byte("secret")
+// 签名密钥从配置加载并支持轮换（见 jwtkeys.go）
 
-// generateToken：根据用户名生成 JWT，过期时间 24 小时；并携带 is_admin 声明
-func generateToken(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// generateToken：根据用户名生成访问令牌（JWT），有效期 ACCESS_TOKEN_TTL；携带 is_admin 声明、
+// 用于吊销的 jti 与所属会话 sid（见 tokens.go）
+func generateToken(username, session string) (string, error) {
+	now := time.Now()
+	return signToken(jwt.MapClaims{
 		"username": username,
 		"is_admin": isAdminUsername(username),
-		"exp":      time.Now().Add(24 * time.Hour).Unix(), // 24 小时有效期
+		"iat":      now.Unix(),
+		"exp":      now.Add(accessTokenTTL).Unix(),
+		"jti":      uuid.New().String(),
+		"sid":      session,
 	})
-	return token.SignedString(mySigningKey)
 }
 
-// jwtRequired：检查请求头中的 Authorization 是否带有有效的 JWT
+// jwtRequired：检查请求头中的 Authorization（或网页会话的 Cookie，见 cookies.go）是否带有有效的 JWT
 func jwtRequired(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if !strings.HasPrefix(tokenString, "Bearer ") {
+		tokenString, fromCookie := bearerOrCookieToken(r)
+		if tokenString == "" {
 			http.Error(w, "Missing token", http.StatusUnauthorized)
 			return
 		}
-		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
+		// Cookie 会被浏览器自动带上：写操作需要 double-submit CSRF 令牌
+		if fromCookie && stateChanging(r.Method) && !csrfValid(r) {
+			http.Error(w, "forbidden: missing or invalid "+csrfHeader, http.StatusForbidden)
+			return
+		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return mySigningKey, nil
-		})
+		// 只接受 HS256，按 kid 选择密钥
+		token, err := parseToken(tokenString)
 		if err != nil || !token.Valid {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
+		// 已注销或被吊销的令牌与会话（旧令牌没有 jti / sid，不检查）
+		jti, session, _ := tokenClaims(token)
+		var ids []string
+		if jti != "" {
+			ids = append(ids, jti)
+		}
+		if session != "" {
+			ids = append(ids, sessionRevocationID(session))
+		}
+		if len(ids) > 0 {
+			revoked, err := tokenStore.IsRevoked(r.Context(), ids...)
+			if err != nil {
+				http.Error(w, "failed to check token: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if revoked {
+				http.Error(w, "Token revoked", http.StatusUnauthorized)
+				return
+			}
+		}
 
 		// 从 JWT 提取用户名，并基于当前环境变量现算 is_admin；旧 token 仅作兜底
 		var username string
@@ -173,32 +219,96 @@ func containsFilteredWords(s *string) bool {
 	return false
 }
 
-// saveToES 用于保存帖子到Elasticsearch
-func saveToES(p *Post, id string) error {
-	// 创建ES客户端（连接URL并关闭嗅探）
-	esClient, err := elastic.NewClient(
-		elastic.SetURL(ES_URL),
-		elastic.SetSniff(false),
-	)
+// postInput 是 JSON 格式的发帖请求体（/post 与 /post/bulk 共用）；坐标使用指针解码，以区分“缺失”与“0”
+type postInput struct {
+	Message  string `json:"message"`
+	Location struct {
+		Lat *float64 `json:"lat"`
+		Lon *float64 `json:"lon"`
+	} `json:"location"`
+	Url string `json:"url"`
+	// 有效期：到期时间或时长（字符串 "90m" 或秒数），二选一
+	ExpiresAt string          `json:"expires_at"`
+	TTL       json.RawMessage `json:"ttl"`
+}
+
+// toPost 校验坐标与有效期，生成作者为 username 的帖子
+func (in postInput) toPost(username string) (Post, error) {
+	loc, err := validateLocation(in.Location.Lat, in.Location.Lon)
 	if err != nil {
-		return err
+		return Post{}, err
 	}
-
-	// 写入索引（指定index与id，body为帖子内容）
-	_, err = esClient.Index().
-		Index(INDEX).
-		Id(id).
-		BodyJson(p).
-		Refresh("true"). // 立即可见，便于测试；生产可去掉或用"wait_for"
-		Do(context.Background())
+	expiresAt, err := parseExpiry(in.ExpiresAt, ttlString(in.TTL))
 	if err != nil {
-		return err
+		return Post{}, err
 	}
+	now := time.Now().UTC()
+	return Post{User: username, Message: in.Message, Location: loc, Url: in.Url, CreatedAt: &now, ExpiresAt: expiresAt}, nil
+}
+
+// preparePost 补充帖子的派生字段并检查禁用词，单条发帖与批量导入共用
+func preparePost(p *Post) error {
+	// 从消息中提取 #标签（忽略客户端自带的 tags）
+	p.Tags = extractHashtags(p.Message)
+	// 根据坐标补充城市/地区/国家
+	reverseGeocode(p)
+	// 检测帖子语言
+	p.Lang = detectLanguage(p.Message)
 
-	fmt.Printf("Post is saved to index=%s, id=%s, message=%s\n", INDEX, id, p.Message)
+	// 检查帖子内容是否包含禁用词（如广告、政治内容等）
+	if containsFilteredWords(&p.Message) {
+		return invalidParam("message", "message contains forbidden words")
+	}
 	return nil
 }
 
+// savePost 保存帖子到存储（postRepo）并记录 created 事件（见 changes.go），再执行写入后的附加处理。
+// 返回 errChangesNotRecorded 时帖子已经保存
+func savePost(ctx context.Context, p *Post, id, actor string) error {
+	events, err := writeWithChanges(ctx, func(ctx context.Context) ([]ChangeEvent, error) {
+		if err := postRepo.Save(ctx, id, p); err != nil {
+			return nil, err
+		}
+		return []ChangeEvent{newChange(changeCreated, id, p, actor)}, nil
+	})
+	if len(events) > 0 {
+		postSaved(ctx, p, id)
+	}
+	return err
+}
+
+// updatePost 仅当帖子仍为版本 ver 时覆盖写入（见 concurrency.go）并记录 updated 事件，返回新版本。
+// 返回 errChangesNotRecorded 时帖子已经更新
+func updatePost(ctx context.Context, p *Post, id string, ver PostVersion, actor string) (PostVersion, error) {
+	var newVer PostVersion
+	events, err := writeWithChanges(ctx, func(ctx context.Context) ([]ChangeEvent, error) {
+		var err error
+		if newVer, err = postRepo.SaveIf(ctx, id, p, ver); err != nil {
+			return nil, err
+		}
+		return []ChangeEvent{newChange(changeUpdated, id, p, actor)}, nil
+	})
+	if len(events) == 0 {
+		return PostVersion{}, err
+	}
+	postSaved(ctx, p, id)
+	return newVer, err
+}
+
+// postSaved 是写入后的附加处理：使搜索缓存失效、匹配保存的搜索
+func postSaved(ctx context.Context, p *Post, id string) {
+	fmt.Printf("Post is saved to %s, id=%s, message=%s\n", storageBackend, id, p.Message)
+	// 使覆盖该位置的搜索缓存失效
+	searchCache.InvalidateAt(p.Location)
+
+	// 反向匹配用户保存的搜索（地理围栏提醒，仅 ES 后端）；失败不影响发帖本身
+	if esClient != nil {
+		if err := matchSavedSearches(ctx, esClient, p, id); err != nil {
+			log.Printf("percolate saved searches for post %s failed: %v", id, err)
+		}
+	}
+}
+
 // saveToGCS 将上传的文件写入到指定的 GCS 存储桶，并返回可公开访问的 URL。
 // 课堂/练习的最简单做法是假设 Bucket 已设置为 public-read（Uniform 访问控制 + allUsers: Storage Object Viewer）。
 func saveToGCS(ctx context.Context, bucket string, r io.Reader, originalName string) (string, error) {
@@ -270,95 +380,37 @@ func saveToLocal(ctx context.Context, dir string, r io.Reader, originalName stri
 // handlerSearch 处理搜索请求
 func handlerSearch(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Received one request for search")
+	started := time.Now()
 
-	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64) // 解析纬度参数
-	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64) // 解析经度参数
-
-	mode := strings.ToLower(r.URL.Query().Get("mode"))
-	// Optional max results (default 200, cap 1000)
-	size := 200
-	if v := r.URL.Query().Get("limit"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			if n < 1 {
-				size = 1
-			} else if n > 1000 {
-				size = 1000
-			} else {
-				size = n
-			}
-		}
-	}
-
-	ran := DISTANCE
-	if val := r.URL.Query().Get("range"); val != "" {
-		ran = val + "km" // 解析搜索范围参数
-	}
-
-	fmt.Printf("Search received: %f %f %s\n", lat, lon, ran)
-
-	// 创建ES客户端（连接到指定URL并关闭嗅探功能）
-	client, err := elastic.NewClient(
-		elastic.SetURL(ES_URL),
-		elastic.SetSniff(false),
-	)
+	// 先校验参数，再连接 ES
+	params, err := parseSearchParams(r.URL.Query())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeSearchError(w, err)
 		return
 	}
+	if pj, err := json.Marshal(params); err == nil {
+		fmt.Printf("Search received: %s\n", pj)
+	}
 
-	// 根据模式构建查询：
-	// 1) 默认圆形半径模式（lat/lon/range）
-	// 2) 视野模式（mode=viewport + n/s/e/w）使用 geo_bounding_box
-	var q elastic.Query
-	if mode == "viewport" {
-		// 读取四至（北 South 东 West）
-		north, errN := strconv.ParseFloat(r.URL.Query().Get("n"), 64)
-		south, errS := strconv.ParseFloat(r.URL.Query().Get("s"), 64)
-		east, errE := strconv.ParseFloat(r.URL.Query().Get("e"), 64)
-		west, errW := strconv.ParseFloat(r.URL.Query().Get("w"), 64)
-		if errN != nil || errS != nil || errE != nil || errW != nil {
-			http.Error(w, "invalid viewport bounds (n/s/e/w)", http.StatusBadRequest)
-			return
-		}
-		q = elastic.NewGeoBoundingBoxQuery("location").
-			TopLeft(north, west).
-			BottomRight(south, east)
-	} else {
-		// 默认圆形距离查询
-		q = elastic.NewGeoDistanceQuery("location").
-			Distance(ran).
-			Lat(lat).
-			Lon(lon)
-	}
-
-	// 执行搜索请求（在指定索引中执行查询）
-	res, err := client.Search().
-		Index(INDEX).
-		Query(q).
-		Size(size).
-		Pretty(true).
-		Do(context.Background())
+	// 先查进程内缓存，未命中再查 ES
+	out, total, cached, err := cachedSearch(r.Context(), params)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	fmt.Printf("Query took %d ms, total hits %d\n", res.TookInMillis, res.TotalHits())
-
-	var out []PostWithID
-	// 遍历搜索结果，带上每条文档的 ES ID
-	for _, hit := range res.Hits.Hits {
-		var p Post
-		if err := json.Unmarshal(hit.Source, &p); err == nil {
-			out = append(out, PostWithID{
-				ID:   hit.Id,
-				Post: p,
-			})
-		}
+	if cached {
+		// 缓存期间到期的限时帖子不再返回
+		out, total = dropExpired(out, total, time.Now())
 	}
 
-	// 将结果编码为JSON
-	b, err := json.Marshal(out)
+	// 默认返回带总数、耗时、分页信息的信封；旧客户端可通过 ?format=array 或 Accept 头要求裸数组
+	resp := newSearchResponse(params, out, total, started)
+	resp.Cached = cached
+	var body interface{} = resp
+	if wantsBareArray(r) {
+		body = out
+	}
+	b, err := json.Marshal(body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -394,16 +446,24 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// 从表单获取文本字段
-		lat, _ := strconv.ParseFloat(r.FormValue("lat"), 64)
-		lon, _ := strconv.ParseFloat(r.FormValue("lon"), 64)
+		// 从表单获取文本字段（坐标必须合法，避免缺省成 0,0）
+		loc, err := parseLocation(r.FormValue("lat"), r.FormValue("lon"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		expiresAt, err := parseExpiry(r.FormValue("expires_at"), r.FormValue("ttl"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		now := time.Now().UTC()
 		p = Post{
-			User:    username,
-			Message: r.FormValue("message"),
-			Location: Location{
-				Lat: lat,
-				Lon: lon,
-			},
+			User:      username,
+			Message:   r.FormValue("message"),
+			Location:  loc,
+			CreatedAt: &now,
+			ExpiresAt: expiresAt,
 		}
 
 		// 从表单获取文件字段：key = "image"（可选）
@@ -435,26 +495,33 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		// --- 处理原有 JSON 请求 ---
+		var in postInput
 		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&p); err != nil {
-			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		if err := decoder.Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, &paramError{Code: errCodeBadBody, Message: "invalid JSON body"})
+			return
+		}
+		var err error
+		if p, err = in.toPost(username); err != nil {
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
-		p.User = username
 	}
 
-	// 检查帖子内容是否包含禁用词（如广告、政治内容等）
-	if containsFilteredWords(&p.Message) {
-		http.Error(w, "message contains forbidden words", http.StatusBadRequest)
+	if err := preparePost(&p); err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	// 生成唯一ID（用于ES文档ID）
+	// 生成唯一ID（用作帖子ID）
 	id := uuid.New().String()
 
-	// 保存到ES（写入posts索引）
-	if err := saveToES(&p, id); err != nil {
-		http.Error(w, "failed to save to ES: "+err.Error(), http.StatusInternalServerError)
+	// 保存到存储（ES 后端写入posts索引）
+	if err := savePost(r.Context(), &p, id, username); errors.Is(err, errChangesNotRecorded) {
+		writeChangesNotRecorded(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to save post: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -491,25 +558,14 @@ func handlerDeletePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 创建 ES 客户端
-	client, err := elastic.NewClient(
-		elastic.SetURL(ES_URL),
-		elastic.SetSniff(false),
-	)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// 先取文档，验证是否作者本人或管理员
-	getResp, err := client.Get().Index(INDEX).Id(id).Do(r.Context())
-	if err != nil || !getResp.Found {
+	// 先取帖子，验证是否作者本人或管理员；已在回收站中或已到期的帖子视为不存在
+	p, ver, err := postRepo.GetVersioned(r.Context(), id)
+	if errors.Is(err, ErrPostNotFound) || (err == nil && (p.DeletedAt != nil || p.expired(time.Now()))) {
 		http.Error(w, "post not found", http.StatusNotFound)
 		return
 	}
-	var p Post
-	if err := json.Unmarshal(getResp.Source, &p); err != nil {
-		http.Error(w, "failed to parse post", http.StatusInternalServerError)
+	if err != nil {
+		http.Error(w, "failed to load post: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	log.Printf("[auth] delete id=%q by user=%q isAdmin=%v admins=%v", id, username, isAdminFromCtx(r.Context()), adminSet)
@@ -518,25 +574,35 @@ func handlerDeletePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 通过验证后执行删除
-	if _, err := client.Delete().Index(INDEX).Id(id).Refresh("true").Do(r.Context()); err != nil {
-		http.Error(w, "delete failed: "+err.Error(), http.StatusInternalServerError)
+	if !checkIfMatch(w, r, ver) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	_, _ = w.Write([]byte(`{"status":"deleted"}`))
+	// 通过验证后移入回收站（保留期后由后台任务永久删除，见 trash.go）；
+	// 以读取时的版本为条件写入，避免与同时进行的编辑或删除互相覆盖
+	newVer, err := softDeletePost(r.Context(), id, p, username, ver)
+	if errors.Is(err, ErrVersionConflict) {
+		writeVersionConflict(w, r)
+		return
+	}
+	if errors.Is(err, errChangesNotRecorded) {
+		writeChangesNotRecorded(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "delete failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", newVer.ETag())
+	writeJSON(w, http.StatusOK, DeleteResponse{Status: "deleted", DeletedAt: p.DeletedAt, PurgeAt: purgeAt(p)})
 }
 
 func main() {
-	// 创建ES客户端（连接到指定URL并关闭嗅探功能）
-	client, err := elastic.NewClient(
-		elastic.SetURL(ES_URL),
-		elastic.SetSniff(false),
-	)
-	if err != nil {
-		log.Fatalf("failed to create ES client: %v", err)
+	// 子命令 export / import（见 transfer.go）：执行完即退出，不启动 HTTP 服务
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
 		return
 	}
 
@@ -554,63 +620,37 @@ func main() {
 		log.Printf("no ADMIN_USERS set; no superuser configured")
 	}
 
-	// Step 2/3: 确保用户索引存在（用于注册/登录）
-	usersExists, err := client.IndexExists(USERS_INDEX).Do(context.Background())
-	if err != nil {
-		log.Fatalf("failed to check users index existence: %v", err)
+	// 加载 JWT 签名密钥（JWT_KEYS_FILE / JWT_KEYS / JWT_SECRET）
+	if err := initSigningKeys(); err != nil {
+		log.Fatalf("failed to load JWT signing keys: %v", err)
 		return
 	}
-	if !usersExists {
-		usersMapping := `{
-			"mappings": {
-				"properties": {
-					"username": { "type": "keyword" },
-					"password": { "type": "keyword" },
-					"age":      { "type": "integer" },
-					"gender":   { "type": "keyword" }
-				}
-			}
-		}`
-		if _, err := client.CreateIndex(USERS_INDEX).BodyString(usersMapping).Do(context.Background()); err != nil {
-			log.Fatalf("failed to create users index %q: %v", USERS_INDEX, err)
+
+	// 可选：加载离线地名表，用于发帖时的反向地理编码
+	if gazetteerFile != "" {
+		g, err := loadGazetteer(gazetteerFile, gazetteerAdmin1File)
+		if err != nil {
+			log.Fatalf("failed to load gazetteer %q: %v", gazetteerFile, err)
 			return
 		}
+		gazetteer = g
+		log.Printf("gazetteer loaded: %d places from %q", g.Len(), gazetteerFile)
+	} else {
+		log.Printf("no GAZETTEER_FILE set; reverse geocoding disabled")
 	}
 
-	// 查询ES索引是否存在（返回true或false）
-	exists, err := client.IndexExists(INDEX).Do(context.Background())
-	if err != nil {
-		log.Fatalf("failed to check index existence: %v", err)
+	// 初始化帖子与用户存储（ES 后端会创建/升级索引）
+	if err := openRepositories(context.Background()); err != nil {
+		log.Fatalf("failed to open %s storage: %v", storageBackend, err)
 		return
 	}
+	log.Printf("storage backend: %s", storageBackend)
 
-	if !exists {
-		// 如果索引不存在，定义索引的mapping（数据结构）
-		// mapping中"user"字段类型为keyword，适合精确匹配和聚合
-		// "message"字段类型为text，适合全文搜索
-		// "location"字段类型为geo_point，支持地理位置查询
-		mapping := `{
-			"mappings": {
-				"properties": {
-					"user":     { "type": "keyword" },
-					"message":  { "type": "text"    },
-					"location": { "type": "geo_point" }
-				}
-			}
-		}`
-
-		// 使用定义好的mapping创建ES索引
-		createResp, err := client.CreateIndex(INDEX).
-			BodyString(mapping).
-			Do(context.Background())
-		if err != nil {
-			log.Fatalf("failed to create index %q: %v", INDEX, err)
-			return
-		}
-		if !createResp.Acknowledged {
-			log.Printf("warning: create index %q not acknowledged by ES", INDEX)
-		}
-	}
+	// 后台定期永久删除超过保留期的已删除帖子
+	go runTrashPurger(context.Background())
+	go runExpiryReaper(context.Background())
+	go runTokenPurger(context.Background())
+	go runChangeOutbox(context.Background())
 
 	// 启动HTTP服务并注册路由
 	fmt.Println("started-service")
@@ -629,6 +669,8 @@ func main() {
 
 	http.HandleFunc("/login", loginHandler)
 	http.HandleFunc("/signup", signupHandler)
+	http.HandleFunc("/token/refresh", handlerRefreshToken)
+	http.HandleFunc("/logout", handlerLogout)
 	// Step 1: 使用 JWT 中间件保护 /post 与 /search 与 /delete
 	http.HandleFunc("/post", jwtRequired(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -640,8 +682,25 @@ func main() {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
 	}))
+	http.HandleFunc("/post/bulk", jwtRequired(handlerBulkPost))
+	// PATCH /post/{id} 编辑帖子，GET /post/{id}/history 查看修订历史
+	http.HandleFunc("/post/", jwtRequired(handlerPostByID))
 	http.HandleFunc("/search", jwtRequired(handlerSearch))
 	http.HandleFunc("/delete", jwtRequired(handlerDeletePost))
+	http.HandleFunc("/trash", jwtRequired(handlerTrash))
+	http.HandleFunc("/trash/restore", jwtRequired(handlerRestorePost))
+	http.HandleFunc("/changes", jwtRequired(handlerChanges))
+	http.HandleFunc("/geocode", jwtRequired(handlerGeocode))
+	http.HandleFunc("/cache/stats", jwtRequired(handlerCacheStats))
+	// 以下功能依赖 ES 的 percolator 与聚合，仅 ES 后端提供
+	if esClient != nil {
+		http.HandleFunc("/searches", jwtRequired(handlerSavedSearches))
+		http.HandleFunc("/alerts", jwtRequired(handlerAlerts))
+		http.HandleFunc("/tags", jwtRequired(handlerTagFacets))
+		http.HandleFunc("/suggest", jwtRequired(handlerSuggest))
+	} else {
+		log.Printf("saved searches, alerts, /tags and /suggest require Elasticsearch; disabled for %s storage", storageBackend)
+	}
 	// 监听端口：若平台提供 PORT 环境变量则使用，否则本地默认 8080
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// 版本化索引：posts、users 对外都是别名，指向带版本号的物理索引（posts_v1、posts_v3 ...），
+// 代码中始终通过别名读写。修改 mapping 时更新 indexDefinitions 中的完整定义，并在 indexMigrations 末尾追加新版本：
+//   - 只新增字段时填写 AddFields：启动时以 PutMapping 加到当前物理索引上，不需要 reindex；
+//     已应用的版本记在索引 mapping 的 _meta.version 中（物理索引名中的版本号是它创建时的版本）
+//   - 改变已有字段（类型、分词器等）时 AddFields 留空，启动时迁移程序会：
+//     1. 用完整定义创建物理索引 <别名>_v<版本>
+//     2. 从当前索引 reindex 全部文档（version_type=external，保留文档版本号），期间旧索引照常读写
+//     3. 对旧索引加写锁，再做一次增量 reindex 补上第 2 步期间的新增/修改，并删除期间被删掉的文档
+//     4. 原子地把别名切换到新索引，之后的读写都落在新索引上；切换之后不再从旧索引复制任何文档
+//     第 3、4 步之间写请求会失败，读请求不受影响。旧索引保持写锁，作为迁移前的快照。
+//
+// 待应用的版本中只要有一个需要 reindex，就直接 reindex 到最新版本（中间的新增字段已包含在完整定义中）。
+// 全新部署直接按完整定义创建最新版本的索引。每个应用的版本都在 MIGRATIONS_INDEX 中留有记录。
+//
+// 多个实例同时启动（滚动发布）时，需要迁移的实例先在 MIGRATIONS_INDEX 中以 create 方式写入锁文档
+// lock:<别名>，写入成功的实例执行迁移，其余实例等待它完成后重新检查（通常已是最新版本）。
+// 持锁实例定期续期；它中途退出时，锁在 MIGRATION_LOCK_TTL 后到期，由下一个实例接管。
+//
+// 早期版本直接创建了名为 posts / users 的实体索引：首次迁移按同样的步骤加写锁、补齐增量，
+// 再在同一个别名操作中删除它并建立别名。
+// 旧的版本化索引保留用于回滚（回滚前需解除写锁），确认无误后可手动删除。
+
+// MIGRATIONS_INDEX 记录已应用的索引迁移
+const MIGRATIONS_INDEX = "schema_migrations"
+
+const migrationsMapping = `{
+	"mappings": {
+		"properties": {
+			"alias":       { "type": "keyword" },
+			"version":     { "type": "integer" },
+			"index":       { "type": "keyword" },
+			"from_index":  { "type": "keyword" },
+			"description": { "type": "text" },
+			"docs":        { "type": "long" },
+			"applied_at":  { "type": "date" },
+			"owner":       { "type": "keyword" },
+			"expires_at":  { "type": "date" }
+		}
+	}
+}`
+
+// indexMigration 是某个别名的一个 mapping 版本
+type indexMigration struct {
+	Alias       string
+	Version     int
+	Description string
+	// AddFields 为该版本新增字段的 properties（JSON 对象）；为空表示需要新建索引并 reindex
+	AddFields string
+}
+
+// indexDefinitions 是各别名最新版本的完整定义（settings + mappings），新建物理索引时使用
+var indexDefinitions = map[string]string{
+	USERS_INDEX: usersMapping,
+	INDEX:       postsMapping,
+}
+
+// indexMigrations 按别名、版本升序排列
+var indexMigrations = []indexMigration{
+	{Alias: USERS_INDEX, Version: 1, Description: "users keyed by username"},
+	{Alias: INDEX, Version: 1, Description: "posts with message en/cjk/suggest sub-fields, lang, tags and place fields"},
+	{Alias: INDEX, Version: 2, Description: "soft delete: deleted_at / deleted_by",
+		AddFields: `{"deleted_at": { "type": "date" }, "deleted_by": { "type": "keyword" }}`},
+	// url 之前由动态 mapping 生成（text + keyword 子字段），改为 keyword 需要 reindex
+	{Alias: INDEX, Version: 3, Description: "ephemeral posts: expires_at; url as keyword"},
+	{Alias: INDEX, Version: 4, Description: "post time: created_at",
+		AddFields: `{"created_at": { "type": "date" }}`},
+}
+
+// appliedMigration 是 MIGRATIONS_INDEX 中的一条记录
+type appliedMigration struct {
+	Alias       string    `json:"alias"`
+	Version     int       `json:"version"`
+	Index       string    `json:"index"`
+	FromIndex   string    `json:"from_index,omitempty"`
+	Description string    `json:"description"`
+	Docs        int64     `json:"docs"`
+	AppliedAt   time.Time `json:"applied_at"`
+}
+
+// migrationLock 是 MIGRATIONS_INDEX 中 ID 为 lock:<别名> 的迁移锁
+type migrationLock struct {
+	Alias     string    `json:"alias"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// migrationLockTTL 是迁移锁的有效期，持锁实例每隔三分之一有效期续期一次
+var migrationLockTTL = getenvDuration("MIGRATION_LOCK_TTL", 2*time.Minute)
+
+var versionedIndexPattern = regexp.MustCompile(`^(.+)_v(\d+)$`)
+
+// versionedIndex 返回别名某个版本对应的物理索引名
+func versionedIndex(alias string, version int) string {
+	return fmt.Sprintf("%s_v%d", alias, version)
+}
+
+// runIndexMigrations 将每个别名迁移到 indexMigrations 中的最新版本（已是最新时不做任何事）
+func runIndexMigrations(ctx context.Context, client *elastic.Client) error {
+	if err := ensureIndex(ctx, client, MIGRATIONS_INDEX, migrationsMapping); err != nil {
+		return fmt.Errorf("create index %q: %w", MIGRATIONS_INDEX, err)
+	}
+	steps := map[string][]indexMigration{}
+	var order []string
+	for _, m := range indexMigrations {
+		if _, ok := steps[m.Alias]; !ok {
+			order = append(order, m.Alias)
+		}
+		steps[m.Alias] = append(steps[m.Alias], m)
+	}
+	for _, alias := range order {
+		if err := migrateAliasLocked(ctx, client, alias, steps[alias]); err != nil {
+			latest := steps[alias][len(steps[alias])-1]
+			return fmt.Errorf("migrate %q to v%d: %w", alias, latest.Version, err)
+		}
+	}
+	return nil
+}
+
+// migrateAliasLocked 在别名需要迁移时取得迁移锁再执行 migrateAlias；
+// 已是最新版本时不加锁，等到锁的实例会在锁内重新检查（其他实例可能已完成迁移）
+func migrateAliasLocked(ctx context.Context, client *elastic.Client, alias string, steps []indexMigration) error {
+	from, version, _, err := aliasVersion(ctx, client, alias)
+	if err != nil || from != "" && version == steps[len(steps)-1].Version {
+		return err
+	}
+	ctx, release, err := acquireMigrationLock(ctx, client, alias)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return migrateAlias(ctx, client, alias, steps)
+}
+
+// acquireMigrationLock 以 create 方式写入锁文档，锁被其他实例持有时等待，到期未续的锁直接接管。
+// 返回的 ctx 在续期失败（锁已被接管）时取消，release 停止续期并删除锁。
+func acquireMigrationLock(ctx context.Context, client *elastic.Client, alias string) (context.Context, func(), error) {
+	id := "lock:" + alias
+	owner, _ := os.Hostname()
+	lock := migrationLock{Alias: alias, Owner: fmt.Sprintf("%s/%d", owner, os.Getpid())}
+	waiting := false
+	for {
+		lock.ExpiresAt = time.Now().UTC().Add(migrationLockTTL)
+		res, err := client.Index().Index(MIGRATIONS_INDEX).Id(id).OpType("create").BodyJson(lock).Refresh("true").Do(ctx)
+		if err == nil {
+			ctx, release := holdMigrationLock(ctx, client, id, lock, res.SeqNo, res.PrimaryTerm)
+			return ctx, release, nil
+		}
+		if !elastic.IsConflict(err) {
+			return nil, nil, fmt.Errorf("acquire migration lock: %w", err)
+		}
+
+		cur, err := client.Get().Index(MIGRATIONS_INDEX).Id(id).Do(ctx)
+		if elastic.IsNotFound(err) {
+			continue // 持锁实例刚刚释放
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("read migration lock: %w", err)
+		}
+		var held migrationLock
+		_ = json.Unmarshal(cur.Source, &held)
+		if time.Now().After(held.ExpiresAt) {
+			log.Printf("[migrate] %s: taking over expired lock of %s", alias, held.Owner)
+			_, err := client.Delete().Index(MIGRATIONS_INDEX).Id(id).
+				IfSeqNo(*cur.SeqNo).IfPrimaryTerm(*cur.PrimaryTerm).Refresh("true").Do(ctx)
+			if err != nil && !elastic.IsConflict(err) && !elastic.IsNotFound(err) {
+				return nil, nil, fmt.Errorf("take over migration lock: %w", err)
+			}
+			continue
+		}
+		if !waiting {
+			log.Printf("[migrate] %s: waiting for %s to finish migrating", alias, held.Owner)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(taskPollInterval):
+		}
+	}
+}
+
+// holdMigrationLock 在后台续期锁（以 seq_no 条件写入，锁被接管后续期失败并取消 ctx）
+func holdMigrationLock(ctx context.Context, client *elastic.Client, id string, lock migrationLock, seqNo, term int64) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(migrationLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			lock.ExpiresAt = time.Now().UTC().Add(migrationLockTTL)
+			res, err := client.Index().Index(MIGRATIONS_INDEX).Id(id).
+				IfSeqNo(seqNo).IfPrimaryTerm(term).BodyJson(lock).Do(ctx)
+			if err != nil {
+				log.Printf("[migrate] lost migration lock %s: %v", id, err)
+				cancel()
+				return
+			}
+			seqNo, term = res.SeqNo, res.PrimaryTerm
+		}
+	}()
+	return ctx, func() {
+		close(stop)
+		<-done
+		defer cancel()
+		if ctx.Err() != nil {
+			return // 锁已被接管
+		}
+		if _, err := client.Delete().Index(MIGRATIONS_INDEX).Id(id).
+			IfSeqNo(seqNo).IfPrimaryTerm(term).Refresh("true").Do(ctx); err != nil {
+			log.Printf("[migrate] release migration lock %s: %v", id, err)
+		}
+	}
+}
+
+// appliedVersion 返回物理索引已应用的版本：mapping 中 _meta.version（由新增字段的迁移写入），没有时取索引名中的版本号
+func appliedVersion(ctx context.Context, client *elastic.Client, index string, nameVersion int) (int, error) {
+	res, err := client.GetMapping().Index(index).Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	def, _ := res[index].(map[string]interface{})
+	mappings, _ := def["mappings"].(map[string]interface{})
+	meta, _ := mappings["_meta"].(map[string]interface{})
+	if v, ok := meta["version"].(float64); ok && int(v) > nameVersion {
+		return int(v), nil
+	}
+	return nameVersion, nil
+}
+
+// currentIndex 返回别名当前指向的物理索引及其版本。
+// legacy=true 表示存在与别名同名的实体索引（版本视为 0）；索引与别名都不存在时返回空字符串。
+func currentIndex(ctx context.Context, client *elastic.Client, alias string) (index string, version int, legacy bool, err error) {
+	res, err := client.Aliases().Alias(alias).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return "", 0, false, err
+	}
+	if err == nil {
+		indices := res.IndicesByAlias(alias)
+		switch {
+		case len(indices) > 1:
+			return "", 0, false, fmt.Errorf("alias %q points to %d indices %v", alias, len(indices), indices)
+		case len(indices) == 1:
+			m := versionedIndexPattern.FindStringSubmatch(indices[0])
+			if m == nil || m[1] != alias {
+				return "", 0, false, fmt.Errorf("alias %q points to unversioned index %q", alias, indices[0])
+			}
+			v, _ := strconv.Atoi(m[2])
+			return indices[0], v, false, nil
+		}
+	}
+	exists, err := client.IndexExists(alias).Do(ctx)
+	if err != nil || !exists {
+		return "", 0, false, err
+	}
+	return alias, 0, true, nil
+}
+
+// aliasVersion 返回别名当前的物理索引与已应用的版本（含新增字段的迁移），含义同 currentIndex
+func aliasVersion(ctx context.Context, client *elastic.Client, alias string) (index string, version int, legacy bool, err error) {
+	index, version, legacy, err = currentIndex(ctx, client, alias)
+	if err == nil && index != "" && !legacy {
+		version, err = appliedVersion(ctx, client, index, version)
+	}
+	return index, version, legacy, err
+}
+
+// migrateAlias 将别名迁移到 steps 中的最新版本；调用方需持有该别名的迁移锁
+func migrateAlias(ctx context.Context, client *elastic.Client, alias string, steps []indexMigration) error {
+	from, version, legacy, err := aliasVersion(ctx, client, alias)
+	if err != nil {
+		return err
+	}
+	latest := steps[len(steps)-1]
+	if version > latest.Version {
+		return fmt.Errorf("index %q is at v%d, newer than this build (v%d)", from, version, latest.Version)
+	}
+	if from != "" && version == latest.Version {
+		return nil
+	}
+
+	var pending []indexMigration
+	reindex := from == "" || legacy
+	for _, m := range steps {
+		if m.Version > version {
+			pending = append(pending, m)
+			reindex = reindex || m.AddFields == ""
+		}
+	}
+	if !reindex {
+		// 只新增字段：逐个版本加到当前索引上
+		for _, m := range pending {
+			log.Printf("[migrate] %s: v%d -> v%d on %s (%s)", alias, version, m.Version, from, m.Description)
+			if _, err := client.PutMapping().Index(from).
+				BodyString(fmt.Sprintf(`{"_meta": {"version": %d}, "properties": %s}`, m.Version, m.AddFields)).
+				Do(ctx); err != nil {
+				return err
+			}
+			if err := recordMigration(ctx, client, m, from, from, 0); err != nil {
+				return err
+			}
+			version = m.Version
+		}
+		log.Printf("[migrate] %s: now at v%d (%s)", alias, version, from)
+		return nil
+	}
+
+	to := versionedIndex(alias, latest.Version)
+	log.Printf("[migrate] %s: %s -> %s (%s)", alias, orNone(from), to, latest.Description)
+
+	// 持锁期间不会有其他实例创建目标索引：已存在且未挂上别名的，只可能是上次迁移中断留下的，删除后重建
+	if exists, err := client.IndexExists(to).Do(ctx); err != nil {
+		return err
+	} else if exists {
+		log.Printf("[migrate] %s: removing leftover index %s from an interrupted run", alias, to)
+		if _, err := client.DeleteIndex(to).Do(ctx); err != nil {
+			return err
+		}
+	}
+	if _, err := client.CreateIndex(to).BodyString(indexDefinitions[alias]).Do(ctx); err != nil {
+		return err
+	}
+
+	var docs int64
+	if from != "" {
+		if docs, err = reindexInto(ctx, client, from, to); err != nil {
+			return err
+		}
+		log.Printf("[migrate] %s: copied %d doc(s) from %s", alias, docs, from)
+
+		// 加写锁后旧索引不再变化：补齐首次复制期间的新增/修改与删除，之后才切换别名
+		if err := setWriteBlock(ctx, client, from, true); err != nil {
+			return err
+		}
+		n, err := reindexInto(ctx, client, from, to)
+		var removed int64
+		if err == nil {
+			removed, err = pruneDeleted(ctx, client, from, to)
+		}
+		if err != nil {
+			_ = setWriteBlock(ctx, client, from, false)
+			return err
+		}
+		log.Printf("[migrate] %s: caught up %d doc(s), removed %d deleted during the copy", alias, n, removed)
+		docs += n
+	}
+
+	swap := client.Alias().Add(to, alias)
+	switch {
+	case legacy:
+		// 实体索引无法与别名同名：在同一原子操作中删除它并建立别名
+		swap = swap.Action(elastic.NewAliasRemoveIndexAction(from))
+	case from != "":
+		swap = swap.Remove(from, alias)
+	}
+	if _, err := swap.Do(ctx); err != nil {
+		if from != "" {
+			_ = setWriteBlock(ctx, client, from, false)
+		}
+		return err
+	}
+
+	// 全新部署只记录最新版本；升级时记录跳过的每个版本（中间版本的修改已包含在完整定义中）
+	if from == "" {
+		pending = pending[len(pending)-1:]
+	}
+	for _, m := range pending {
+		if err := recordMigration(ctx, client, m, to, from, docs); err != nil {
+			return err
+		}
+	}
+	log.Printf("[migrate] %s: now at v%d (%s)", alias, latest.Version, to)
+	return nil
+}
+
+// recordMigration 在 MIGRATIONS_INDEX 中记录已应用的版本
+func recordMigration(ctx context.Context, client *elastic.Client, m indexMigration, index, from string, docs int64) error {
+	_, err := client.Index().
+		Index(MIGRATIONS_INDEX).
+		Id(fmt.Sprintf("%s:%d", m.Alias, m.Version)).
+		BodyJson(appliedMigration{
+			Alias:       m.Alias,
+			Version:     m.Version,
+			Index:       index,
+			FromIndex:   from,
+			Description: m.Description,
+			Docs:        docs,
+			AppliedAt:   time.Now().UTC(),
+		}).
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		return fmt.Errorf("record migration: %w", err)
+	}
+	return nil
+}
+
+// reindexInto 复制 from 中的文档到 to：保留外部版本号，目标中已有相同或更新版本的文档会被跳过，
+// 因此可重复执行以补齐增量。大索引的 reindex 可能超过单个请求的超时，这里异步提交后轮询任务状态。
+// 返回新建与更新的文档数。
+func reindexInto(ctx context.Context, client *elastic.Client, from, to string) (int64, error) {
+	task, err := client.Reindex().
+		SourceIndex(from).
+		Destination(elastic.NewReindexDestination().Index(to).VersionType("external")).
+		Conflicts("proceed").
+		Refresh("true").
+		DoAsync(ctx)
+	if err != nil {
+		return 0, err
+	}
+	created, updated, err := waitForTask(ctx, client, task.TaskId)
+	if err != nil {
+		return 0, fmt.Errorf("reindex %s -> %s: %w", from, to, err)
+	}
+	return created + updated, nil
+}
+
+// pruneDeleted 删除 to 中已不在 from 里的文档（首次复制之后在 from 中删除的），返回删除数；from 须已加写锁。
+// 补齐增量后 to 包含 from 的全部文档，两边数量相同时无需逐个比对。
+func pruneDeleted(ctx context.Context, client *elastic.Client, from, to string) (int64, error) {
+	nFrom, err := client.Count(from).Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	nTo, err := client.Count(to).Do(ctx)
+	if err != nil || nTo <= nFrom {
+		return 0, err
+	}
+
+	var removed int64
+	scroll := client.Scroll(to).Sort("_doc", true).Size(1000).FetchSource(false)
+	defer scroll.Clear(context.Background())
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return removed, nil
+		}
+		if err != nil {
+			return removed, err
+		}
+		ids := make([]string, 0, len(res.Hits.Hits))
+		for _, hit := range res.Hits.Hits {
+			ids = append(ids, hit.Id)
+		}
+		found, err := client.Search(from).Query(elastic.NewIdsQuery().Ids(ids...)).
+			FetchSource(false).Size(len(ids)).Do(ctx)
+		if err != nil {
+			return removed, err
+		}
+		exists := make(map[string]bool, len(found.Hits.Hits))
+		for _, hit := range found.Hits.Hits {
+			exists[hit.Id] = true
+		}
+		bulk := client.Bulk().Index(to).Refresh("true")
+		for _, id := range ids {
+			if !exists[id] {
+				bulk.Add(elastic.NewBulkDeleteRequest().Id(id))
+			}
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		br, err := bulk.Do(ctx)
+		if err != nil {
+			return removed, err
+		}
+		for _, item := range br.Failed() {
+			if item.Status != http.StatusNotFound && item.Error != nil {
+				return removed, fmt.Errorf("delete %s from %s: %s", item.Id, to, item.Error.Reason)
+			}
+		}
+		removed += int64(len(br.Deleted()))
+	}
+}
+
+// setWriteBlock 开启或关闭索引的写锁（index.blocks.write）
+func setWriteBlock(ctx context.Context, client *elastic.Client, index string, on bool) error {
+	_, err := client.IndexPutSettings(index).
+		BodyJson(map[string]interface{}{"index.blocks.write": on}).
+		Do(ctx)
+	return err
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
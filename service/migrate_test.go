@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reindexResponses 是 posts_v1 → posts_v2 迁移用到的 ES 响应；posts_v2 比 posts_v1 多出的 d 是复制期间被删除的文档
+func reindexResponses() map[string]string {
+	scrollPage := `{"_scroll_id": "s1", "hits": {"total": {"value": 4, "relation": "eq"}, "hits": [
+		{"_id": "a"}, {"_id": "b"}, {"_id": "c"}, {"_id": "d"}]}}`
+	return map[string]string{
+		"GET /_alias/posts":                   `{"posts_v1": {"aliases": {"posts": {}}}}`,
+		"GET /posts_v1/_mapping/_all":         `{"posts_v1": {"mappings": {}}}`,
+		"PUT /posts_v2":                       `{"acknowledged": true}`,
+		"POST /_reindex":                      `{"task": "node:1"}`,
+		"GET /_tasks/node:1":                  `{"completed": true, "task": {"status": {"created": 3}}}`,
+		"PUT /posts_v1/_settings":             `{"acknowledged": true}`,
+		"POST /posts_v1/_count":               `{"count": 3}`,
+		"POST /posts_v2/_count":               `{"count": 4}`,
+		"POST /posts_v2/_search":              scrollPage,
+		"POST /_search/scroll":                `{"_scroll_id": "s1", "hits": {"hits": []}}`,
+		"DELETE /_search/scroll":              `{"succeeded": true}`,
+		"POST /posts_v1/_search":              searchHits([]string{"a", "b", "c"}, nil),
+		"POST /posts_v2/_bulk":                `{"items": [{"delete": {"_id": "d", "status": 200, "result": "deleted"}}]}`,
+		"POST /_aliases":                      `{"acknowledged": true}`,
+		"PUT /schema_migrations/_doc/posts:2": `{"result": "created"}`,
+	}
+}
+
+var reindexSteps = []indexMigration{{Alias: INDEX, Version: 1}, {Alias: INDEX, Version: 2, Description: "test"}}
+
+// requestOrder 返回各个 "方法 路径" 请求依次出现的位置
+func (f *fakeES) requestOrder() map[string][]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	order := map[string][]int{}
+	for i, r := range f.requests {
+		parts := strings.SplitN(r, " ", 3)
+		key := parts[0] + " " + parts[1]
+		order[key] = append(order[key], i)
+	}
+	return order
+}
+
+// 增量补齐与删除都在旧索引加写锁之后、切换别名之前完成，切换之后不再复制
+func TestMigrateAliasCatchesUpBeforeSwap(t *testing.T) {
+	es := useFakeES(t, reindexResponses())
+	if err := migrateAlias(context.Background(), esClient, INDEX, reindexSteps); err != nil {
+		t.Fatal(err)
+	}
+
+	order := es.requestOrder()
+	reindex, block, prune, swap := order["POST /_reindex"], order["PUT /posts_v1/_settings"], order["POST /posts_v2/_bulk"], order["POST /_aliases"]
+	if len(reindex) != 2 || len(block) != 1 || len(prune) != 1 || len(swap) != 1 {
+		t.Fatalf("requests: reindex %v, write block %v, prune %v, swap %v", reindex, block, prune, swap)
+	}
+	if !(reindex[0] < block[0] && block[0] < reindex[1] && reindex[1] < prune[0] && prune[0] < swap[0]) {
+		t.Errorf("wrong order: reindex %v, write block %v, prune %v, swap %v", reindex, block, prune, swap)
+	}
+	if settings := es.sent("PUT /posts_v1/_settings"); !strings.Contains(settings[0], `"index.blocks.write":true`) {
+		t.Errorf("settings = %v, want a write block", settings)
+	}
+	bulk := es.sent("POST /posts_v2/_bulk")[0]
+	if !strings.Contains(bulk, `"_id":"d"`) || strings.Count(bulk, `"delete"`) != 1 {
+		t.Errorf("prune bulk = %s, want only d deleted", bulk)
+	}
+	aliases := es.sent("POST /_aliases")[0]
+	for _, want := range []string{`{"remove":{"alias":"posts","index":"posts_v1"}}`, `{"add":{"alias":"posts","index":"posts_v2"}}`} {
+		if !strings.Contains(aliases, want) {
+			t.Errorf("alias actions %s do not contain %s", aliases, want)
+		}
+	}
+}
+
+func TestMigrateAliasUnblocksOnFailedSwap(t *testing.T) {
+	responses := reindexResponses()
+	delete(responses, "POST /_aliases")
+	es := useFakeES(t, responses)
+	if err := migrateAlias(context.Background(), esClient, INDEX, reindexSteps); err == nil {
+		t.Fatal("migration succeeded without an alias swap")
+	}
+	settings := es.sent("PUT /posts_v1/_settings")
+	if len(settings) != 2 || !strings.Contains(settings[1], `"index.blocks.write":false`) {
+		t.Errorf("settings = %v, want the write block lifted", settings)
+	}
+}
+
+func TestMigrationLock(t *testing.T) {
+	var mu sync.Mutex
+	lock := `{"alias": "posts", "owner": "crashed/1", "expires_at": "2026-01-01T00:00:00Z"}` // 已到期
+	current := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return lock
+	}
+	es := useFakeES(t, nil)
+	es.handle = func(r *http.Request, body string) (int, string, bool) {
+		if r.URL.Path != "/schema_migrations/_doc/lock:posts" {
+			return 0, "", false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			if lock != "" && r.URL.Query().Get("op_type") == "create" {
+				return http.StatusConflict, `{"error": {"type": "version_conflict_engine_exception"}, "status": 409}`, true
+			}
+			lock = body
+			return http.StatusCreated, `{"_seq_no": 1, "_primary_term": 1, "result": "created"}`, true
+		case http.MethodGet:
+			if lock == "" {
+				return http.StatusNotFound, `{"found": false}`, true
+			}
+			return http.StatusOK, `{"found": true, "_seq_no": 0, "_primary_term": 1, "_source": ` + lock + `}`, true
+		case http.MethodDelete:
+			lock = ""
+			return http.StatusOK, `{"result": "deleted"}`, true
+		}
+		return 0, "", false
+	}
+
+	// 到期的锁被接管
+	ctx, release, err := acquireMigrationLock(context.Background(), esClient, INDEX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held := current(); strings.Contains(held, "crashed/1") || !strings.Contains(held, `"alias":"posts"`) {
+		t.Fatalf("lock after takeover = %s", held)
+	}
+
+	// 有效的锁：其他实例等待
+	wctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := acquireMigrationLock(wctx, esClient, INDEX); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire while held: err = %v, want a timeout", err)
+	}
+
+	release()
+	if held := current(); held != "" {
+		t.Errorf("lock not released: %s", held)
+	}
+}
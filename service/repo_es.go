@@ -0,0 +1,869 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// esClient 是 ES 后端下启动时创建的客户端；sqlite / memory 后端下为 nil（依赖 ES 的功能随之关闭）
+var esClient *elastic.Client
+
+// usersMapping 是 users 索引最新版本的完整 mapping（修改时需在 indexMigrations 中追加新版本）
+const usersMapping = `{
+	"mappings": {
+		"properties": {
+			"username": { "type": "keyword" },
+			"password": { "type": "keyword" },
+			"age":      { "type": "integer" },
+			"gender":   { "type": "keyword" }
+		}
+	}
+}`
+
+// postsMapping 是 posts 索引最新版本的完整 mapping（修改时需在 indexMigrations 中追加新版本）：
+// user 为 keyword，适合精确匹配和聚合；message 为 text，适合全文搜索；
+// location 为 geo_point，支持地理位置查询；deleted_at / deleted_by 记录软删除；
+// expires_at 为限时帖子的到期时间；url 为 keyword，供清理图片前检查是否仍被引用
+const postsMapping = `{
+	"mappings": {
+		"properties": {
+			"user":     { "type": "keyword" },
+			"message":  ` + messageFieldMapping + `,
+			"lang":     { "type": "keyword" },
+			"location": { "type": "geo_point" },
+			"tags":     { "type": "keyword" },
+			"city":     { "type": "keyword" },
+			"region":   { "type": "keyword" },
+			"country":  { "type": "keyword" },
+			"deleted_at": { "type": "date" },
+			"deleted_by": { "type": "keyword" },
+			"expires_at": { "type": "date" },
+			"url":        { "type": "keyword" },
+			"created_at": { "type": "date" }
+		}
+	}
+}`
+
+// initElasticsearch 创建共享客户端、执行索引迁移并确保其余索引存在，
+// 然后在后台启动旧帖子的数据补齐
+func initElasticsearch(ctx context.Context) (*elastic.Client, error) {
+	// 创建全程共享的ES客户端（节点、超时、重试与健康检查见 es.go）
+	client, err := newESClient(esConfigFromEnv())
+	if err != nil {
+		return nil, fmt.Errorf("create ES client: %w", err)
+	}
+
+	// posts / users 为别名，按 indexMigrations 创建或迁移到最新版本的物理索引
+	if err := runIndexMigrations(ctx, client); err != nil {
+		return nil, err
+	}
+
+	// 保存的搜索（percolator）、提醒、修订历史、变更流与令牌索引
+	for name, m := range map[string]string{
+		SEARCHES_INDEX: searchesMapping, ALERTS_INDEX: alertsMapping, REVISIONS_INDEX: revisionsMapping,
+		CHANGES_INDEX: changesMapping, CHANGES_SEQ_INDEX: changesSeqMapping,
+		REFRESH_TOKENS_INDEX: refreshTokensMapping, REVOKED_TOKENS_INDEX: revokedTokensMapping,
+	} {
+		if err := ensureIndex(ctx, client, name, m); err != nil {
+			return nil, fmt.Errorf("create index %q: %w", name, err)
+		}
+	}
+	// percolator 索引的 message 字段需与 posts 一致（旧索引补充子字段）
+	if _, err := client.PutMapping().Index(SEARCHES_INDEX).
+		BodyString(`{"properties": {"message": ` + messageFieldMapping + `}}`).
+		Do(ctx); err != nil {
+		return nil, fmt.Errorf("update mapping of index %q: %w", SEARCHES_INDEX, err)
+	}
+
+	// 后台为旧帖子补充 lang 字段（同时重建 message 子字段），再补齐仍缺少 message.suggest 的帖子；不阻塞启动
+	go func() {
+		if err := backfillPostLanguages(context.Background(), client); err != nil {
+			log.Printf("[migrate] lang backfill failed: %v", err)
+		}
+		if err := backfillMessageSuggest(context.Background(), client); err != nil {
+			log.Printf("[migrate] message.suggest backfill failed: %v", err)
+		}
+	}()
+	return client, nil
+}
+
+// esPostRepository 将帖子存放在 posts 索引中
+type esPostRepository struct {
+	client *elastic.Client
+}
+
+func (r *esPostRepository) Save(ctx context.Context, id string, p *Post) error {
+	// 写入索引（指定index与id，body为帖子内容）
+	_, err := r.client.Index().
+		Index(INDEX).
+		Id(id).
+		BodyJson(p).
+		Refresh("true"). // 立即可见，便于测试；生产可去掉或用"wait_for"
+		Do(ctx)
+	return err
+}
+
+// SaveIf 以 if_seq_no / if_primary_term 条件写入，ES 返回 409 时视为版本冲突
+func (r *esPostRepository) SaveIf(ctx context.Context, id string, p *Post, ver PostVersion) (PostVersion, error) {
+	res, err := r.client.Index().
+		Index(INDEX).
+		Id(id).
+		BodyJson(p).
+		IfSeqNo(ver.SeqNo).
+		IfPrimaryTerm(ver.PrimaryTerm).
+		Refresh("true").
+		Do(ctx)
+	if elastic.IsConflict(err) {
+		return PostVersion{}, ErrVersionConflict
+	}
+	if err != nil {
+		return PostVersion{}, err
+	}
+	return PostVersion{SeqNo: res.SeqNo, PrimaryTerm: res.PrimaryTerm}, nil
+}
+
+// 批量写入的分批参数：每批最多 bulkActions 条或 bulkSize 字节，由 bulkWorkers 个并发请求发送
+const (
+	bulkActions = 1000
+	bulkSize    = 5 << 20
+	bulkWorkers = 2
+)
+
+// SaveBatch 通过 bulk processor 分批写入，各批不单独刷新，全部完成后对索引统一刷新一次
+func (r *esPostRepository) SaveBatch(ctx context.Context, posts []PostWithID) []SaveResult {
+	// 先假定全部失败，再按 bulk 响应逐条回填；整批请求出错（已由 processor 重试）时保留该错误
+	var mu sync.Mutex
+	result := make(map[string]SaveResult, len(posts))
+	for _, p := range posts {
+		result[p.ID] = SaveResult{Err: errors.New("no response from Elasticsearch bulk request")}
+	}
+	proc, err := r.client.BulkProcessor().
+		Name("bulk-posts").
+		Workers(bulkWorkers).
+		BulkActions(bulkActions).
+		BulkSize(bulkSize).
+		After(func(_ int64, _ []elastic.BulkableRequest, res *elastic.BulkResponse, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if res == nil {
+				if err != nil {
+					log.Printf("bulk request failed: %v", err)
+				}
+				return
+			}
+			for _, item := range res.Indexed() {
+				switch {
+				case item.Error != nil:
+					result[item.Id] = SaveResult{Err: fmt.Errorf("%s: %s", item.Error.Type, item.Error.Reason)}
+				case item.Status >= 200 && item.Status < 300:
+					result[item.Id] = SaveResult{Replaced: item.Result == "updated"}
+				default:
+					result[item.Id] = SaveResult{Err: fmt.Errorf("status %d", item.Status)}
+				}
+			}
+		}).
+		Do(ctx)
+	if err != nil {
+		results := make([]SaveResult, len(posts))
+		for i := range results {
+			results[i] = SaveResult{Err: err}
+		}
+		return results
+	}
+	for i := range posts {
+		proc.Add(elastic.NewBulkIndexRequest().Index(INDEX).Id(posts[i].ID).Doc(posts[i].Post))
+	}
+	// Close 会发送剩余的请求并等待所有 worker 完成
+	if err := proc.Close(); err != nil {
+		log.Printf("close bulk processor: %v", err)
+	}
+	if _, err := r.client.Refresh(INDEX).Do(ctx); err != nil {
+		log.Printf("refresh %s after bulk: %v", INDEX, err)
+	}
+
+	results := make([]SaveResult, len(posts))
+	for i, p := range posts {
+		results[i] = result[p.ID]
+	}
+	return results
+}
+
+func (r *esPostRepository) Get(ctx context.Context, id string) (*Post, error) {
+	p, _, err := r.GetVersioned(ctx, id)
+	return p, err
+}
+
+func (r *esPostRepository) GetVersioned(ctx context.Context, id string) (*Post, PostVersion, error) {
+	res, err := r.client.Get().Index(INDEX).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) || (err == nil && !res.Found) {
+		return nil, PostVersion{}, ErrPostNotFound
+	}
+	if err != nil {
+		return nil, PostVersion{}, err
+	}
+	var p Post
+	if err := json.Unmarshal(res.Source, &p); err != nil {
+		return nil, PostVersion{}, fmt.Errorf("decode post %s: %w", id, err)
+	}
+	var ver PostVersion
+	if res.SeqNo != nil && res.PrimaryTerm != nil {
+		ver = PostVersion{SeqNo: *res.SeqNo, PrimaryTerm: *res.PrimaryTerm}
+	}
+	return &p, ver, nil
+}
+
+func (r *esPostRepository) Delete(ctx context.Context, id string) error {
+	_, err := r.client.Delete().Index(INDEX).Id(id).Refresh("true").Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrPostNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return r.deleteRevisions(ctx, []string{id})
+}
+
+func (r *esPostRepository) AddRevision(ctx context.Context, rev PostRevision) error {
+	_, err := r.client.Index().
+		Index(REVISIONS_INDEX).
+		Id(revisionID(rev.PostID, rev.Revision)).
+		BodyJson(rev).
+		Refresh("true").
+		Do(ctx)
+	return err
+}
+
+// maxRevisions 是读取修订历史的上限
+const maxRevisions = 1000
+
+func (r *esPostRepository) ListRevisions(ctx context.Context, postID string) ([]PostRevision, error) {
+	res, err := r.client.Search().
+		Index(REVISIONS_INDEX).
+		Query(elastic.NewTermQuery("post_id", postID)).
+		Sort("revision", true).
+		Size(maxRevisions).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []PostRevision
+	for _, hit := range res.Hits.Hits {
+		var rev PostRevision
+		if err := json.Unmarshal(hit.Source, &rev); err != nil {
+			return nil, fmt.Errorf("decode revision %s: %w", hit.Id, err)
+		}
+		out = append(out, rev)
+	}
+	return out, nil
+}
+
+// revisionURLs 返回各帖子修订历史中引用的图片地址（帖子 ID -> 地址，每批最多 1000 个帖子）
+func (r *esPostRepository) revisionURLs(ctx context.Context, postIDs []string) (map[string][]string, error) {
+	out := map[string][]string{}
+	for start := 0; start < len(postIDs); start += 1000 {
+		end := start + 1000
+		if end > len(postIDs) {
+			end = len(postIDs)
+		}
+		ids := make([]interface{}, 0, end-start)
+		for _, id := range postIDs[start:end] {
+			ids = append(ids, id)
+		}
+		if err := r.scanRevisions(ctx, elastic.NewTermsQuery("post_id", ids...), func(rev PostRevision) {
+			if rev.Url != "" {
+				out[rev.PostID] = append(out[rev.PostID], rev.Url)
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// scanRevisions 遍历满足 q 的修订记录（只读取 post_id 与 url）
+func (r *esPostRepository) scanRevisions(ctx context.Context, q elastic.Query, fn func(PostRevision)) error {
+	scroll := r.client.Scroll(REVISIONS_INDEX).
+		Query(q).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("post_id", "url")).
+		Size(1000)
+	defer scroll.Clear(context.Background())
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, hit := range res.Hits.Hits {
+			var rev PostRevision
+			if err := json.Unmarshal(hit.Source, &rev); err != nil {
+				return fmt.Errorf("decode revision %s: %w", hit.Id, err)
+			}
+			fn(rev)
+		}
+	}
+}
+
+// deleteRevisions 删除帖子的修订历史（每批最多 1000 个帖子）
+func (r *esPostRepository) deleteRevisions(ctx context.Context, postIDs []string) error {
+	for start := 0; start < len(postIDs); start += 1000 {
+		end := start + 1000
+		if end > len(postIDs) {
+			end = len(postIDs)
+		}
+		ids := make([]interface{}, 0, end-start)
+		for _, id := range postIDs[start:end] {
+			ids = append(ids, id)
+		}
+		if _, err := r.client.DeleteByQuery(REVISIONS_INDEX).
+			Query(elastic.NewTermsQuery("post_id", ids...)).
+			Conflicts("proceed").
+			Do(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *esPostRepository) Search(ctx context.Context, p SearchParams) ([]PostWithID, int64, error) {
+	q, sorter := p.esQuery()
+
+	// 执行搜索请求（在指定索引中执行查询）
+	search := r.client.Search().
+		Index(INDEX).
+		Query(q).
+		From(p.Offset).
+		Size(p.Limit).
+		TrackTotalHits(true).
+		Pretty(true)
+	// 与其他后端相同的顺序：nearest 先按距离，其余按发帖时间最新在前（ES 的日期精度为毫秒）
+	if sorter != nil {
+		search = search.SortBy(sorter)
+	}
+	search = search.SortBy(elastic.NewFieldSort("created_at").Desc().Missing("_last").UnmappedType("date"))
+	res, err := search.Do(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fmt.Printf("Query took %d ms, total hits %d\n", res.TookInMillis, res.TotalHits())
+
+	var out []PostWithID
+	// 遍历搜索结果，带上每条文档的 ES ID
+	for _, hit := range res.Hits.Hits {
+		var post Post
+		if err := json.Unmarshal(hit.Source, &post); err == nil {
+			out = append(out, PostWithID{
+				ID:             hit.Id,
+				Post:           post,
+				DistanceMeters: sortDistance(hit, sorter),
+			})
+		}
+	}
+	return out, res.TotalHits(), nil
+}
+
+func (r *esPostRepository) Scan(ctx context.Context, fn func(PostWithID) error) error {
+	// 按 _doc 排序的 scroll 是遍历整个索引最省资源的方式
+	scroll := r.client.Scroll(INDEX).Sort("_doc", true).Size(1000)
+	defer scroll.Clear(context.Background())
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, hit := range res.Hits.Hits {
+			out := PostWithID{ID: hit.Id}
+			if err := json.Unmarshal(hit.Source, &out.Post); err != nil {
+				return fmt.Errorf("decode post %s: %w", hit.Id, err)
+			}
+			if err := fn(out); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *esPostRepository) ListDeleted(ctx context.Context, user string, limit, offset int) ([]PostWithID, int64, error) {
+	q := elastic.NewBoolQuery().Filter(elastic.NewExistsQuery("deleted_at"))
+	if user != "" {
+		q = q.Filter(elastic.NewTermQuery("user", user))
+	}
+	res, err := r.client.Search().
+		Index(INDEX).
+		Query(q).
+		Sort("deleted_at", false).
+		From(offset).
+		Size(limit).
+		TrackTotalHits(true).
+		Do(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var out []PostWithID
+	for _, hit := range res.Hits.Hits {
+		p := PostWithID{ID: hit.Id}
+		if err := json.Unmarshal(hit.Source, &p.Post); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out, res.TotalHits(), nil
+}
+
+func (r *esPostRepository) PurgeDeleted(ctx context.Context, before time.Time) ([]PurgedPost, error) {
+	q := elastic.NewRangeQuery("deleted_at").Lt(before.UTC().Format(time.RFC3339Nano))
+	// 先记下要清除的帖子及其修订历史中的图片，删除帖子后再删除它们的修订历史
+	var (
+		posts []PurgedPost
+		ids   []string
+	)
+	scroll := r.client.Scroll(INDEX).Query(q).Size(1000)
+	defer scroll.Clear(context.Background())
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range res.Hits.Hits {
+			p := PurgedPost{PostWithID: PostWithID{ID: hit.Id}}
+			if err := json.Unmarshal(hit.Source, &p.Post); err != nil {
+				return nil, fmt.Errorf("decode post %s: %w", hit.Id, err)
+			}
+			posts = append(posts, p)
+			ids = append(ids, hit.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	urls, err := r.revisionURLs(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("read revisions: %w", err)
+	}
+	for i := range posts {
+		posts[i].RevisionURLs = urls[posts[i].ID]
+	}
+	// 限定为扫描到的 ID，避免删除扫描之后才过期的帖子（它们不在返回的列表中）
+	if _, err := r.client.DeleteByQuery(INDEX).
+		Query(elastic.NewBoolQuery().Filter(q, elastic.NewIdsQuery().Ids(ids...))).
+		Conflicts("proceed").
+		Refresh("true").
+		Do(ctx); err != nil {
+		return nil, err
+	}
+	if err := r.deleteRevisions(ctx, ids); err != nil {
+		return posts, fmt.Errorf("delete revisions: %w", err)
+	}
+	return posts, nil
+}
+
+func (r *esPostRepository) ListExpired(ctx context.Context, now time.Time, limit int) ([]PostWithID, error) {
+	res, err := r.client.Search().
+		Index(INDEX).
+		Query(elastic.NewBoolQuery().
+			Filter(elastic.NewRangeQuery("expires_at").Lte(now.UTC().Format(time.RFC3339Nano))).
+			MustNot(elastic.NewExistsQuery("deleted_at"))).
+		Sort("expires_at", true).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]PostWithID, 0, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		p := PostWithID{ID: hit.Id}
+		if err := json.Unmarshal(hit.Source, &p.Post); err != nil {
+			return nil, fmt.Errorf("decode post %s: %w", hit.Id, err)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func (r *esPostRepository) URLInUse(ctx context.Context, url string) (bool, error) {
+	n, err := r.client.Count(INDEX).Query(elastic.NewTermQuery("url", url)).Do(ctx)
+	if err != nil || n > 0 {
+		return n > 0, err
+	}
+	// 修订历史的 url 不建索引（index: false），只能用脚本读取 doc_values；只在清理图片时调用，可以接受逐条比较
+	n, err = r.client.Count(REVISIONS_INDEX).
+		Query(elastic.NewScriptQuery(elastic.NewScript(
+			"doc['url'].size() > 0 && doc['url'].value == params.url").Param("url", url))).
+		Do(ctx)
+	return n > 0, err
+}
+
+// esChangeLog 是 ChangeLog 的 ES 实现：序号由 CHANGES_SEQ_INDEX 中的计数文档原子分配（多实例共享），
+// 事件以序号为文档 ID、以 op_type=create 写入 CHANGES_INDEX。
+//
+// 分配序号与写入事件是两步，并发时较小的序号可能比较大的序号晚写入，读到的序号空缺不一定是丢失。
+// 空缺只有在确认不会再被写入时才跳过：每个序号文档只能被创建一次，写入方与读取方以此决定空缺的归属。
+//   - 写入失败的序号由 Append 写入占位事件（tombstone），读取时跳过
+//   - 空缺之后的事件已产生超过 changeClaimDelay 时，Since 自己为空缺写入占位事件（进程在两步之间退出的情况）；
+//     若事件其实只是写得慢，它的写入会因文档已存在而失败，Append 随后重新分配序号写入，事件不会丢失
+type esChangeLog struct {
+	client *elastic.Client
+}
+
+// changeTombstone 是占位事件的类型，只存在于 CHANGES_INDEX 中，不会出现在 /changes 的响应里
+const changeTombstone = "tombstone"
+
+// changeClaimDelay：空缺之后的事件产生超过这段时间后，读取方才为空缺写入占位事件；
+// 它只影响等待多久，不影响正确性
+const changeClaimDelay = 5 * time.Second
+
+// maxChangeAppendAttempts：序号被读取方占用后重新分配的次数上限
+const maxChangeAppendAttempts = 3
+
+// allocateSeq 原子地分配 n 个连续序号，返回第一个
+func (l *esChangeLog) allocateSeq(ctx context.Context, n int) (int64, error) {
+	res, err := l.client.Update().
+		Index(CHANGES_SEQ_INDEX).
+		Id("seq").
+		Script(elastic.NewScript("ctx._source.value += params.n").Param("n", n)).
+		Upsert(map[string]interface{}{"value": n}).
+		RetryOnConflict(10).
+		FetchSource(true).
+		Do(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("allocate change sequence: %w", err)
+	}
+	var counter struct {
+		Value int64 `json:"value"`
+	}
+	if res.GetResult == nil || json.Unmarshal(res.GetResult.Source, &counter) != nil {
+		return 0, errors.New("allocate change sequence: counter not returned")
+	}
+	return counter.Value - int64(n) + 1, nil
+}
+
+// writeTombstones 为 seqs 写入占位事件；序号上已有事件（或占位事件）时保留原文档
+func (l *esChangeLog) writeTombstones(ctx context.Context, seqs []int64) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	bulk := l.client.Bulk().Index(CHANGES_INDEX).Refresh("true")
+	for _, seq := range seqs {
+		bulk.Add(elastic.NewBulkIndexRequest().OpType("create").Id(strconv.FormatInt(seq, 10)).
+			Doc(ChangeEvent{Seq: seq, Type: changeTombstone, At: now}))
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range res.Failed() {
+		if item.Status != http.StatusConflict {
+			return fmt.Errorf("write tombstone %s: status %d", item.Id, item.Status)
+		}
+	}
+	return nil
+}
+
+func (l *esChangeLog) Append(ctx context.Context, events []ChangeEvent) error {
+	pending := make([]int, len(events)) // 尚未写入的事件下标
+	for i := range pending {
+		pending[i] = i
+	}
+	var failed []*elastic.BulkResponseItem
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt == maxChangeAppendAttempts {
+			return fmt.Errorf("%d change event(s) not written: sequence numbers claimed by readers %d times", len(pending), attempt)
+		}
+		first, err := l.allocateSeq(ctx, len(pending))
+		if err != nil {
+			return err
+		}
+		seqs := make([]int64, len(pending))
+		bulk := l.client.Bulk().Index(CHANGES_INDEX).Refresh("true")
+		for i, idx := range pending {
+			seqs[i] = first + int64(i)
+			events[idx].Seq = seqs[i]
+			bulk.Add(elastic.NewBulkIndexRequest().OpType("create").Id(strconv.FormatInt(seqs[i], 10)).Doc(events[idx]))
+		}
+		res, err := bulk.Do(ctx)
+		if err != nil {
+			// 不确定哪些写入了：逐个占位，已写入的序号会保留原事件
+			l.tombstone(seqs)
+			return err
+		}
+		var retry []int
+		var lost []int64
+		for i, item := range res.Items {
+			for _, r := range item {
+				switch {
+				case r.Status == http.StatusConflict:
+					retry = append(retry, pending[i]) // 序号已被读取方占位，换一个序号重写
+				case r.Status >= 300:
+					failed = append(failed, r)
+					lost = append(lost, seqs[i])
+				}
+			}
+		}
+		l.tombstone(lost)
+		pending = retry
+	}
+	if len(failed) > 0 {
+		reason := ""
+		if failed[0].Error != nil {
+			reason = failed[0].Error.Reason
+		}
+		return fmt.Errorf("%d change event(s) not written: %s", len(failed), reason)
+	}
+	return nil
+}
+
+// tombstone 为写入失败的序号占位，使读取方不必等待；请求的 ctx 可能已取消，因此使用独立的超时。
+// 占位也失败时，读取方会在 changeClaimDelay 之后自行占位
+func (l *esChangeLog) tombstone(seqs []int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := l.writeTombstones(ctx, seqs); err != nil {
+		log.Printf("[changes] tombstone for %d sequence number(s) failed: %v", len(seqs), err)
+	}
+}
+
+// Since 跳过占位事件；遇到空缺时停在空缺之前，直到空缺被写入事件或占位
+func (l *esChangeLog) Since(ctx context.Context, cursor int64, limit int) ([]ChangeEvent, error) {
+	var out []ChangeEvent
+	next := cursor + 1
+	claimed := false
+	for len(out) < limit {
+		res, err := l.client.Search().
+			Index(CHANGES_INDEX).
+			Query(elastic.NewRangeQuery("seq").Gte(next)).
+			Sort("seq", true).
+			Size(limit).
+			Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		hits := res.Hits.Hits
+		if len(hits) == 0 {
+			break
+		}
+		rescan := false
+		for _, hit := range hits {
+			var e ChangeEvent
+			if err := json.Unmarshal(hit.Source, &e); err != nil {
+				return nil, fmt.Errorf("decode change %s: %w", hit.Id, err)
+			}
+			if e.Seq != next {
+				if claimed || time.Since(e.At) < changeClaimDelay {
+					return out, nil
+				}
+				// 空缺已久：占位后重新读取；占位失败（409）说明事件恰好写入了，重新读取时会读到它
+				var gap []int64
+				for seq := next; seq < e.Seq; seq++ {
+					gap = append(gap, seq)
+				}
+				if err := l.writeTombstones(ctx, gap); err != nil {
+					return nil, fmt.Errorf("claim change sequence gap: %w", err)
+				}
+				claimed, rescan = true, true
+				break
+			}
+			next = e.Seq + 1
+			if e.Type == changeTombstone {
+				continue
+			}
+			out = append(out, e)
+			if len(out) == limit {
+				return out, nil
+			}
+		}
+		if !rescan && len(hits) < limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+func (l *esChangeLog) Latest(ctx context.Context) (int64, error) {
+	res, err := l.client.Get().Index(CHANGES_SEQ_INDEX).Id("seq").Do(ctx)
+	if elastic.IsNotFound(err) || (err == nil && !res.Found) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var counter struct {
+		Value int64 `json:"value"`
+	}
+	if err := json.Unmarshal(res.Source, &counter); err != nil {
+		return 0, err
+	}
+	return counter.Value, nil
+}
+
+// esTokenStore 是 TokenStore 的 ES 实现：刷新令牌以摘要、吊销记录以 jti（或 sid:<会话>）为文档 ID，
+// 按 ID 读取是实时的，无需等待刷新
+type esTokenStore struct {
+	client *elastic.Client
+}
+
+func (s *esTokenStore) CreateRefresh(ctx context.Context, t *RefreshToken) error {
+	_, err := s.client.Index().
+		Index(REFRESH_TOKENS_INDEX).
+		Id(t.ID).
+		OpType("create").
+		BodyJson(t).
+		Refresh("true"). // DeleteSession 按 session 查询，需立即可见
+		Do(ctx)
+	return err
+}
+
+// UseRefresh 以读取时的 _seq_no / _primary_term 为条件写入 used_at；条件写入冲突说明另一个请求抢先用掉了它
+func (s *esTokenStore) UseRefresh(ctx context.Context, id string, now time.Time) (*RefreshToken, error) {
+	res, err := s.client.Get().Index(REFRESH_TOKENS_INDEX).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) || (err == nil && !res.Found) {
+		return nil, ErrRefreshNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t RefreshToken
+	if err := json.Unmarshal(res.Source, &t); err != nil {
+		return nil, fmt.Errorf("decode refresh token: %w", err)
+	}
+	t.ID = id
+	if t.UsedAt != nil || res.SeqNo == nil || res.PrimaryTerm == nil {
+		return &t, ErrRefreshReused
+	}
+	used := now.UTC()
+	t.UsedAt = &used
+	_, err = s.client.Index().
+		Index(REFRESH_TOKENS_INDEX).
+		Id(id).
+		BodyJson(&t).
+		IfSeqNo(*res.SeqNo).
+		IfPrimaryTerm(*res.PrimaryTerm).
+		Do(ctx)
+	if elastic.IsConflict(err) {
+		return &t, ErrRefreshReused
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *esTokenStore) DeleteSession(ctx context.Context, session string) error {
+	_, err := s.client.DeleteByQuery(REFRESH_TOKENS_INDEX).
+		Query(elastic.NewTermQuery("session", session)).
+		Conflicts("proceed").
+		Refresh("true").
+		Do(ctx)
+	return err
+}
+
+func (s *esTokenStore) Revoke(ctx context.Context, id string, expiresAt time.Time) error {
+	_, err := s.client.Index().
+		Index(REVOKED_TOKENS_INDEX).
+		Id(id).
+		BodyJson(map[string]interface{}{"expires_at": expiresAt.UTC()}).
+		Do(ctx)
+	return err
+}
+
+// IsRevoked 用 mget 按 ID 读取（实时，不依赖刷新）
+func (s *esTokenStore) IsRevoked(ctx context.Context, ids ...string) (bool, error) {
+	if len(ids) == 0 {
+		return false, nil
+	}
+	mget := s.client.Mget()
+	for _, id := range ids {
+		mget.Add(elastic.NewMultiGetItem().Index(REVOKED_TOKENS_INDEX).Id(id).FetchSource(elastic.NewFetchSourceContext(false)))
+	}
+	res, err := mget.Do(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, doc := range res.Docs {
+		if doc.Error != nil {
+			return false, fmt.Errorf("check revocation %s: %s", doc.Id, doc.Error.Reason)
+		}
+		if doc.Found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *esTokenStore) PurgeExpired(ctx context.Context, now time.Time) (int64, error) {
+	var total int64
+	for _, index := range []string{REFRESH_TOKENS_INDEX, REVOKED_TOKENS_INDEX} {
+		res, err := s.client.DeleteByQuery(index).
+			Query(elastic.NewRangeQuery("expires_at").Lte(now.UTC().Format(time.RFC3339Nano))).
+			Conflicts("proceed").
+			Do(ctx)
+		if err != nil {
+			return total, err
+		}
+		total += res.Deleted
+	}
+	return total, nil
+}
+
+// esUserRepository 将用户存放在 users 索引中，以 username 作为文档 ID
+type esUserRepository struct {
+	client *elastic.Client
+}
+
+func (r *esUserRepository) Get(ctx context.Context, username string) (*User, error) {
+	// 先按 ID 读取，再回退 term 查询（兼容早期未以用户名为 ID 写入的文档）
+	var u User
+	res, err := r.client.Get().Index(USERS_INDEX).Id(username).Do(ctx)
+	if err == nil && res.Found {
+		if err := json.Unmarshal(res.Source, &u); err != nil {
+			return nil, fmt.Errorf("decode user %s: %w", username, err)
+		}
+		return &u, nil
+	}
+	if err != nil && !elastic.IsNotFound(err) {
+		return nil, err
+	}
+	sr, err := r.client.Search().Index(USERS_INDEX).Query(elastic.NewTermQuery("username", username)).Size(1).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(sr.Hits.Hits) == 0 {
+		return nil, ErrUserNotFound
+	}
+	if err := json.Unmarshal(sr.Hits.Hits[0].Source, &u); err != nil {
+		return nil, fmt.Errorf("decode user %s: %w", username, err)
+	}
+	return &u, nil
+}
+
+func (r *esUserRepository) Create(ctx context.Context, u *User) error {
+	// op_type=create：文档 ID 已存在时 ES 返回 409，检查与写入是原子的
+	_, err := r.client.Index().
+		Index(USERS_INDEX).
+		Id(u.Username).
+		OpType("create").
+		BodyJson(u).
+		Refresh("true"). // 测试期立即可见
+		Do(ctx)
+	if elastic.IsStatusCode(err, http.StatusConflict) {
+		return ErrUserExists
+	}
+	return err
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// 进程内存储（STORAGE_BACKEND=memory）：用于本地开发与测试，重启后数据丢失。
+// 搜索为线性扫描，地理条件与 ES 后端一致（半径按大圆距离、视野可跨日界线、最近邻按距离排序）；
+// 关键词匹配只是近似：中日韩关键词按子串匹配，其他关键词按词匹配并做简单的英文复数归一。
+
+// memoryPost 是存储的一条帖子；seq 为写入顺序（每次写入都会变化，兼作版本号）
+type memoryPost struct {
+	post Post
+	seq  int64
+}
+
+// memoryPostRepository 是 PostRepository 的内存实现
+type memoryPostRepository struct {
+	mu        sync.RWMutex
+	seq       int64
+	posts     map[string]*memoryPost
+	revisions map[string]map[int]PostRevision // 帖子 ID -> 版本号 -> 修订
+}
+
+func newMemoryPostRepository() *memoryPostRepository {
+	return &memoryPostRepository{posts: map[string]*memoryPost{}, revisions: map[string]map[int]PostRevision{}}
+}
+
+// clonePost 复制帖子，避免调用方与存储共享切片与指针
+func clonePost(p Post) Post {
+	p.Tags = append([]string(nil), p.Tags...)
+	for _, t := range []**time.Time{&p.CreatedAt, &p.EditedAt, &p.DeletedAt, &p.ExpiresAt} {
+		if *t != nil {
+			c := **t
+			*t = &c
+		}
+	}
+	return p
+}
+
+func (r *memoryPostRepository) Save(ctx context.Context, id string, p *Post) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	r.posts[id] = &memoryPost{post: clonePost(*p), seq: r.seq}
+	return nil
+}
+
+func (r *memoryPostRepository) SaveIf(ctx context.Context, id string, p *Post, ver PostVersion) (PostVersion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mp, ok := r.posts[id]
+	if !ok || (PostVersion{SeqNo: mp.seq}) != ver {
+		return PostVersion{}, ErrVersionConflict
+	}
+	r.seq++
+	r.posts[id] = &memoryPost{post: clonePost(*p), seq: r.seq}
+	return PostVersion{SeqNo: r.seq}, nil
+}
+
+func (r *memoryPostRepository) SaveBatch(ctx context.Context, posts []PostWithID) []SaveResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := make([]SaveResult, len(posts))
+	for i, p := range posts {
+		_, results[i].Replaced = r.posts[p.ID]
+		r.seq++
+		r.posts[p.ID] = &memoryPost{post: clonePost(p.Post), seq: r.seq}
+	}
+	return results
+}
+
+func (r *memoryPostRepository) Get(ctx context.Context, id string) (*Post, error) {
+	p, _, err := r.GetVersioned(ctx, id)
+	return p, err
+}
+
+func (r *memoryPostRepository) GetVersioned(ctx context.Context, id string) (*Post, PostVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	mp, ok := r.posts[id]
+	if !ok {
+		return nil, PostVersion{}, ErrPostNotFound
+	}
+	p := clonePost(mp.post)
+	return &p, PostVersion{SeqNo: mp.seq}, nil
+}
+
+func (r *memoryPostRepository) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.posts[id]; !ok {
+		return ErrPostNotFound
+	}
+	delete(r.posts, id)
+	delete(r.revisions, id)
+	return nil
+}
+
+func (r *memoryPostRepository) AddRevision(ctx context.Context, rev PostRevision) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.revisions[rev.PostID] == nil {
+		r.revisions[rev.PostID] = map[int]PostRevision{}
+	}
+	r.revisions[rev.PostID][rev.Revision] = rev
+	return nil
+}
+
+func (r *memoryPostRepository) ListRevisions(ctx context.Context, postID string) ([]PostRevision, error) {
+	r.mu.RLock()
+	out := make([]PostRevision, 0, len(r.revisions[postID]))
+	for _, rev := range r.revisions[postID] {
+		out = append(out, rev)
+	}
+	r.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Revision < out[j].Revision })
+	return out, nil
+}
+
+func (r *memoryPostRepository) Scan(ctx context.Context, fn func(PostWithID) error) error {
+	type entry struct {
+		hit PostWithID
+		seq int64
+	}
+	r.mu.RLock()
+	all := make([]entry, 0, len(r.posts))
+	for id, mp := range r.posts {
+		all = append(all, entry{hit: PostWithID{ID: id, Post: clonePost(mp.post)}, seq: mp.seq})
+	}
+	r.mu.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+	for _, e := range all {
+		if err := fn(e.hit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryPostRepository) ListDeleted(ctx context.Context, user string, limit, offset int) ([]PostWithID, int64, error) {
+	r.mu.RLock()
+	var out []PostWithID
+	for id, mp := range r.posts {
+		if mp.post.DeletedAt != nil && (user == "" || mp.post.User == user) {
+			out = append(out, PostWithID{ID: id, Post: clonePost(mp.post)})
+		}
+	}
+	r.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].DeletedAt.After(*out[j].DeletedAt) })
+	total := int64(len(out))
+	if offset >= len(out) {
+		return nil, total, nil
+	}
+	out = out[offset:]
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, total, nil
+}
+
+func (r *memoryPostRepository) PurgeDeleted(ctx context.Context, before time.Time) ([]PurgedPost, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []PurgedPost
+	for id, mp := range r.posts {
+		if mp.post.DeletedAt != nil && mp.post.DeletedAt.Before(before) {
+			p := PurgedPost{PostWithID: PostWithID{ID: id, Post: mp.post}}
+			for _, rev := range r.revisions[id] {
+				p.RevisionURLs = append(p.RevisionURLs, rev.Url)
+			}
+			delete(r.posts, id)
+			delete(r.revisions, id)
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+func (r *memoryPostRepository) ListExpired(ctx context.Context, now time.Time, limit int) ([]PostWithID, error) {
+	r.mu.RLock()
+	var out []PostWithID
+	for id, mp := range r.posts {
+		if mp.post.DeletedAt == nil && mp.post.expired(now) {
+			out = append(out, PostWithID{ID: id, Post: clonePost(mp.post)})
+		}
+	}
+	r.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ExpiresAt.Before(*out[j].ExpiresAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (r *memoryPostRepository) URLInUse(ctx context.Context, url string) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, mp := range r.posts {
+		if mp.post.Url == url {
+			return true, nil
+		}
+	}
+	for _, revs := range r.revisions {
+		for _, rev := range revs {
+			if rev.Url == url {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (r *memoryPostRepository) Search(ctx context.Context, p SearchParams) ([]PostWithID, int64, error) {
+	type match struct {
+		hit  PostWithID
+		dist float64
+	}
+	r.mu.RLock()
+	var matches []match
+	for id, mp := range r.posts {
+		if !p.matches(&mp.post) {
+			continue
+		}
+		m := match{hit: PostWithID{ID: id, Post: clonePost(mp.post)}}
+		if p.Mode == modeNearest {
+			m.dist = haversineMeters(*p.Center, mp.post.Location)
+			d := m.dist
+			m.hit.DistanceMeters = &d
+		}
+		matches = append(matches, m)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if p.Mode == modeNearest && matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		return newerFirst(&matches[i].hit, &matches[j].hit)
+	})
+
+	total := int64(len(matches))
+	var out []PostWithID
+	for i := p.Offset; i < len(matches) && len(out) < p.Limit; i++ {
+		out = append(out, matches[i].hit)
+	}
+	return out, total, nil
+}
+
+// matches 判断帖子是否满足查询条件，语义与 esQuery 相同
+func (p SearchParams) matches(post *Post) bool {
+	if post.DeletedAt != nil || post.expired(time.Now()) {
+		return false
+	}
+	switch p.Mode {
+	case modeViewport:
+		if !p.Viewport.Contains(post.Location) {
+			return false
+		}
+	case modeRadius:
+		if haversineMeters(*p.Center, post.Location) > p.RangeM {
+			return false
+		}
+	}
+	if p.Keywords != "" && !matchesKeywords(post.Message, p.Keywords) {
+		return false
+	}
+	for _, t := range p.Tags {
+		if !containsString(post.Tags, t) {
+			return false
+		}
+	}
+	for _, f := range [][2]string{{p.City, post.City}, {p.Region, post.Region}, {p.Country, post.Country}} {
+		if f[0] != "" && !strings.EqualFold(f[0], f[1]) {
+			return false
+		}
+	}
+	return p.Lang == "" || p.Lang == post.Lang
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesKeywords 近似 keywordQuery（operator=and）：所有关键词都需出现在消息中
+func matchesKeywords(message, keywords string) bool {
+	message = strings.ToLower(message)
+	words := map[string]bool{}
+	for _, w := range splitWords(message) {
+		words[w] = true
+		words[stemEnglish(w)] = true
+	}
+	for _, k := range splitWords(strings.ToLower(keywords)) {
+		if isCJK(detectLanguage(k)) {
+			if !strings.Contains(message, k) {
+				return false
+			}
+		} else if !words[k] && !words[stemEnglish(k)] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitWords 按非字母数字字符切分文本
+func splitWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// stemEnglish 是极简的英文复数归一（cities → city、dogs → dog），用于近似 english 分析器
+func stemEnglish(w string) string {
+	switch {
+	case len(w) > 4 && strings.HasSuffix(w, "ies"):
+		return w[:len(w)-3] + "y"
+	case len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+// memoryUserRepository 是 UserRepository 的内存实现
+type memoryUserRepository struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func newMemoryUserRepository() *memoryUserRepository {
+	return &memoryUserRepository{users: map[string]User{}}
+}
+
+func (r *memoryUserRepository) Get(ctx context.Context, username string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	u, ok := r.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &u, nil
+}
+
+func (r *memoryUserRepository) Create(ctx context.Context, u *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[u.Username]; ok {
+		return ErrUserExists
+	}
+	r.users[u.Username] = *u
+	return nil
+}
+
+// memoryChangeLog 是 ChangeLog 的内存实现：事件按追加顺序存放，序号即位置 + 1
+type memoryChangeLog struct {
+	mu     sync.RWMutex
+	events []ChangeEvent
+}
+
+func (l *memoryChangeLog) Append(ctx context.Context, events []ChangeEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range events {
+		events[i].Seq = int64(len(l.events)) + 1
+		l.events = append(l.events, events[i])
+	}
+	return nil
+}
+
+func (l *memoryChangeLog) Since(ctx context.Context, cursor int64, limit int) ([]ChangeEvent, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if cursor >= int64(len(l.events)) {
+		return nil, nil
+	}
+	rest := l.events[cursor:]
+	if len(rest) > limit {
+		rest = rest[:limit]
+	}
+	return append([]ChangeEvent(nil), rest...), nil
+}
+
+func (l *memoryChangeLog) Latest(ctx context.Context) (int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return int64(len(l.events)), nil
+}
+
+// memoryTokenStore 是 TokenStore 的内存实现
+type memoryTokenStore struct {
+	mu      sync.Mutex
+	refresh map[string]RefreshToken
+	revoked map[string]time.Time // jti 或 sid:<会话> → 过期时间
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{refresh: map[string]RefreshToken{}, revoked: map[string]time.Time{}}
+}
+
+func (s *memoryTokenStore) CreateRefresh(ctx context.Context, t *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh[t.ID] = *t
+	return nil
+}
+
+func (s *memoryTokenStore) UseRefresh(ctx context.Context, id string, now time.Time) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.refresh[id]
+	if !ok {
+		return nil, ErrRefreshNotFound
+	}
+	if t.UsedAt != nil {
+		return &t, ErrRefreshReused
+	}
+	used := now.UTC()
+	t.UsedAt = &used
+	s.refresh[id] = t
+	return &t, nil
+}
+
+func (s *memoryTokenStore) DeleteSession(ctx context.Context, session string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, t := range s.refresh {
+		if t.Session == session {
+			delete(s.refresh, id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryTokenStore) Revoke(ctx context.Context, id string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[id] = expiresAt
+	return nil
+}
+
+func (s *memoryTokenStore) IsRevoked(ctx context.Context, ids ...string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := s.revoked[id]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryTokenStore) PurgeExpired(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for id, t := range s.refresh {
+		if !t.ExpiresAt.After(now) {
+			delete(s.refresh, id)
+			n++
+		}
+	}
+	for jti, exp := range s.revoked {
+		if !exp.After(now) {
+			delete(s.revoked, jti)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,935 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// 嵌入式 SQLite 存储（STORAGE_BACKEND=sqlite）：适合不想部署 ES 集群的小型实例，单个数据库文件同时保存帖子与用户。
+//   - posts      ：帖子 JSON 存在 doc 列，过滤用到的字段（lang/tags/city/...）另存为列
+//   - posts_rtree：R-tree 空间索引（点存为退化矩形）；半径/视野/最近邻查询先按矩形粗筛，再精确计算距离
+//   - post_revisions：帖子的修订历史（JSON），随帖子一起删除
+//   - post_changes：变更流（见 changes.go），seq 即 cursor
+//   - refresh_tokens / revoked_tokens：刷新令牌（以摘要为主键）与吊销列表（jti 或 sid:<会话>，见 tokens.go）
+//   - posts_fts  ：FTS5 全文索引（porter 词干化），与 ES 的 message.en 一样 "dogs" 能匹配 "dog"；
+//     中日韩关键词没有空格分词，改为对 message 做子串匹配（对应 ES 的 message.cjk）
+//
+// 相关环境变量：
+//   - SQLITE_PATH：数据库文件路径（默认 geoconnect.db；":memory:" 为临时内存库）
+
+var sqlitePath = getenvDefault("SQLITE_PATH", "geoconnect.db")
+
+// sqliteSchema 建表语句，可在每次启动时重复执行
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	username TEXT PRIMARY KEY,
+	password TEXT NOT NULL,
+	age      INTEGER NOT NULL DEFAULT 0,
+	gender   TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS posts (
+	seq     INTEGER PRIMARY KEY AUTOINCREMENT,
+	id      TEXT NOT NULL UNIQUE,
+	user    TEXT NOT NULL,
+	message TEXT NOT NULL,
+	lat     REAL NOT NULL,
+	lon     REAL NOT NULL,
+	tags    TEXT NOT NULL DEFAULT '[]',
+	city    TEXT NOT NULL DEFAULT '',
+	region  TEXT NOT NULL DEFAULT '',
+	country TEXT NOT NULL DEFAULT '',
+	lang    TEXT NOT NULL DEFAULT '',
+	doc     TEXT NOT NULL,
+	deleted_at INTEGER,
+	expires_at INTEGER,
+	created_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS post_revisions (
+	post_id  TEXT NOT NULL,
+	revision INTEGER NOT NULL,
+	doc      TEXT NOT NULL,
+	PRIMARY KEY (post_id, revision)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS post_changes (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	doc TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id         TEXT PRIMARY KEY,
+	session    TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	used_at    INTEGER,
+	doc        TEXT NOT NULL
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS refresh_tokens_session ON refresh_tokens (session);
+CREATE INDEX IF NOT EXISTS refresh_tokens_expires_at ON refresh_tokens (expires_at);
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	id         TEXT PRIMARY KEY,
+	expires_at INTEGER NOT NULL
+) WITHOUT ROWID;
+CREATE VIRTUAL TABLE IF NOT EXISTS posts_rtree USING rtree(seq, min_lat, max_lat, min_lon, max_lon);
+CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(message, tokenize = 'porter unicode61 remove_diacritics 2');
+`
+
+// sqliteColumns 是建表之后新增的列：旧数据库启动时按需 ALTER TABLE 补上（SQLite 不支持 ADD COLUMN IF NOT EXISTS）
+var sqliteColumns = []struct{ table, column, def string }{
+	{"posts", "deleted_at", "INTEGER"}, // 软删除时间（Unix 纳秒），NULL 表示未删除
+	{"posts", "expires_at", "INTEGER"}, // 限时帖子的到期时间（Unix 纳秒），NULL 表示不过期
+	{"posts", "created_at", "INTEGER"}, // 发帖时间（Unix 纳秒），搜索结果按它排列；NULL 为没有发帖时间的旧帖子
+}
+
+// sqliteIndexes 依赖新增列的索引，需在补列之后创建
+const sqliteIndexes = `
+CREATE INDEX IF NOT EXISTS posts_deleted_at ON posts (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS posts_expires_at ON posts (expires_at) WHERE expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS posts_created_at ON posts (created_at);
+`
+
+// openSQLite 打开（必要时创建）数据库并建表
+func openSQLite(ctx context.Context, path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite 同一时间只允许一个写者：使用单个连接串行化访问，避免 SQLITE_BUSY；
+	// ":memory:" 库也只在同一连接内可见
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000", sqliteSchema} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("init sqlite %q: %w", path, err)
+		}
+	}
+	if err := addMissingColumns(ctx, db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("upgrade sqlite %q: %w", path, err)
+	}
+	if _, err := db.ExecContext(ctx, sqliteIndexes); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init sqlite %q: %w", path, err)
+	}
+	return db, nil
+}
+
+// addMissingColumns 为旧数据库补上 sqliteColumns 中缺少的列
+func addMissingColumns(ctx context.Context, db *sql.DB) error {
+	for _, c := range sqliteColumns {
+		var n int
+		if err := db.QueryRowContext(ctx,
+			`SELECT count(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.def)); err != nil {
+			return err
+		}
+		log.Printf("sqlite: added column %s.%s", c.table, c.column)
+	}
+	return nil
+}
+
+// sqlitePostRepository 是 PostRepository 的 SQLite 实现
+type sqlitePostRepository struct {
+	db *sql.DB
+}
+
+// sqliteTxKey 是 InTx 放在 ctx 中的事务
+type sqliteTxKey struct{}
+
+// InTx 在一个事务中执行 fn（见 changes.go 的 writeWithChanges）：fn 中的帖子写入与变更追加经由 ctx 加入这个事务，
+// 一起提交或回滚。只有单个连接，fn 中不能再直接使用 db（会等待自身而死锁）
+func (r *sqlitePostRepository) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(sqliteTxKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(context.WithValue(ctx, sqliteTxKey{}, tx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteTx 是一次写入使用的事务：独立的事务，或在 InTx 的事务中建立的保存点（提交与回滚只作用于这次写入）
+type sqliteTx struct {
+	*sql.Tx
+	joined bool
+	done   bool
+}
+
+// beginSQLite 开始一次写入；ctx 中有 InTx 开启的事务时加入其中
+func beginSQLite(ctx context.Context, db *sql.DB) (*sqliteTx, error) {
+	if tx, ok := ctx.Value(sqliteTxKey{}).(*sql.Tx); ok {
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT sqlite_write`); err != nil {
+			return nil, err
+		}
+		return &sqliteTx{Tx: tx, joined: true}, nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteTx{Tx: tx}, nil
+}
+
+func (t *sqliteTx) Commit() error {
+	if !t.joined {
+		return t.Tx.Commit()
+	}
+	t.done = true
+	_, err := t.ExecContext(context.Background(), `RELEASE sqlite_write`)
+	return err
+}
+
+// Rollback 与 sql.Tx 一样可以在 Commit 之后调用（defer），此时什么也不做
+func (t *sqliteTx) Rollback() error {
+	if !t.joined {
+		return t.Tx.Rollback()
+	}
+	if t.done {
+		return nil
+	}
+	t.done = true
+	if _, err := t.ExecContext(context.Background(), `ROLLBACK TO sqlite_write`); err != nil {
+		return err
+	}
+	_, err := t.ExecContext(context.Background(), `RELEASE sqlite_write`)
+	return err
+}
+
+func (r *sqlitePostRepository) Save(ctx context.Context, id string, p *Post) error {
+	tx, err := beginSQLite(ctx, r.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := insertPostTx(ctx, tx.Tx, id, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveIf 在事务内比较 seq（每次写入都会分配新的 seq，兼作版本号）后覆盖写入
+func (r *sqlitePostRepository) SaveIf(ctx context.Context, id string, p *Post, ver PostVersion) (PostVersion, error) {
+	tx, err := beginSQLite(ctx, r.db)
+	if err != nil {
+		return PostVersion{}, err
+	}
+	defer tx.Rollback()
+	var cur int64
+	err = tx.QueryRowContext(ctx, `SELECT seq FROM posts WHERE id = ?`, id).Scan(&cur)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (PostVersion{SeqNo: cur}) != ver) {
+		return PostVersion{}, ErrVersionConflict
+	}
+	if err != nil {
+		return PostVersion{}, err
+	}
+	seq, err := insertPostTx(ctx, tx.Tx, id, p)
+	if err != nil {
+		return PostVersion{}, err
+	}
+	return PostVersion{SeqNo: seq}, tx.Commit()
+}
+
+// SaveBatch 在同一个事务中写入全部帖子；每条帖子包在一个保存点里，单条失败只回滚这一条
+func (r *sqlitePostRepository) SaveBatch(ctx context.Context, posts []PostWithID) []SaveResult {
+	results := make([]SaveResult, len(posts))
+	fail := func(err error) []SaveResult {
+		for i := range results {
+			results[i] = SaveResult{Err: err}
+		}
+		return results
+	}
+	tx, err := beginSQLite(ctx, r.db)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+	for i := range posts {
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT bulk_item`); err != nil {
+			return fail(err)
+		}
+		var n int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM posts WHERE id = ?`, posts[i].ID).Scan(&n); err != nil {
+			return fail(err)
+		}
+		results[i].Replaced = n > 0
+		if _, results[i].Err = insertPostTx(ctx, tx.Tx, posts[i].ID, &posts[i].Post); results[i].Err != nil {
+			results[i].Replaced = false
+			if _, err := tx.ExecContext(ctx, `ROLLBACK TO bulk_item`); err != nil {
+				return fail(err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `RELEASE bulk_item`); err != nil {
+			return fail(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return results
+}
+
+// insertPostTx 在事务内写入（或覆盖）帖子及其 R-tree / FTS 索引行，返回新分配的 seq
+func insertPostTx(ctx context.Context, tx *sql.Tx, id string, p *Post) (int64, error) {
+	doc, err := json.Marshal(p)
+	if err != nil {
+		return 0, err
+	}
+	tags := p.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return 0, err
+	}
+
+	// 覆盖写入：先删除同 ID 的旧记录及其索引行
+	if err := deletePostTx(ctx, tx, id); err != nil && !errors.Is(err, ErrPostNotFound) {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO posts (id, user, message, lat, lon, tags, city, region, country, lang, doc, deleted_at, expires_at, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, p.User, p.Message, p.Location.Lat, p.Location.Lon, string(tagsJSON),
+		p.City, p.Region, p.Country, p.Lang, string(doc),
+		unixNanoOrNull(p.DeletedAt), unixNanoOrNull(p.ExpiresAt), unixNanoOrNull(p.CreatedAt))
+	if err != nil {
+		return 0, err
+	}
+	seq, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO posts_rtree (seq, min_lat, max_lat, min_lon, max_lon) VALUES (?, ?, ?, ?, ?)`,
+		seq, p.Location.Lat, p.Location.Lat, p.Location.Lon, p.Location.Lon); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO posts_fts (rowid, message) VALUES (?, ?)`, seq, p.Message); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// unixNanoOrNull 将可选时间转为 Unix 纳秒，nil 存为 NULL
+func unixNanoOrNull(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+func (r *sqlitePostRepository) Get(ctx context.Context, id string) (*Post, error) {
+	p, _, err := r.GetVersioned(ctx, id)
+	return p, err
+}
+
+func (r *sqlitePostRepository) GetVersioned(ctx context.Context, id string) (*Post, PostVersion, error) {
+	var (
+		seq int64
+		doc string
+	)
+	err := r.db.QueryRowContext(ctx, `SELECT seq, doc FROM posts WHERE id = ?`, id).Scan(&seq, &doc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, PostVersion{}, ErrPostNotFound
+	}
+	if err != nil {
+		return nil, PostVersion{}, err
+	}
+	var p Post
+	if err := json.Unmarshal([]byte(doc), &p); err != nil {
+		return nil, PostVersion{}, fmt.Errorf("decode post %s: %w", id, err)
+	}
+	return &p, PostVersion{SeqNo: seq}, nil
+}
+
+func (r *sqlitePostRepository) Scan(ctx context.Context, fn func(PostWithID) error) error {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, doc FROM posts ORDER BY seq`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, doc string
+		if err := rows.Scan(&id, &doc); err != nil {
+			return err
+		}
+		hit := PostWithID{ID: id}
+		if err := json.Unmarshal([]byte(doc), &hit.Post); err != nil {
+			return fmt.Errorf("decode post %s: %w", id, err)
+		}
+		if err := fn(hit); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *sqlitePostRepository) ListDeleted(ctx context.Context, user string, limit, offset int) ([]PostWithID, int64, error) {
+	where, args := []string{"deleted_at IS NOT NULL"}, []interface{}{}
+	if user != "" {
+		where = append(where, "user = ?")
+		args = append(args, user)
+	}
+	var total int64
+	if err := r.db.QueryRowContext(ctx, `SELECT count(*) FROM posts`+whereClause(where), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT id, doc FROM posts`+whereClause(where)+` ORDER BY deleted_at DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var out []PostWithID
+	for rows.Next() {
+		var id, doc string
+		if err := rows.Scan(&id, &doc); err != nil {
+			return nil, 0, err
+		}
+		hit := PostWithID{ID: id}
+		if err := json.Unmarshal([]byte(doc), &hit.Post); err != nil {
+			return nil, 0, fmt.Errorf("decode post %s: %w", id, err)
+		}
+		out = append(out, hit)
+	}
+	return out, total, rows.Err()
+}
+
+func (r *sqlitePostRepository) PurgeDeleted(ctx context.Context, before time.Time) ([]PurgedPost, error) {
+	tx, err := beginSQLite(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT id, doc FROM posts WHERE deleted_at < ?`, before.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	var out []PurgedPost
+	for rows.Next() {
+		var id, doc string
+		if err := rows.Scan(&id, &doc); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p := PurgedPost{PostWithID: PostWithID{ID: id}}
+		if err := json.Unmarshal([]byte(doc), &p.Post); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("decode post %s: %w", id, err)
+		}
+		out = append(out, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, p := range out {
+		if out[i].RevisionURLs, err = revisionURLsTx(ctx, tx.Tx, p.ID); err != nil {
+			return nil, err
+		}
+		if err := deletePostTx(ctx, tx.Tx, p.ID); err != nil && !errors.Is(err, ErrPostNotFound) {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM post_revisions WHERE post_id = ?`, p.ID); err != nil {
+			return nil, err
+		}
+	}
+	return out, tx.Commit()
+}
+
+// revisionURLsTx 返回帖子修订历史中引用的图片地址
+func revisionURLsTx(ctx context.Context, tx *sql.Tx, postID string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT json_extract(doc, '$.url') FROM post_revisions WHERE post_id = ? AND json_extract(doc, '$.url') IS NOT NULL`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+func (r *sqlitePostRepository) ListExpired(ctx context.Context, now time.Time, limit int) ([]PostWithID, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT id, doc FROM posts WHERE expires_at <= ? AND deleted_at IS NULL ORDER BY expires_at LIMIT ?`, now.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PostWithID
+	for rows.Next() {
+		var id, doc string
+		if err := rows.Scan(&id, &doc); err != nil {
+			return nil, err
+		}
+		hit := PostWithID{ID: id}
+		if err := json.Unmarshal([]byte(doc), &hit.Post); err != nil {
+			return nil, fmt.Errorf("decode post %s: %w", id, err)
+		}
+		out = append(out, hit)
+	}
+	return out, rows.Err()
+}
+
+func (r *sqlitePostRepository) URLInUse(ctx context.Context, url string) (bool, error) {
+	var n int
+	err := r.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM posts WHERE json_extract(doc, '$.url') = ?)
+		     OR EXISTS (SELECT 1 FROM post_revisions WHERE json_extract(doc, '$.url') = ?)`, url, url).Scan(&n)
+	return n == 1, err
+}
+
+func (r *sqlitePostRepository) Delete(ctx context.Context, id string) error {
+	tx, err := beginSQLite(ctx, r.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := deletePostTx(ctx, tx.Tx, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM post_revisions WHERE post_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *sqlitePostRepository) AddRevision(ctx context.Context, rev PostRevision) error {
+	doc, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO post_revisions (post_id, revision, doc) VALUES (?, ?, ?)`,
+		rev.PostID, rev.Revision, string(doc))
+	return err
+}
+
+func (r *sqlitePostRepository) ListRevisions(ctx context.Context, postID string) ([]PostRevision, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT doc FROM post_revisions WHERE post_id = ? ORDER BY revision`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PostRevision
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		var rev PostRevision
+		if err := json.Unmarshal([]byte(doc), &rev); err != nil {
+			return nil, fmt.Errorf("decode revision of post %s: %w", postID, err)
+		}
+		out = append(out, rev)
+	}
+	return out, rows.Err()
+}
+
+// deletePostTx 在事务内删除帖子及其 R-tree / FTS 索引行，不存在时返回 ErrPostNotFound
+func deletePostTx(ctx context.Context, tx *sql.Tx, id string) error {
+	var seq int64
+	err := tx.QueryRowContext(ctx, `SELECT seq FROM posts WHERE id = ?`, id).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrPostNotFound
+	}
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		`DELETE FROM posts WHERE seq = ?`,
+		`DELETE FROM posts_rtree WHERE seq = ?`,
+		`DELETE FROM posts_fts WHERE rowid = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search 的过滤条件与 ES 后端一致：radius / viewport 先按 R-tree 矩形粗筛，再按距离或视野精确过滤；
+// nearest 见 searchNearest。结果按 newerFirst 排列（由 candidates 的 ORDER BY 完成），分页在过滤之后进行。
+func (r *sqlitePostRepository) Search(ctx context.Context, p SearchParams) ([]PostWithID, int64, error) {
+	if p.Mode == modeNearest {
+		return r.searchNearest(ctx, p)
+	}
+
+	var boxes []BoundingBox
+	var inside func(Location) bool
+	if p.Mode == modeViewport {
+		boxes = p.Viewport.Boxes()
+		inside = p.Viewport.Contains
+	} else {
+		center, rangeM := *p.Center, p.RangeM
+		boxes = circleBounds(center, Distance(rangeM)).Boxes()
+		inside = func(loc Location) bool { return haversineMeters(center, loc) <= rangeM }
+	}
+	cands, err := r.candidates(ctx, p, boxes)
+	if err != nil {
+		return nil, 0, err
+	}
+	var hits []PostWithID
+	for _, c := range cands {
+		if inside(c.Location) {
+			hits = append(hits, c)
+		}
+	}
+	return paginate(hits, p.Offset, p.Limit), int64(len(hits)), nil
+}
+
+// searchNearest 以 1km 为起点、每次扩大 4 倍的圆逐步搜索，直到圆内的帖子数足够一页（或覆盖全球），
+// 再按距离升序（同距离保持 newerFirst 顺序）取前 k 条；总数与 ES 一致，为满足非地理条件的全部帖子数。
+func (r *sqlitePostRepository) searchNearest(ctx context.Context, p SearchParams) ([]PostWithID, int64, error) {
+	total, err := r.count(ctx, p)
+	if err != nil {
+		return nil, 0, err
+	}
+	center := *p.Center
+	need := p.Offset + p.Limit
+
+	var hits []PostWithID
+	for radius := 1000.0; ; radius *= 4 {
+		if radius >= maxDistanceMeters {
+			if hits, err = r.candidates(ctx, p, nil); err != nil {
+				return nil, 0, err
+			}
+			break
+		}
+		cands, err := r.candidates(ctx, p, circleBounds(center, Distance(radius)).Boxes())
+		if err != nil {
+			return nil, 0, err
+		}
+		hits = hits[:0]
+		for _, c := range cands {
+			if haversineMeters(center, c.Location) <= radius {
+				hits = append(hits, c)
+			}
+		}
+		if len(hits) >= need {
+			break
+		}
+	}
+
+	for i := range hits {
+		d := haversineMeters(center, hits[i].Location)
+		hits[i].DistanceMeters = &d
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return *hits[i].DistanceMeters < *hits[j].DistanceMeters })
+	return paginate(hits, p.Offset, p.Limit), total, nil
+}
+
+// paginate 截取 [offset, offset+limit) 范围内的结果
+func paginate(hits []PostWithID, offset, limit int) []PostWithID {
+	if offset >= len(hits) {
+		return nil
+	}
+	hits = hits[offset:]
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// candidates 返回满足非地理条件、且落在任一矩形（R-tree 粗筛）内的帖子，按 newerFirst 排列；boxes 为 nil 时不限位置
+func (r *sqlitePostRepository) candidates(ctx context.Context, p SearchParams, boxes []BoundingBox) ([]PostWithID, error) {
+	where, args := sqliteFilters(p)
+	if boxes != nil {
+		var ors []string
+		for _, b := range boxes {
+			// R-tree 以 32 位浮点存储坐标，这里用“相交”而非“包含”判断，边界上的点留给精确过滤
+			ors = append(ors, "(max_lat >= ? AND min_lat <= ? AND max_lon >= ? AND min_lon <= ?)")
+			args = append(args, b.South, b.North, b.West, b.East)
+		}
+		where = append(where, "p.seq IN (SELECT seq FROM posts_rtree WHERE "+strings.Join(ors, " OR ")+")")
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT p.id, p.doc FROM posts p`+whereClause(where)+` ORDER BY p.created_at IS NULL, p.created_at DESC, p.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PostWithID
+	for rows.Next() {
+		var id, doc string
+		if err := rows.Scan(&id, &doc); err != nil {
+			return nil, err
+		}
+		var post Post
+		if err := json.Unmarshal([]byte(doc), &post); err != nil {
+			return nil, fmt.Errorf("decode post %s: %w", id, err)
+		}
+		out = append(out, PostWithID{ID: id, Post: post})
+	}
+	return out, rows.Err()
+}
+
+// count 返回满足非地理条件的帖子数
+func (r *sqlitePostRepository) count(ctx context.Context, p SearchParams) (int64, error) {
+	where, args := sqliteFilters(p)
+	var n int64
+	err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM posts p`+whereClause(where), args...).Scan(&n)
+	return n, err
+}
+
+// sqliteFilters 将关键词、标签、地名与语言条件转换为 SQL 条件（语义同 esQuery）
+func sqliteFilters(p SearchParams) ([]string, []interface{}) {
+	// 排除已软删除与已到期的帖子
+	where := []string{"p.deleted_at IS NULL", "(p.expires_at IS NULL OR p.expires_at > ?)"}
+	args := []interface{}{time.Now().UnixNano()}
+
+	// 关键词全部需命中：非中日韩词交给 FTS5（带引号避免被解析为 FTS 语法），中日韩词做子串匹配
+	var ftsTerms []string
+	for _, k := range splitWords(strings.ToLower(p.Keywords)) {
+		if isCJK(detectLanguage(k)) {
+			where = append(where, `p.message LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+escapeLike(k)+"%")
+		} else {
+			ftsTerms = append(ftsTerms, `"`+strings.ReplaceAll(k, `"`, `""`)+`"`)
+		}
+	}
+	if len(ftsTerms) > 0 {
+		where = append(where, "p.seq IN (SELECT rowid FROM posts_fts WHERE posts_fts MATCH ?)")
+		args = append(args, strings.Join(ftsTerms, " "))
+	}
+
+	for _, t := range p.Tags {
+		where = append(where, "EXISTS (SELECT 1 FROM json_each(p.tags) WHERE json_each.value = ?)")
+		args = append(args, t)
+	}
+	for _, f := range [][2]string{{"city", p.City}, {"region", p.Region}, {"country", p.Country}} {
+		if f[1] != "" {
+			where = append(where, "p."+f[0]+" = ? COLLATE NOCASE")
+			args = append(args, f[1])
+		}
+	}
+	if p.Lang != "" {
+		where = append(where, "p.lang = ?")
+		args = append(args, p.Lang)
+	}
+	return where, args
+}
+
+func whereClause(where []string) string {
+	if len(where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(where, " AND ")
+}
+
+// escapeLike 转义 LIKE 模式中的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// sqliteChangeLog 是 ChangeLog 的 SQLite 实现：AUTOINCREMENT 保证序号递增且不复用，
+// 单连接串行写入保证按序号顺序提交
+type sqliteChangeLog struct {
+	db *sql.DB
+}
+
+func (l *sqliteChangeLog) Append(ctx context.Context, events []ChangeEvent) error {
+	tx, err := beginSQLite(ctx, l.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := range events {
+		doc, err := json.Marshal(events[i])
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO post_changes (doc) VALUES (?)`, string(doc))
+		if err != nil {
+			return err
+		}
+		if events[i].Seq, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (l *sqliteChangeLog) Since(ctx context.Context, cursor int64, limit int) ([]ChangeEvent, error) {
+	rows, err := l.db.QueryContext(ctx,
+		`SELECT seq, doc FROM post_changes WHERE seq > ? ORDER BY seq LIMIT ?`, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ChangeEvent
+	for rows.Next() {
+		var (
+			seq int64
+			doc string
+		)
+		if err := rows.Scan(&seq, &doc); err != nil {
+			return nil, err
+		}
+		var e ChangeEvent
+		if err := json.Unmarshal([]byte(doc), &e); err != nil {
+			return nil, fmt.Errorf("decode change %d: %w", seq, err)
+		}
+		e.Seq = seq
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (l *sqliteChangeLog) Latest(ctx context.Context) (int64, error) {
+	var seq int64
+	err := l.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM post_changes`).Scan(&seq)
+	return seq, err
+}
+
+// sqliteTokenStore 是 TokenStore 的 SQLite 实现；时间存为 Unix 纳秒
+type sqliteTokenStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteTokenStore) CreateRefresh(ctx context.Context, t *RefreshToken) error {
+	doc, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO refresh_tokens (id, session, expires_at, doc) VALUES (?, ?, ?, ?)`,
+		t.ID, t.Session, t.ExpiresAt.UnixNano(), string(doc))
+	return err
+}
+
+// UseRefresh 在事务内检查并设置 used_at（单连接串行执行，同一令牌只有一个请求能成功）
+func (s *sqliteTokenStore) UseRefresh(ctx context.Context, id string, now time.Time) (*RefreshToken, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var (
+		doc  string
+		used sql.NullInt64
+	)
+	err = tx.QueryRowContext(ctx, `SELECT doc, used_at FROM refresh_tokens WHERE id = ?`, id).Scan(&doc, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefreshNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t RefreshToken
+	if err := json.Unmarshal([]byte(doc), &t); err != nil {
+		return nil, fmt.Errorf("decode refresh token: %w", err)
+	}
+	t.ID = id
+	if used.Valid {
+		return &t, ErrRefreshReused
+	}
+	usedAt := now.UTC()
+	t.UsedAt = &usedAt
+	b, err := json.Marshal(&t)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = ?, doc = ? WHERE id = ?`,
+		usedAt.UnixNano(), string(b), id); err != nil {
+		return nil, err
+	}
+	return &t, tx.Commit()
+}
+
+func (s *sqliteTokenStore) DeleteSession(ctx context.Context, session string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE session = ?`, session)
+	return err
+}
+
+func (s *sqliteTokenStore) Revoke(ctx context.Context, id string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO revoked_tokens (id, expires_at) VALUES (?, ?)`, id, expiresAt.UnixNano())
+	return err
+}
+
+func (s *sqliteTokenStore) IsRevoked(ctx context.Context, ids ...string) (bool, error) {
+	if len(ids) == 0 {
+		return false, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	var n int
+	err := s.db.QueryRowContext(ctx,
+		`SELECT count(*) FROM revoked_tokens WHERE id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...).Scan(&n)
+	return n > 0, err
+}
+
+func (s *sqliteTokenStore) PurgeExpired(ctx context.Context, now time.Time) (int64, error) {
+	var total int64
+	for _, table := range []string{"refresh_tokens", "revoked_tokens"} {
+		res, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE expires_at <= ?`, now.UnixNano())
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+// sqliteUserRepository 是 UserRepository 的 SQLite 实现
+type sqliteUserRepository struct {
+	db *sql.DB
+}
+
+func (r *sqliteUserRepository) Get(ctx context.Context, username string) (*User, error) {
+	var u User
+	err := r.db.QueryRowContext(ctx,
+		`SELECT username, password, age, gender FROM users WHERE username = ?`, username).
+		Scan(&u.Username, &u.Password, &u.Age, &u.Gender)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (r *sqliteUserRepository) Create(ctx context.Context, u *User) error {
+	res, err := r.db.ExecContext(ctx,
+		`INSERT INTO users (username, password, age, gender) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (username) DO NOTHING`,
+		u.Username, u.Password, u.Age, u.Gender)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUserExists
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestSQLite 打开一个临时内存库
+func newTestSQLite(t *testing.T) *sqlitePostRepository {
+	t.Helper()
+	db, err := openSQLite(context.Background(), ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &sqlitePostRepository{db: db}
+}
+
+// SQLite 后端的搜索结果（顺序、总数、距离）必须与内存后端一致
+func TestSQLiteSearchMatchesMemory(t *testing.T) {
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tagged := func(p PostWithID, lang, city, region, country string, tags ...string) PostWithID {
+		p.Lang, p.City, p.Region, p.Country, p.Tags = lang, city, region, country, tags
+		return p
+	}
+	deleted := at("deleted", 40.71, -74.0, "deleted coffee")
+	deleted.DeletedAt = &past
+	expired := at("expired", 40.71, -74.0, "expired coffee")
+	expired.ExpiresAt = &past
+	live := at("live", 40.72, -74.0, "coffee until tonight")
+	live.ExpiresAt = &future
+	moved := at("moved", 51.5, -0.12, "moved post")
+	// 编辑（最后写入）不改变发帖时间，因此不会排到最前
+	edited := tagged(at("moved", 48.85, 2.35, "moved post"), langEnglish, "Paris", "Île-de-France", "FR")
+	edited.CreatedAt = moved.CreatedAt
+
+	posts := []PostWithID{
+		tagged(at("nyc", 40.7128, -74.0060, "coffee in manhattan #NYC"), langEnglish, "New York City", "New York", "US", "nyc"),
+		tagged(at("brooklyn", 40.6782, -73.9442, "pizza and dogs in brooklyn"), langEnglish, "Brooklyn", "New York", "US"),
+		tagged(at("boston", 42.3601, -71.0589, "coffee in boston #coffee"), langEnglish, "Boston", "Massachusetts", "US", "coffee"),
+		tagged(at("beijing", 39.9042, 116.4074, "今天在北京喝咖啡"), langChinese, "Beijing", "Beijing", "CN"),
+		tagged(at("fiji", -17.7, 179.5, "beach east of the date line"), langEnglish, "", "", "FJ"),
+		tagged(at("samoa", -13.8, -172.1, "beach west of the date line"), langEnglish, "", "", "WS"),
+		moved,
+		deleted, expired, live,
+		edited,
+	}
+	mem, lite := newMemoryPostRepository(), newTestSQLite(t)
+	for _, repo := range []PostRepository{mem, lite} {
+		for i := range posts {
+			p := posts[i].Post
+			if err := repo.Save(ctx, posts[i].ID, &p); err != nil {
+				t.Fatalf("save %s: %v", posts[i].ID, err)
+			}
+		}
+	}
+
+	queries := []string{
+		"lat=40.7&lon=-74&range=20km",
+		"lat=41.5&lon=-72.5&range=300km",
+		"lat=51.5&lon=-0.12&range=50km", // moved 的旧位置不应再命中
+		"lat=48.85&lon=2.35&range=10km",
+		"mode=viewport&n=41&s=40&e=-73&w=-75",
+		"mode=viewport&n=0&s=-20&e=-170&w=170",
+		"mode=viewport&n=90&s=-90&e=180&w=-180",
+		"mode=nearest&lat=40.7&lon=-74&k=3",
+		"mode=nearest&lat=-15&lon=180&k=2",
+		"mode=nearest&lat=0&lon=0&k=20",
+		"lat=41.5&lon=-72.5&range=500km&q=coffee",
+		"lat=41.5&lon=-72.5&range=500km&q=coffee+boston",
+		"lat=41.5&lon=-72.5&range=500km&q=dog",
+		"lat=40&lon=116&range=200km&q=咖啡",
+		"mode=viewport&n=90&s=-90&e=180&w=-180&tag=coffee",
+		"mode=viewport&n=90&s=-90&e=180&w=-180&tag=coffee,nyc",
+		"mode=viewport&n=90&s=-90&e=180&w=-180&lang=zh",
+		"mode=viewport&n=90&s=-90&e=180&w=-180&region=new+york",
+		"mode=viewport&n=90&s=-90&e=180&w=-180&country=us&limit=2&offset=1",
+		"mode=nearest&lat=40.7&lon=-74&k=5&country=US",
+	}
+	for _, query := range queries {
+		q, _ := url.ParseQuery(query)
+		p, err := parseSearchParams(q)
+		if err != nil {
+			t.Fatalf("parseSearchParams(%q): %v", query, err)
+		}
+		want, wantTotal, err := mem.Search(ctx, p)
+		if err != nil {
+			t.Fatalf("memory Search(%q): %v", query, err)
+		}
+		got, total, err := lite.Search(ctx, p)
+		if err != nil {
+			t.Fatalf("sqlite Search(%q): %v", query, err)
+		}
+		if !reflect.DeepEqual(resultIDs(got), resultIDs(want)) || total != wantTotal {
+			t.Errorf("%s: sqlite = %v (total %d), memory = %v (total %d)",
+				query, resultIDs(got), total, resultIDs(want), wantTotal)
+			continue
+		}
+		for i := range got {
+			if (got[i].DistanceMeters == nil) != (want[i].DistanceMeters == nil) ||
+				got[i].DistanceMeters != nil && *got[i].DistanceMeters != *want[i].DistanceMeters {
+				t.Errorf("%s: distance of %s differs", query, got[i].ID)
+			}
+		}
+	}
+}
+
+// 两个后端都按发帖时间排列：编辑过的帖子保持原来的位置
+func TestEditKeepsSearchOrder(t *testing.T) {
+	for name, repo := range map[string]func(t *testing.T) PostRepository{
+		"memory": func(t *testing.T) PostRepository { return newMemoryPostRepository() },
+		"sqlite": func(t *testing.T) PostRepository { return newTestSQLite(t) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			useMemoryStorage(t)
+			postRepo = repo(t)
+			mux := newTestMux()
+			kimi := loginAs(t, mux, "kimi")
+			seedPosts(t, at("older", 40.71, -74.0, "older post"), at("newer", 40.72, -74.0, "newer post"))
+
+			edit := map[string]string{"message": "older post, edited"}
+			if code := doJSON(t, mux, http.MethodPatch, "/post/older", kimi, edit, nil); code != http.StatusOK {
+				t.Fatalf("PATCH: status %d", code)
+			}
+			var found SearchResponse
+			if code := doJSON(t, mux, http.MethodGet, "/search?lat=40.7&lon=-74&range=10km", kimi, nil, &found); code != http.StatusOK {
+				t.Fatalf("GET /search: status %d", code)
+			}
+			if got := resultIDs(found.Results); !reflect.DeepEqual(got, []string{"newer", "older"}) {
+				t.Errorf("results after editing = %v, want [newer older]", got)
+			}
+		})
+	}
+}
+
+// 图片地址被帖子或修订历史引用都算在用
+func TestURLInUseCountsRevisions(t *testing.T) {
+	ctx := context.Background()
+	for name, repo := range map[string]PostRepository{"memory": newMemoryPostRepository(), "sqlite": newTestSQLite(t)} {
+		if err := repo.Save(ctx, "p", &Post{User: "kimi", Message: "new", Url: "/uploads/new.jpg"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.AddRevision(ctx, PostRevision{PostID: "p", Revision: 0, Message: "old", Url: "/uploads/old.jpg"}); err != nil {
+			t.Fatal(err)
+		}
+		for url, want := range map[string]bool{"/uploads/new.jpg": true, "/uploads/old.jpg": true, "/uploads/other.jpg": false} {
+			if got, err := repo.URLInUse(ctx, url); err != nil || got != want {
+				t.Errorf("%s: URLInUse(%s) = %v, %v, want %v", name, url, got, err, want)
+			}
+		}
+	}
+}
+
+func TestSQLiteSaveBatchReportsReplaced(t *testing.T) {
+	ctx := context.Background()
+	lite := newTestSQLite(t)
+	if err := lite.Save(ctx, "old", &Post{User: "kimi", Message: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	res := lite.SaveBatch(ctx, []PostWithID{
+		{ID: "old", Post: Post{User: "kimi", Message: "replaced"}},
+		{ID: "new", Post: Post{User: "kimi", Message: "new"}},
+	})
+	if len(res) != 2 || res[0].Err != nil || res[1].Err != nil {
+		t.Fatalf("SaveBatch = %+v", res)
+	}
+	if !res[0].Replaced || res[1].Replaced {
+		t.Errorf("replaced = %v, %v, want true, false", res[0].Replaced, res[1].Replaced)
+	}
+	if p, err := lite.Get(ctx, "old"); err != nil || p.Message != "replaced" {
+		t.Errorf("Get(old) = %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 存储抽象：处理函数只通过 postRepo / userRepo 读写帖子与用户，不直接依赖 Elasticsearch，
+// 因此整个服务可以在没有 ES 集群的情况下（STORAGE_BACKEND=memory 或 sqlite）运行和测试。
+//
+// 相关环境变量：
+//   - STORAGE_BACKEND：elasticsearch（默认）、sqlite（嵌入式数据库文件，见 repo_sqlite.go）
+//     或 memory（进程内存，重启后数据丢失）
+//
+// 保存的搜索、提醒、标签统计与 /suggest 依赖 ES 的 percolator 和聚合，只在 ES 后端下启用。
+
+// 存储后端
+const (
+	backendElasticsearch = "elasticsearch"
+	backendSQLite        = "sqlite"
+	backendMemory        = "memory"
+)
+
+var storageBackend = strings.ToLower(getenvDefault("STORAGE_BACKEND", backendElasticsearch))
+
+var (
+	// ErrPostNotFound 表示帖子不存在
+	ErrPostNotFound = errors.New("post not found")
+	// ErrUserNotFound 表示用户不存在
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserExists 表示用户名已被注册
+	ErrUserExists = errors.New("username already exists")
+	// ErrVersionConflict 表示条件写入时帖子已被修改或删除
+	ErrVersionConflict = errors.New("post version conflict")
+)
+
+// PostRepository 是帖子存储。Search 按 SearchParams.Mode 执行半径（radius）、
+// 矩形视野（viewport，可跨日界线）或最近邻（nearest）查询，并应用关键词、标签、地名与语言过滤；
+// 已软删除（DeletedAt 非空）或已到期（ExpiresAt 不晚于当前时间）的帖子不会出现在搜索结果中，Get 与 Scan 则照常返回。
+// 搜索结果的顺序见 newerFirst（nearest 模式先按距离）。
+type PostRepository interface {
+	// Save 以指定 ID 写入（或覆盖）帖子，返回后立即可被搜索到
+	Save(ctx context.Context, id string, p *Post) error
+	// SaveBatch 批量写入或覆盖（posts 中 ID 互不相同），返回与 posts 一一对应的结果；
+	// 全部写完后统一刷新一次，返回时成功的帖子均可被搜索到
+	SaveBatch(ctx context.Context, posts []PostWithID) []SaveResult
+	// SaveIf 仅当帖子当前版本仍为 ver 时覆盖写入，返回新版本；帖子已被修改或删除时返回 ErrVersionConflict
+	SaveIf(ctx context.Context, id string, p *Post, ver PostVersion) (PostVersion, error)
+	// Get 读取帖子，不存在时返回 ErrPostNotFound
+	Get(ctx context.Context, id string) (*Post, error)
+	// GetVersioned 读取帖子及其当前版本，不存在时返回 ErrPostNotFound
+	GetVersioned(ctx context.Context, id string) (*Post, PostVersion, error)
+	// Delete 删除帖子，不存在时返回 ErrPostNotFound
+	Delete(ctx context.Context, id string) error
+	// Search 返回本页结果与满足条件的总数
+	Search(ctx context.Context, p SearchParams) ([]PostWithID, int64, error)
+	// ListDeleted 返回回收站中的帖子（按删除时间倒序）与总数；user 非空时只返回该用户的帖子
+	ListDeleted(ctx context.Context, user string, limit, offset int) ([]PostWithID, int64, error)
+	// PurgeDeleted 永久删除在 before 之前被删除的帖子及其修订历史，返回被删除的帖子（调用方据此清理图片）
+	PurgeDeleted(ctx context.Context, before time.Time) ([]PurgedPost, error)
+	// ListExpired 返回到期时间不晚于 now 的帖子（按到期时间升序，至多 limit 条）；
+	// 回收站中的帖子不在其中，它们按 TRASH_RETENTION 保留，由回收站清理任务删除
+	ListExpired(ctx context.Context, now time.Time, limit int) ([]PostWithID, error)
+	// URLInUse 判断是否有帖子（包括回收站中的帖子）或修订历史引用了图片地址 url
+	URLInUse(ctx context.Context, url string) (bool, error)
+	// AddRevision 写入一条修订记录（同一帖子同一版本号重复写入时覆盖）
+	AddRevision(ctx context.Context, rev PostRevision) error
+	// ListRevisions 按版本号升序返回帖子的修订历史；Delete 与 PurgeDeleted 会一并删除修订历史
+	ListRevisions(ctx context.Context, postID string) ([]PostRevision, error)
+	// Scan 按写入顺序（ES 后端为索引内部顺序）逐条遍历全部帖子，fn 返回错误时停止
+	Scan(ctx context.Context, fn func(PostWithID) error) error
+}
+
+// SaveResult 是 SaveBatch 中一条帖子的写入结果
+type SaveResult struct {
+	Err      error // nil 表示成功
+	Replaced bool  // 覆盖了已存在的同 ID 帖子
+}
+
+// UserRepository 是注册用户存储，用户名即主键
+type UserRepository interface {
+	// Get 读取用户，不存在时返回 ErrUserNotFound
+	Get(ctx context.Context, username string) (*User, error)
+	// Create 新建用户，用户名已存在时返回 ErrUserExists
+	Create(ctx context.Context, u *User) error
+}
+
+// 当前使用的存储，在 main() 中按 STORAGE_BACKEND 初始化
+var (
+	postRepo PostRepository
+	userRepo UserRepository
+)
+
+// openRepositories 按 STORAGE_BACKEND 初始化存储；ES 后端会同时创建/升级所需索引
+func openRepositories(ctx context.Context) error {
+	switch storageBackend {
+	case backendMemory:
+		postRepo = newMemoryPostRepository()
+		userRepo = newMemoryUserRepository()
+		changeLog = &memoryChangeLog{}
+		tokenStore = newMemoryTokenStore()
+		return nil
+	case backendSQLite:
+		db, err := openSQLite(ctx, sqlitePath)
+		if err != nil {
+			return err
+		}
+		postRepo = &sqlitePostRepository{db: db}
+		userRepo = &sqliteUserRepository{db: db}
+		changeLog = &sqliteChangeLog{db: db}
+		tokenStore = &sqliteTokenStore{db: db}
+		return nil
+	case backendElasticsearch:
+		client, err := initElasticsearch(ctx)
+		if err != nil {
+			return err
+		}
+		esClient = client
+		postRepo = &esPostRepository{client: client}
+		userRepo = &esUserRepository{client: client}
+		changeLog = &esChangeLog{client: client}
+		tokenStore = &esTokenStore{client: client}
+		return nil
+	default:
+		return fmt.Errorf("unknown STORAGE_BACKEND %q (want %s, %s or %s)", storageBackend, backendElasticsearch, backendSQLite, backendMemory)
+	}
+}
+
+// PurgedPost 是被永久删除的帖子；RevisionURLs 为其修订历史中引用的图片，与帖子一同失去引用
+type PurgedPost struct {
+	PostWithID
+	RevisionURLs []string
+}
+
+// newerFirst 是所有后端共同的搜索结果顺序：发帖时间新的在前，没有发帖时间的在最后，同一时间按 ID 升序
+func newerFirst(a, b *PostWithID) bool {
+	switch {
+	case a.CreatedAt == nil || b.CreatedAt == nil:
+		if (a.CreatedAt == nil) != (b.CreatedAt == nil) {
+			return b.CreatedAt == nil
+		}
+	case !a.CreatedAt.Equal(*b.CreatedAt):
+		return a.CreatedAt.After(*b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
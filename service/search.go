@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// 搜索模式
+const (
+	modeRadius   = "radius"
+	modeViewport = "viewport"
+	modeNearest  = "nearest"
+)
+
+const (
+	defaultSearchLimit = 200
+	maxSearchLimit     = 1000
+	// maxResultWindow 对应 ES 默认的 index.max_result_window：offset + limit 不能超过它
+	maxResultWindow = 10000
+)
+
+// SearchParams 是校验、规范化之后的 /search 参数；
+// 既用于构造 ES 查询，也原样回显在响应的 query 字段中，便于客户端确认服务端实际执行的条件。
+type SearchParams struct {
+	Mode     string    `json:"mode"`
+	Center   *Location `json:"center,omitempty"`   // radius / nearest 模式的中心点
+	RangeM   float64   `json:"range_m,omitempty"`  // radius 模式的半径（米）
+	Viewport *Viewport `json:"viewport,omitempty"` // viewport 模式的视野
+	Place    *Place    `json:"place,omitempty"`    // 由 place= / place_id= 解析出的地点
+	K        int       `json:"k,omitempty"`        // nearest 模式的条数
+	Limit    int       `json:"limit"`
+	Offset   int       `json:"offset"`
+	Keywords string    `json:"q,omitempty"`
+	Lang     string    `json:"lang,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	City     string    `json:"city,omitempty"`
+	Region   string    `json:"region,omitempty"`
+	Country  string    `json:"country,omitempty"`
+}
+
+// parseSearchParams 解析并校验 /search 的全部参数（规则见各 parseXxx 函数）：
+//  1. 默认圆形半径模式（lat/lon/range）
+//  2. 视野模式（mode=viewport + n/s/e/w），指定了 place 时取以该地为中心、边长 2×range 的方框
+//  3. 最近邻模式（mode=nearest + lat/lon/k）不限半径，按距离升序取前 k 条
+//
+// place= / place_id= 解析出的城市坐标代替 lat/lon 作为搜索中心。
+func parseSearchParams(query url.Values) (SearchParams, error) {
+	var p SearchParams
+	var err error
+
+	// Optional max results (default 200, max 1000) 与分页偏移
+	if p.Limit, err = parseLimit("limit", query.Get("limit"), defaultSearchLimit, maxSearchLimit); err != nil {
+		return p, err
+	}
+	if p.Offset, err = parseOffset("offset", query.Get("offset"), maxResultWindow); err != nil {
+		return p, err
+	}
+
+	// 可选的标签过滤（tag=a&tag=b 或 tag=a,b）
+	if p.Tags, err = parseTagFilter(query); err != nil {
+		return p, err
+	}
+	p.Keywords = strings.TrimSpace(query.Get("q"))
+	p.Lang = strings.ToLower(strings.TrimSpace(query.Get("lang")))
+	p.City = strings.TrimSpace(query.Get("city"))
+	p.Region = strings.TrimSpace(query.Get("region"))
+	p.Country = strings.TrimSpace(query.Get("country"))
+
+	if p.Place, err = resolvePlace(query); err != nil {
+		return p, err
+	}
+	center := func() (*Location, error) {
+		if p.Place != nil {
+			loc := p.Place.Location
+			return &loc, nil
+		}
+		loc, err := parseLocation(query.Get("lat"), query.Get("lon"))
+		return &loc, err
+	}
+
+	p.Mode = strings.ToLower(query.Get("mode"))
+	switch p.Mode {
+	case modeViewport:
+		var vp Viewport
+		if p.Place != nil {
+			dist, err := parseRange(query)
+			if err != nil {
+				return p, err
+			}
+			vp = viewportAround(p.Place.Location, dist)
+		} else if vp, err = parseViewport(query); err != nil {
+			// 读取四至（北 South 东 West），校验并规范化（纬度截断、经度折回）
+			return p, err
+		}
+		p.Viewport = &vp
+	case "", modeRadius:
+		// 默认圆形距离查询：lat/lon 必填，range 支持 m/km/mi 后缀（纯数字按公里）
+		p.Mode = modeRadius
+		if p.Center, err = center(); err != nil {
+			return p, err
+		}
+		dist, err := parseRange(query)
+		if err != nil {
+			return p, err
+		}
+		p.RangeM = float64(dist)
+	case modeNearest:
+		// 稀疏地区固定半径可能一条都搜不到，这里改为按距离排序取最近的 k 条（默认 10，最多 1000）；
+		// 条数只由 k 决定，也没有翻页，显式给出的 limit / offset 视为参数错误而不是悄悄忽略
+		for _, f := range []string{"limit", "offset"} {
+			if strings.TrimSpace(query.Get(f)) != "" {
+				return p, invalidParam(f, "not supported with mode=nearest; use k")
+			}
+		}
+		if p.Center, err = center(); err != nil {
+			return p, err
+		}
+		if p.K, err = parseLimit("k", query.Get("k"), 10, maxSearchLimit); err != nil {
+			return p, err
+		}
+		p.Limit = p.K
+	default:
+		return p, invalidParam("mode", "must be one of: radius, viewport, nearest")
+	}
+
+	if p.Offset+p.Limit > maxResultWindow {
+		return p, outOfRange("offset", "offset + limit must not exceed 10000")
+	}
+	return p, nil
+}
+
+// esQuery 将参数转换为 ES 查询；nearest 模式额外返回按距离排序的 Sorter
+func (p SearchParams) esQuery() (elastic.Query, elastic.Sorter) {
+	var q elastic.Query
+	var sorter elastic.Sorter
+	switch p.Mode {
+	case modeViewport:
+		// 视野模式使用 geo_bounding_box；跨日界线时拆成两个矩形
+		q = viewportQuery("location", *p.Viewport)
+	case modeNearest:
+		q = elastic.NewMatchAllQuery()
+		sorter = nearestSort("location", *p.Center)
+	default:
+		q = elastic.NewGeoDistanceQuery("location").
+			Distance(Distance(p.RangeM).String()).
+			Lat(p.Center.Lat).
+			Lon(p.Center.Lon)
+	}
+
+	// 可选的关键词（q=）：参与评分
+	if p.Keywords != "" {
+		q = elastic.NewBoolQuery().Must(q, keywordQuery(p.Keywords))
+	}
+
+	// 追加标签、地名与语言过滤
+	filters := tagFilters(p.Tags)
+	for _, f := range [][2]string{{"city", p.City}, {"region", p.Region}, {"country", p.Country}} {
+		if f[1] != "" {
+			filters = append(filters, elastic.NewTermQuery(f[0], f[1]).CaseInsensitive(true))
+		}
+	}
+	if p.Lang != "" {
+		filters = append(filters, elastic.NewTermQuery("lang", p.Lang))
+	}
+	return visibleOnly(withFilters(q, filters)), sorter
+}
+
+// visibleOnly 排除已软删除与已到期的帖子；面向用户的帖子查询（搜索、标签、联想）都要经过它
+func visibleOnly(q elastic.Query) elastic.Query {
+	return elastic.NewBoolQuery().Must(q).MustNot(
+		elastic.NewExistsQuery("deleted_at"),
+		elastic.NewRangeQuery("expires_at").Lte("now"),
+	)
+}
+
+// withFilters 在已有查询上追加过滤条件（filters 为空时原样返回）
+func withFilters(q elastic.Query, filters []elastic.Query) elastic.Query {
+	if len(filters) == 0 {
+		return q
+	}
+	return elastic.NewBoolQuery().Must(q).Filter(filters...)
+}
+
+// Pagination 描述本页在全部结果中的位置；NextOffset 为 nil 表示没有下一页
+type Pagination struct {
+	Offset     int  `json:"offset"`
+	Limit      int  `json:"limit"`
+	NextOffset *int `json:"next_offset"`
+}
+
+// SearchResponse 是 /search 的响应信封
+type SearchResponse struct {
+	Total      int64        `json:"total"`     // 满足条件的帖子总数
+	Returned   int          `json:"returned"`  // 本次返回的条数
+	TookMs     int64        `json:"took_ms"`   // 服务端处理耗时（毫秒）
+	Truncated  bool         `json:"truncated"` // 是否还有未返回的结果（被 limit 截断）
+	Cached     bool         `json:"cached"`    // 是否来自进程内缓存
+	Query      SearchParams `json:"query"`
+	Pagination Pagination   `json:"pagination"`
+	Results    []PostWithID `json:"results"`
+}
+
+// newSearchResponse 根据结果与总数组装信封。
+// nearest 模式的结果集就是“最近的 k 条”：total 不超过 k，因此只要返回了全部 k 条就不算截断
+func newSearchResponse(p SearchParams, results []PostWithID, total int64, started time.Time) SearchResponse {
+	if results == nil {
+		results = []PostWithID{}
+	}
+	if p.Mode == modeNearest && total > int64(p.K) {
+		total = int64(p.K)
+	}
+	resp := SearchResponse{
+		Total:      total,
+		Returned:   len(results),
+		TookMs:     time.Since(started).Milliseconds(),
+		Query:      p,
+		Pagination: Pagination{Offset: p.Offset, Limit: p.Limit},
+		Results:    results,
+	}
+	if end := int64(p.Offset + len(results)); end < total {
+		resp.Truncated = true
+		if p.Mode != modeNearest && end < maxResultWindow {
+			next := int(end)
+			resp.Pagination.NextOffset = &next
+		}
+	}
+	return resp
+}
+
+// arrayMediaType 是旧版裸数组响应的 Accept 类型
+const arrayMediaType = "application/vnd.geoconnect.array+json"
+
+// wantsBareArray 判断客户端是否要求旧的裸数组响应：?format=array 或 Accept 中声明 arrayMediaType
+func wantsBareArray(r *http.Request) bool {
+	if strings.EqualFold(r.URL.Query().Get("format"), "array") {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), arrayMediaType)
+}
+
+// cachedSearch 先查缓存，未命中时调用 postRepo.Search 并写入缓存。
+// 视野模式（且不翻页）时按对齐到网格的视野一次取回最多 maxSearchLimit 条，再裁剪回真实视野并截取 limit 条；
+// 若对齐后的视野结果本身被截断，裁剪结果可能不完整，此时退回按真实视野精确查询。
+func cachedSearch(ctx context.Context, p SearchParams) ([]PostWithID, int64, bool, error) {
+	if !searchCache.Enabled() {
+		out, total, err := postRepo.Search(ctx, p)
+		return out, total, false, err
+	}
+
+	if p.Mode == modeViewport && p.Offset == 0 {
+		sp := p
+		sv := snapViewport(*p.Viewport)
+		sp.Viewport = &sv
+		sp.Limit = maxSearchLimit
+		key := cacheKey(sp)
+
+		e, hit := searchCache.Get(key)
+		if !hit {
+			out, total, err := postRepo.Search(ctx, sp)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			searchCache.Put(key, sp.coverage(), out, total)
+			e = &cacheEntry{results: out, total: total}
+		}
+		if e.total <= int64(len(e.results)) {
+			var clipped []PostWithID
+			for _, post := range e.results {
+				if p.Viewport.Contains(post.Location) {
+					clipped = append(clipped, post)
+				}
+			}
+			total := int64(len(clipped))
+			if len(clipped) > p.Limit {
+				clipped = clipped[:p.Limit]
+			}
+			return clipped, total, hit, nil
+		}
+	}
+
+	key := cacheKey(p)
+	if e, ok := searchCache.Get(key); ok {
+		return e.results, e.total, true, nil
+	}
+	out, total, err := postRepo.Search(ctx, p)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	searchCache.Put(key, p.coverage(), out, total)
+	return out, total, false, nil
+}
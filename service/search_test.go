@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// useMemoryStorage 把全局存储换成全新的内存实现，并关闭搜索缓存；测试结束后恢复
+func useMemoryStorage(t *testing.T) *memoryPostRepository {
+	t.Helper()
+	oldPosts, oldUsers, oldChanges, oldTokens, oldCache := postRepo, userRepo, changeLog, tokenStore, searchCache
+	oldKeys := jwtKeys.Load()
+	t.Cleanup(func() {
+		postRepo, userRepo, changeLog, tokenStore, searchCache = oldPosts, oldUsers, oldChanges, oldTokens, oldCache
+		jwtKeys.Store(oldKeys)
+	})
+	repo := newMemoryPostRepository()
+	postRepo = repo
+	userRepo = newMemoryUserRepository()
+	changeLog = &memoryChangeLog{}
+	tokenStore = newMemoryTokenStore()
+	searchCache = newSearchCache(0, 0)
+	jwtKeys.Store(&keyRing{keys: []signingKey{{ID: "test", Secret: "test-secret-test-secret-test-secret"}}, source: "test"})
+	return repo
+}
+
+// seedPosts 按顺序写入帖子
+func seedPosts(t *testing.T, posts ...PostWithID) {
+	t.Helper()
+	for i := range posts {
+		if err := postRepo.Save(context.Background(), posts[i].ID, &posts[i].Post); err != nil {
+			t.Fatalf("save %s: %v", posts[i].ID, err)
+		}
+	}
+}
+
+// postClock 为 at 生成的帖子分配递增的发帖时间：后创建的帖子在搜索结果中排前
+var postClock = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func at(id string, lat, lon float64, message string) PostWithID {
+	postClock = postClock.Add(time.Second)
+	created := postClock
+	return PostWithID{ID: id, Post: Post{User: "kimi", Message: message, Location: Location{Lat: lat, Lon: lon}, CreatedAt: &created}}
+}
+
+func resultIDs(posts []PostWithID) []string {
+	ids := make([]string, 0, len(posts))
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func TestMemorySearchModes(t *testing.T) {
+	useMemoryStorage(t)
+	past := time.Now().Add(-time.Hour)
+	deleted := at("deleted", 40.71, -74.0, "deleted coffee")
+	deleted.DeletedAt = &past
+	expired := at("expired", 40.71, -74.0, "expired coffee")
+	expired.ExpiresAt = &past
+	seedPosts(t,
+		at("nyc", 40.7128, -74.0060, "coffee in manhattan"),
+		at("brooklyn", 40.6782, -73.9442, "pizza in brooklyn"),
+		at("boston", 42.3601, -71.0589, "coffee in boston"),
+		at("fiji", -17.7, 179.5, "beach east of the date line"),
+		at("samoa", -13.8, -172.1, "beach west of the date line"),
+		deleted,
+		expired,
+	)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+		total int64
+	}{
+		{"radius", "lat=40.7&lon=-74&range=20km", []string{"brooklyn", "nyc"}, 2},
+		{"radius keeps order of writes", "lat=41.5&lon=-72.5&range=300km", []string{"boston", "brooklyn", "nyc"}, 3},
+		{"viewport", "mode=viewport&n=41&s=40&e=-73&w=-75", []string{"brooklyn", "nyc"}, 2},
+		{"viewport crossing antimeridian", "mode=viewport&n=0&s=-20&e=-170&w=170", []string{"samoa", "fiji"}, 2},
+		{"viewport with unwrapped longitudes", "mode=viewport&n=0&s=-20&e=190&w=170", []string{"samoa", "fiji"}, 2},
+		// nearest 不限半径：total 为全部可见帖子数
+		{"nearest", "mode=nearest&lat=40.7&lon=-74&k=3", []string{"nyc", "brooklyn", "boston"}, 5},
+		{"keyword", "lat=41.5&lon=-72.5&range=500km&q=coffee", []string{"boston", "nyc"}, 2},
+		{"keyword needs every word", "lat=41.5&lon=-72.5&range=500km&q=coffee+boston", []string{"boston"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			p, err := parseSearchParams(q)
+			if err != nil {
+				t.Fatalf("parseSearchParams(%q): %v", tt.query, err)
+			}
+			got, total, err := postRepo.Search(context.Background(), p)
+			if err != nil {
+				t.Fatalf("Search: %v", err)
+			}
+			if ids := resultIDs(got); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("ids = %v, want %v", ids, tt.want)
+			}
+			if total != tt.total {
+				t.Errorf("total = %d, want %d", total, tt.total)
+			}
+		})
+	}
+}
+
+func TestMemorySearchNearestDistances(t *testing.T) {
+	useMemoryStorage(t)
+	seedPosts(t, at("far", 10, 10, "far"), at("near", 0, 0.01, "near"))
+	q, _ := url.ParseQuery("mode=nearest&lat=0&lon=0&k=5")
+	p, err := parseSearchParams(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := postRepo.Search(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != "near" || got[0].DistanceMeters == nil || got[1].DistanceMeters == nil {
+		t.Fatalf("unexpected results %+v", got)
+	}
+	if d := *got[0].DistanceMeters; d < 1100 || d > 1120 {
+		t.Errorf("distance to near = %.1f m, want about 1113 m", d)
+	}
+	if *got[0].DistanceMeters > *got[1].DistanceMeters {
+		t.Errorf("results not sorted by distance")
+	}
+}
+
+func TestMemorySearchPagination(t *testing.T) {
+	useMemoryStorage(t)
+	var posts []PostWithID
+	for _, id := range []string{"p1", "p2", "p3", "p4", "p5"} {
+		posts = append(posts, at(id, 1, 1, id))
+	}
+	seedPosts(t, posts...)
+
+	tests := []struct {
+		offset, limit int
+		want          []string
+		next          *int
+	}{
+		{0, 2, []string{"p5", "p4"}, intPtr(2)},
+		{2, 2, []string{"p3", "p2"}, intPtr(4)},
+		{4, 2, []string{"p1"}, nil},
+		{5, 2, []string{}, nil},
+	}
+	for _, tt := range tests {
+		p := SearchParams{Mode: modeRadius, Center: &Location{Lat: 1, Lon: 1}, RangeM: 1000, Offset: tt.offset, Limit: tt.limit}
+		got, total, err := postRepo.Search(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := resultIDs(got); !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("offset %d: ids = %v, want %v", tt.offset, ids, tt.want)
+		}
+		if total != 5 {
+			t.Errorf("offset %d: total = %d, want 5", tt.offset, total)
+		}
+		resp := newSearchResponse(p, got, total, time.Now())
+		if !reflect.DeepEqual(resp.Pagination.NextOffset, tt.next) {
+			t.Errorf("offset %d: next_offset = %v, want %v", tt.offset, derefInt(resp.Pagination.NextOffset), derefInt(tt.next))
+		}
+		if resp.Truncated != (tt.next != nil) {
+			t.Errorf("offset %d: truncated = %v", tt.offset, resp.Truncated)
+		}
+	}
+}
+
+func intPtr(n int) *int { return &n }
+
+func derefInt(p *int) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// newTestMux 按 main() 的方式注册主要路由
+func newTestMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signup", signupHandler)
+	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("/post", jwtRequired(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlerPost(w, r)
+		case http.MethodDelete:
+			handlerDeletePost(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/post/", jwtRequired(handlerPostByID))
+	mux.HandleFunc("/search", jwtRequired(handlerSearch))
+	mux.HandleFunc("/delete", jwtRequired(handlerDeletePost))
+	mux.HandleFunc("/trash", jwtRequired(handlerTrash))
+	return mux
+}
+
+// doJSON 发送请求并把响应体解码到 out（out 为 nil 时忽略响应体），返回状态码
+func doJSON(t *testing.T, h http.Handler, method, target, token string, body, out interface{}) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, target, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %q: %v", method, target, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// loginAs 注册并登录，返回访问令牌
+func loginAs(t *testing.T, h http.Handler, username string) string {
+	t.Helper()
+	creds := map[string]string{"username": username, "password": "secret"}
+	if code := doJSON(t, h, http.MethodPost, "/signup", "", creds, nil); code != http.StatusOK && code != http.StatusCreated {
+		t.Fatalf("signup %s: status %d", username, code)
+	}
+	var tok TokenResponse
+	if code := doJSON(t, h, http.MethodPost, "/login", "", creds, &tok); code != http.StatusOK {
+		t.Fatalf("login %s: status %d", username, code)
+	}
+	return tok.Token
+}
+
+func TestHandlersPostSearchEditDelete(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTestMux()
+	kimi := loginAs(t, mux, "kimi")
+	other := loginAs(t, mux, "other")
+
+	post := map[string]interface{}{"message": "coffee #NYC", "location": map[string]float64{"lat": 40.7128, "lon": -74.006}}
+	if code := doJSON(t, mux, http.MethodPost, "/post", kimi, post, nil); code != http.StatusOK {
+		t.Fatalf("POST /post: status %d", code)
+	}
+
+	var found SearchResponse
+	if code := doJSON(t, mux, http.MethodGet, "/search?lat=40.7&lon=-74&range=10km", kimi, nil, &found); code != http.StatusOK {
+		t.Fatalf("GET /search: status %d", code)
+	}
+	if found.Total != 1 || len(found.Results) != 1 {
+		t.Fatalf("search found %d/%d posts, want 1", len(found.Results), found.Total)
+	}
+	got := found.Results[0]
+	if got.User != "kimi" || !reflect.DeepEqual(got.Tags, []string{"nyc"}) || got.Lang != "en" {
+		t.Errorf("unexpected post %+v", got.Post)
+	}
+	id := got.ID
+
+	// 只有作者能编辑
+	edit := map[string]string{"message": "tea #NYC"}
+	if code := doJSON(t, mux, http.MethodPatch, "/post/"+id, other, edit, nil); code != http.StatusForbidden {
+		t.Errorf("PATCH by other user: status %d, want 403", code)
+	}
+	var edited PostWithID
+	if code := doJSON(t, mux, http.MethodPatch, "/post/"+id, kimi, edit, &edited); code != http.StatusOK {
+		t.Fatalf("PATCH /post/%s: status %d", id, code)
+	}
+	if edited.Message != "tea #NYC" || edited.Revision != 1 || !edited.Edited {
+		t.Errorf("unexpected edited post %+v", edited.Post)
+	}
+	var history PostHistory
+	if code := doJSON(t, mux, http.MethodGet, "/post/"+id+"/history", kimi, nil, &history); code != http.StatusOK {
+		t.Fatalf("GET history: status %d", code)
+	}
+	if len(history.Revisions) != 2 || history.Revisions[0].Message != "coffee #NYC" {
+		t.Errorf("unexpected history %+v", history.Revisions)
+	}
+
+	// 删除后进入回收站，搜索不到
+	if code := doJSON(t, mux, http.MethodDelete, "/delete?id="+id, other, nil, nil); code != http.StatusForbidden {
+		t.Errorf("DELETE by other user: status %d, want 403", code)
+	}
+	if code := doJSON(t, mux, http.MethodDelete, "/delete?id="+id, kimi, nil, nil); code != http.StatusOK {
+		t.Fatalf("DELETE: status %d", code)
+	}
+	if code := doJSON(t, mux, http.MethodGet, "/search?lat=40.7&lon=-74&range=10km", kimi, nil, &found); code != http.StatusOK || found.Total != 0 {
+		t.Errorf("search after delete: status %d, total %d", code, found.Total)
+	}
+	var trash TrashResponse
+	if code := doJSON(t, mux, http.MethodGet, "/trash", kimi, nil, &trash); code != http.StatusOK {
+		t.Fatalf("GET /trash: status %d", code)
+	}
+	if len(trash.Results) != 1 || trash.Results[0].ID != id || trash.Results[0].PurgeAt == nil {
+		t.Errorf("trash = %+v, want post %s with purge_at", trash.Results, id)
+	}
+
+	// 变更流按顺序记录了发帖、编辑与删除
+	events, err := changeLog.Since(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	if want := []string{changeCreated, changeUpdated, changeDeleted}; !reflect.DeepEqual(types, want) {
+		t.Errorf("change types = %v, want %v", types, want)
+	}
+}
+
+func TestSearchHandlerErrors(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTestMux()
+	token := loginAs(t, mux, "kimi")
+
+	tests := []struct {
+		name   string
+		target string
+		token  string
+		status int
+	}{
+		{"missing token", "/search?lat=1&lon=1", "", http.StatusUnauthorized},
+		{"bad token", "/search?lat=1&lon=1", "not-a-jwt", http.StatusUnauthorized},
+		{"missing lat", "/search?lon=1", token, http.StatusBadRequest},
+		{"lat out of range", "/search?lat=91&lon=1", token, http.StatusBadRequest},
+		{"bad range", "/search?lat=1&lon=1&range=far", token, http.StatusBadRequest},
+		{"bad mode", "/search?mode=square&lat=1&lon=1", token, http.StatusBadRequest},
+		{"viewport south above north", "/search?mode=viewport&n=1&s=2&e=1&w=0", token, http.StatusBadRequest},
+		{"window too deep", "/search?lat=1&lon=1&offset=9990&limit=20", token, http.StatusBadRequest},
+		{"limit with nearest", "/search?mode=nearest&lat=1&lon=1&k=5&limit=5", token, http.StatusBadRequest},
+		{"offset with nearest", "/search?mode=nearest&lat=1&lon=1&offset=0", token, http.StatusBadRequest},
+		{"nearest", "/search?mode=nearest&lat=1&lon=1&k=5", token, http.StatusOK},
+		{"ok", "/search?lat=1&lon=1", token, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := doJSON(t, mux, http.MethodGet, tt.target, tt.token, nil, nil); code != tt.status {
+				t.Errorf("status = %d, want %d", code, tt.status)
+			}
+		})
+	}
+}
+
+// nearest 的 total 与 truncated 相对于 k：取满 k 条不算截断，匹配不足 k 条时 total 为实际条数
+func TestSearchHandlerNearestTotal(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTestMux()
+	token := loginAs(t, mux, "kimi")
+	seedPosts(t, at("a", 0, 1, "a"), at("b", 0, 2, "b"), at("c", 0, 3, "c"))
+
+	tests := []struct {
+		k     string
+		total int64
+		ids   []string
+	}{
+		{"2", 2, []string{"a", "b"}},
+		{"3", 3, []string{"a", "b", "c"}},
+		{"10", 3, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		var resp SearchResponse
+		if code := doJSON(t, mux, http.MethodGet, "/search?mode=nearest&lat=0&lon=0&k="+tt.k, token, nil, &resp); code != http.StatusOK {
+			t.Fatalf("k=%s: status %d", tt.k, code)
+		}
+		if resp.Total != tt.total || resp.Truncated || resp.Pagination.NextOffset != nil {
+			t.Errorf("k=%s: total %d, truncated %v, next %v; want total %d and no more pages",
+				tt.k, resp.Total, resp.Truncated, derefInt(resp.Pagination.NextOffset), tt.total)
+		}
+		if ids := resultIDs(resp.Results); !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("k=%s: ids = %v, want %v", tt.k, ids, tt.ids)
+		}
+	}
+}
+
+func TestSearchHandlerBareArray(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTestMux()
+	token := loginAs(t, mux, "kimi")
+	seedPosts(t, at("a", 1, 1, "a"), at("b", 1, 1, "b"))
+
+	var arr []PostWithID
+	if code := doJSON(t, mux, http.MethodGet, "/search?lat=1&lon=1&format=array", token, nil, &arr); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	ids := resultIDs(arr)
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("ids = %v", ids)
+	}
+}
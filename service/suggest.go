@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// 搜索联想（/suggest）：根据用户输入的前缀补全
+//   - terms：帖子正文里的常用词，基于 message.suggest（search_as_you_type，内部为 edge-ngram 前缀子字段）
+//   - tags ：以该前缀开头的热门 #标签（tags 字段的 terms 聚合）
+//   - users：以该前缀开头的用户名（有视野时取视野内发过帖的用户，否则查 users 索引）
+// 提供 n/s/e/w 时，terms/tags/users 都只统计视野内的帖子。
+
+const (
+	defaultSuggestSize = 5
+	maxSuggestSize     = 20
+	// 用于提取候选词的匹配帖子数量
+	suggestSampleSize = 100
+)
+
+// Suggestion 是一个补全候选及其出现次数（帖子数）
+type Suggestion struct {
+	Text  string `json:"text"`
+	Count int64  `json:"count,omitempty"`
+}
+
+// SuggestResponse 是 /suggest 的响应
+type SuggestResponse struct {
+	Terms []Suggestion `json:"terms"`
+	Tags  []Suggestion `json:"tags"`
+	Users []Suggestion `json:"users"`
+}
+
+// luceneRegexSpecial 是 Lucene 正则里需要转义的字符（terms 聚合 include 参数使用 Lucene 正则）
+var luceneRegexSpecial = regexp.MustCompile(`[.?+*|{}\[\]()"\\#@&<>~^$]`)
+
+// prefixRegex 生成 "前缀.*" 形式的 Lucene 正则
+func prefixRegex(prefix string) string {
+	return luceneRegexSpecial.ReplaceAllString(prefix, `\$0`) + ".*"
+}
+
+// hasViewportParams 判断是否提供了视野参数（任意一个存在即视为提供，缺少其余参数会在解析时报错）
+func hasViewportParams(q url.Values) bool {
+	for _, k := range []string{"n", "s", "e", "w"} {
+		if q.Get(k) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerSuggest：GET /suggest?q=<prefix>[&n=&s=&e=&w=][&size=]
+func handlerSuggest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	prefix := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(query.Get("q")), "#")))
+	if prefix == "" {
+		writeError(w, http.StatusBadRequest, missingParam("q"))
+		return
+	}
+	size, err := parseLimit("size", query.Get("size"), defaultSuggestSize, maxSuggestSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var vp *Viewport
+	if hasViewportParams(query) {
+		v, err := parseViewport(query)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		vp = &v
+	}
+
+	// 一次查询同时完成：正文前缀匹配（取样本帖子提取候选词）+ 标签/用户名前缀聚合。
+	// 样本只取前缀匹配的帖子（must）；聚合放在 global 下，统计视野内的全部帖子，不受前缀匹配限制
+	area := visibleOnly(elastic.NewMatchAllQuery())
+	if vp != nil {
+		area = visibleOnly(viewportQuery("location", *vp))
+	}
+	textMatch := elastic.NewMultiMatchQuery(prefix, "message.suggest", "message.suggest._2gram", "message.suggest._3gram").
+		Type("bool_prefix")
+	include := prefixRegex(prefix)
+	aggs := elastic.NewGlobalAggregation().SubAggregation("area", elastic.NewFilterAggregation().Filter(area).
+		SubAggregation("tags", elastic.NewTermsAggregation().Field("tags").Include(include).Size(size)).
+		SubAggregation("users", elastic.NewTermsAggregation().Field("user").Include(include).Size(size)))
+	res, err := esClient.Search().
+		Index(INDEX).
+		Query(elastic.NewBoolQuery().Must(textMatch).Filter(area)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("message")).
+		Aggregation("all", aggs).
+		Size(suggestSampleSize).
+		Do(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out := SuggestResponse{Terms: []Suggestion{}, Tags: []Suggestion{}, Users: []Suggestion{}}
+	out.Terms = termsFromHits(res.Hits.Hits, prefix, size)
+	if all, found := res.Aggregations.Global("all"); found {
+		if area, found := all.Aggregations.Filter("area"); found {
+			out.Tags = bucketSuggestions(area.Aggregations, "tags")
+			if vp != nil {
+				out.Users = bucketSuggestions(area.Aggregations, "users")
+			}
+		}
+	}
+
+	// 无视野时直接按前缀查注册用户（username 为 keyword，前缀查询开销很小）
+	if vp == nil {
+		users, err := esClient.Search().
+			Index(USERS_INDEX).
+			Query(elastic.NewPrefixQuery("username", prefix)).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Include("username")).
+			Sort("username", true).
+			Size(size).
+			Do(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, hit := range users.Hits.Hits {
+			var u User
+			if err := json.Unmarshal(hit.Source, &u); err == nil {
+				out.Users = append(out.Users, Suggestion{Text: u.Username})
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// bucketSuggestions 将 terms 聚合的桶转换为补全候选
+func bucketSuggestions(aggs elastic.Aggregations, name string) []Suggestion {
+	out := []Suggestion{}
+	if agg, found := aggs.Terms(name); found {
+		for _, b := range agg.Buckets {
+			if s, ok := b.Key.(string); ok {
+				out = append(out, Suggestion{Text: s, Count: b.DocCount})
+			}
+		}
+	}
+	return out
+}
+
+// termsFromHits 从命中帖子的正文中找出以 prefix 开头的词，按出现的帖子数降序返回前 size 个
+func termsFromHits(hits []*elastic.SearchHit, prefix string, size int) []Suggestion {
+	counts := map[string]int64{}
+	for _, hit := range hits {
+		var p Post
+		if err := json.Unmarshal(hit.Source, &p); err != nil {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, word := range splitWords(strings.ToLower(p.Message)) {
+			if strings.HasPrefix(word, prefix) && !seen[word] {
+				seen[word] = true
+				counts[word]++
+			}
+		}
+	}
+
+	out := make([]Suggestion, 0, len(counts))
+	for t, c := range counts {
+		out = append(out, Suggestion{Text: t, Count: c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Text < out[j].Text
+	})
+	if len(out) > size {
+		out = out[:size]
+	}
+	return out
+}
+
+// backfillMessageSuggest 让旧帖子补上新增的 message.suggest 子字段：
+// 对缺少该子字段的文档执行不带脚本的 update_by_query，ES 会按当前 mapping 重新索引它们（异步提交并轮询）。
+func backfillMessageSuggest(ctx context.Context, client *elastic.Client) error {
+	task, err := client.UpdateByQuery(INDEX).
+		Query(elastic.NewBoolQuery().
+			Filter(elastic.NewExistsQuery("message")).
+			MustNot(elastic.NewExistsQuery("message.suggest"))).
+		ProceedOnVersionConflict().
+		DoAsync(ctx)
+	if err != nil {
+		return err
+	}
+	_, updated, err := waitForTask(ctx, client, task.TaskId)
+	if err != nil {
+		return err
+	}
+	if updated > 0 {
+		log.Printf("[migrate] message.suggest backfill: %d post(s) reindexed", updated)
+	}
+	return nil
+}
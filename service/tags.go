@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	// 单条帖子最多提取的标签数，以及单个标签的最大长度
+	maxTagsPerPost = 20
+	maxTagLength   = 64
+)
+
+// hashtagPattern 匹配 "#标签"：# 前必须是开头或非单词字符（避免把 URL 片段 a#b 当成标签），
+// 标签本身由任意语言的字母、数字和下划线组成。
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/])#([\p{L}\p{N}_]+)`)
+
+// extractHashtags 从消息中提取去重后的标签（统一小写、保持出现顺序）
+func extractHashtags(msg string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, m := range hashtagPattern.FindAllStringSubmatch(msg, -1) {
+		t := normalizeTag(m[1])
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		tags = append(tags, t)
+		if len(tags) == maxTagsPerPost {
+			break
+		}
+	}
+	return tags
+}
+
+// normalizeTag 去掉前导 # 并转为小写；超长标签视为无效
+func normalizeTag(t string) string {
+	t = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), "#"))
+	if len([]rune(t)) > maxTagLength {
+		return ""
+	}
+	return t
+}
+
+// parseTagFilter 读取 /search 的 tag 参数：可重复（tag=a&tag=b）或逗号分隔，要求帖子同时带有全部标签
+func parseTagFilter(q url.Values) ([]string, error) {
+	var tags []string
+	for _, v := range q["tag"] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.TrimSpace(t) == "" {
+				continue
+			}
+			n := normalizeTag(t)
+			if n == "" {
+				return nil, invalidParam("tag", "tag is too long")
+			}
+			tags = append(tags, n)
+		}
+	}
+	return tags, nil
+}
+
+// tagFilters 为每个标签生成一个 term 过滤（帖子需同时带有全部标签）
+func tagFilters(tags []string) []elastic.Query {
+	var filters []elastic.Query
+	for _, t := range tags {
+		filters = append(filters, elastic.NewTermQuery("tags", t))
+	}
+	return filters
+}
+
+// TagCount 是标签聚合结果中的一项
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+// handlerTagFacets：GET /tags?n=&s=&e=&w=&size= 返回视野内出现最多的标签（size 默认 10，最多 100）
+func handlerTagFacets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	vp, err := parseViewport(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	size, err := parseLimit("size", query.Get("size"), 10, 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// 只要聚合结果，不取文档本身
+	res, err := esClient.Search().
+		Index(INDEX).
+		Query(visibleOnly(viewportQuery("location", vp))).
+		Aggregation("top_tags", elastic.NewTermsAggregation().Field("tags").Size(size)).
+		Size(0).
+		Do(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out := []TagCount{}
+	if agg, found := res.Aggregations.Terms("top_tags"); found {
+		for _, b := range agg.Buckets {
+			tag, _ := b.Key.(string)
+			out = append(out, TagCount{Tag: tag, Count: b.DocCount})
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractHashtags(t *testing.T) {
+	long := strings.Repeat("a", maxTagLength+1)
+	var many []string
+	for i := 0; i < maxTagsPerPost+5; i++ {
+		many = append(many, fmt.Sprintf("#t%d", i))
+	}
+	var first20 []string
+	for i := 0; i < maxTagsPerPost; i++ {
+		first20 = append(first20, fmt.Sprintf("t%d", i))
+	}
+
+	tests := []struct {
+		name string
+		msg  string
+		want []string
+	}{
+		{"none", "just coffee", nil},
+		{"single", "coffee #NYC", []string{"nyc"}},
+		{"start of message", "#morning run", []string{"morning"}},
+		{"dedup case-insensitively, keep first order", "#Coffee #tea #COFFEE", []string{"coffee", "tea"}},
+		{"punctuation ends the tag", "love it! #sunset, #beach.", []string{"sunset", "beach"}},
+		{"underscore and digits", "#new_york2026", []string{"new_york2026"}},
+		{"chinese", "今天 #咖啡 很好", []string{"咖啡"}},
+		{"tag after punctuation", "(#inside)", []string{"inside"}},
+		{"url fragment is not a tag", "see https://example.com/page#section", nil},
+		{"html entity is not a tag", "fish &#38; chips", nil},
+		{"word#word is not a tag", "c#sharp", nil},
+		{"bare hash", "# nothing", nil},
+		{"too long is dropped", "#" + long + " #ok", []string{"ok"}},
+		{"capped per post", strings.Join(many, " "), first20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractHashtags(tt.msg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractHashtags(%q) = %v, want %v", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTagFilter(t *testing.T) {
+	q, _ := url.ParseQuery("tag=NYC,%23Coffee&tag=&tag=tea")
+	got, err := parseTagFilter(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"nyc", "coffee", "tea"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tags = %v, want %v", got, want)
+	}
+
+	q = url.Values{"tag": {strings.Repeat("x", maxTagLength+1)}}
+	if _, err := parseTagFilter(q); paramCode(err) != errCodeInvalid {
+		t.Errorf("too long tag: err = %v, want invalid_parameter", err)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// 访问令牌与刷新令牌：登录返回短期的访问令牌（JWT）与长期的刷新令牌（随机串，服务端保存）。
+// 同一次登录产生的令牌属于同一个会话（访问令牌中的 sid）。
+//   - POST /token/refresh {"refresh_token": "..."}：换取一对新令牌，旧刷新令牌随即作废（轮换）。
+//     已作废的刷新令牌再次出现说明它可能已被盗用：吊销整个会话（全部访问令牌与刷新令牌）
+//   - POST /logout：吊销当前访问令牌与所在会话
+//
+// 刷新令牌只保存 SHA-256 摘要。被吊销的访问令牌按 jti 记入吊销列表，被吊销的会话以 "sid:<会话 ID>" 记入同一列表，
+// jwtRequired 对每个请求检查两者，/token/refresh 检查会话；刷新令牌与吊销记录过期后由后台任务清理。
+// 本功能上线前签发的令牌没有 jti，无法单独吊销：它们在 24 小时内自然过期，需要立即作废时可退役其签名密钥（见 jwtkeys.go）。
+//
+// 相关环境变量：
+//   - ACCESS_TOKEN_TTL：访问令牌有效期（默认 15m）
+//   - REFRESH_TOKEN_TTL：刷新令牌有效期（默认 720h 即 30 天；每次刷新重新计算，长期不用才需要重新登录）
+
+// REFRESH_TOKENS_INDEX / REVOKED_TOKENS_INDEX 存放刷新令牌与吊销列表（ES 后端），文档 ID 分别为令牌摘要与吊销 ID
+const (
+	REFRESH_TOKENS_INDEX = "refresh_tokens"
+	REVOKED_TOKENS_INDEX = "revoked_tokens"
+)
+
+const refreshTokensMapping = `{
+	"mappings": {
+		"properties": {
+			"session":    { "type": "keyword" },
+			"user":       { "type": "keyword" },
+			"created_at": { "type": "date" },
+			"expires_at": { "type": "date" },
+			"used_at":    { "type": "date" }
+		}
+	}
+}`
+
+const revokedTokensMapping = `{
+	"mappings": {
+		"properties": {
+			"expires_at": { "type": "date" }
+		}
+	}
+}`
+
+var (
+	accessTokenTTL  = getenvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL = getenvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+)
+
+// tokenPurgeInterval 是清理过期刷新令牌与吊销记录的间隔
+const tokenPurgeInterval = time.Hour
+
+var (
+	// ErrRefreshNotFound 表示刷新令牌不存在（或已被删除）
+	ErrRefreshNotFound = errors.New("refresh token not found")
+	// ErrRefreshReused 表示刷新令牌已经用过一次
+	ErrRefreshReused = errors.New("refresh token already used")
+)
+
+// RefreshToken 是服务端保存的刷新令牌；ID 为令牌的 SHA-256 摘要
+type RefreshToken struct {
+	ID        string     `json:"-"`
+	Session   string     `json:"session"`
+	User      string     `json:"user"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// TokenResponse 是 /login 与 /token/refresh 的响应；token 即访问令牌。
+// Cookie 模式下令牌只写入 Cookie，响应体改为携带 csrf_token（见 cookies.go）
+type TokenResponse struct {
+	Token            string `json:"token,omitempty"`
+	TokenType        string `json:"token_type,omitempty"`
+	ExpiresIn        int64  `json:"expires_in"` // 秒
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"` // 秒
+	CSRFToken        string `json:"csrf_token,omitempty"`
+}
+
+// TokenStore 保存刷新令牌与访问令牌的吊销列表
+type TokenStore interface {
+	// CreateRefresh 保存新的刷新令牌
+	CreateRefresh(ctx context.Context, t *RefreshToken) error
+	// UseRefresh 原子地把刷新令牌标记为已使用并返回；不存在时返回 ErrRefreshNotFound，
+	// 已经使用过时返回记录与 ErrRefreshReused（两个请求同时使用同一令牌时只有一个成功）
+	UseRefresh(ctx context.Context, id string, now time.Time) (*RefreshToken, error)
+	// DeleteSession 删除会话的全部刷新令牌
+	DeleteSession(ctx context.Context, session string) error
+	// Revoke 将 id（访问令牌的 jti 或 sessionRevocationID）加入吊销列表，保留到 expiresAt
+	Revoke(ctx context.Context, id string, expiresAt time.Time) error
+	// IsRevoked 判断 ids 中是否有已被吊销的
+	IsRevoked(ctx context.Context, ids ...string) (bool, error)
+	// PurgeExpired 删除在 now 之前过期的刷新令牌与吊销记录，返回删除的条数
+	PurgeExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+// tokenStore 在 openRepositories 中随存储后端一起初始化
+var tokenStore TokenStore
+
+// refreshTokenID 返回刷新令牌的存储 ID（SHA-256 摘要，十六进制）
+func refreshTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionRevocationID 是会话在吊销列表中的 ID
+func sessionRevocationID(session string) string {
+	return "sid:" + session
+}
+
+// issueTokens 为用户签发一对新令牌；session 为空时开始一个新会话
+func issueTokens(ctx context.Context, username, session string) (TokenResponse, error) {
+	if session == "" {
+		session = uuid.New().String()
+	}
+	access, err := generateToken(username, session)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return TokenResponse{}, err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now().UTC()
+	rec := &RefreshToken{
+		ID:        refreshTokenID(refresh),
+		Session:   session,
+		User:      username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}
+	if err := tokenStore.CreateRefresh(ctx, rec); err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{
+		Token:            access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(accessTokenTTL / time.Second),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int64(refreshTokenTTL / time.Second),
+	}, nil
+}
+
+// revokeSession 吊销会话：会话记入吊销列表（该会话的访问令牌与刷新令牌随即失效，
+// 包括与吊销同时进行的刷新请求刚签发的令牌），再删除会话的刷新令牌。
+// 吊销记录保留到该会话任何令牌都已过期之后
+func revokeSession(ctx context.Context, session string) error {
+	until := time.Now().Add(refreshTokenTTL + accessTokenTTL)
+	if err := tokenStore.Revoke(ctx, sessionRevocationID(session), until); err != nil {
+		return err
+	}
+	return tokenStore.DeleteSession(ctx, session)
+}
+
+// tokenClaims 读取访问令牌中的 jti、sid 与过期时间（旧令牌没有 jti / sid）
+func tokenClaims(token *jwt.Token) (jti, session string, exp time.Time) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", "", time.Time{}
+	}
+	jti, _ = claims["jti"].(string)
+	session, _ = claims["sid"].(string)
+	if t, err := claims.GetExpirationTime(); err == nil && t != nil {
+		exp = t.Time
+	}
+	return jti, session, exp
+}
+
+// handlerRefreshToken：POST /token/refresh；请求体没有 refresh_token 时使用 Cookie 中的刷新令牌（Cookie 模式，见 cookies.go）
+func handlerRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var in struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, &paramError{Code: errCodeBadBody, Message: "invalid JSON body"})
+		return
+	}
+	refresh := strings.TrimSpace(in.RefreshToken)
+	cookieMode := false
+	if refresh == "" {
+		if refresh = cookieValue(r, refreshCookie); refresh != "" {
+			cookieMode = true
+			if !csrfValid(r) {
+				http.Error(w, "forbidden: missing or invalid "+csrfHeader, http.StatusForbidden)
+				return
+			}
+		}
+	}
+	if refresh == "" {
+		writeError(w, http.StatusBadRequest, &paramError{Code: errCodeMissing, Field: "refresh_token", Message: "refresh_token is required"})
+		return
+	}
+	// 刷新失败时清除 Cookie，网页随即回到未登录状态
+	unauthorized := func(msg string) {
+		if cookieMode {
+			clearSessionCookies(w, r)
+		}
+		http.Error(w, msg, http.StatusUnauthorized)
+	}
+
+	now := time.Now()
+	rec, err := tokenStore.UseRefresh(r.Context(), refreshTokenID(refresh), now)
+	if errors.Is(err, ErrRefreshReused) {
+		// 令牌被重放：可能已被盗用，作废整个会话
+		log.Printf("[auth] refresh token of user %s reused; revoking session %s", rec.User, rec.Session)
+		if err := revokeSession(r.Context(), rec.Session); err != nil {
+			log.Printf("[auth] revoke session %s failed: %v", rec.Session, err)
+		}
+		unauthorized("refresh token already used; session revoked, please log in again")
+		return
+	}
+	if errors.Is(err, ErrRefreshNotFound) || (err == nil && !rec.ExpiresAt.After(now)) {
+		unauthorized("invalid or expired refresh token")
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load refresh token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if revoked, err := tokenStore.IsRevoked(r.Context(), sessionRevocationID(rec.Session)); err != nil {
+		http.Error(w, "failed to check session: "+err.Error(), http.StatusInternalServerError)
+		return
+	} else if revoked {
+		unauthorized("invalid or expired refresh token")
+		return
+	}
+	// 用户可能已被删除
+	if _, err := userRepo.Get(r.Context(), rec.User); errors.Is(err, ErrUserNotFound) {
+		_ = revokeSession(r.Context(), rec.Session)
+		unauthorized("invalid or expired refresh token")
+		return
+	} else if err != nil {
+		http.Error(w, "load user failed", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := issueTokens(r.Context(), rec.User, rec.Session)
+	if err != nil {
+		http.Error(w, "cannot mint token", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, r, resp, cookieMode)
+}
+
+// handlerLogout：POST /logout
+// 不经过 jwtRequired：访问令牌过期后仍要能注销，否则会话会一直留到刷新令牌过期。
+// 凭据任给其一：访问令牌（Authorization 头或 gc_access Cookie，已过期的也接受，只用来找到会话），
+// 或刷新令牌（请求体 refresh_token 或 gc_refresh Cookie）。吊销能识别出的访问令牌与整个会话；
+// 请求带会话 Cookie 时总是清除，即使令牌已经无效。
+func handlerLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var in struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, &paramError{Code: errCodeBadBody, Message: "invalid JSON body"})
+		return
+	}
+	access, accessFromCookie := bearerOrCookieToken(r)
+	refresh := strings.TrimSpace(in.RefreshToken)
+	refreshFromCookie := false
+	if refresh == "" {
+		refresh = cookieValue(r, refreshCookie)
+		refreshFromCookie = refresh != ""
+	}
+	// Cookie 会被浏览器自动带上：与其他写操作一样需要 CSRF 令牌
+	if (accessFromCookie || refreshFromCookie) && !csrfValid(r) {
+		http.Error(w, "forbidden: missing or invalid "+csrfHeader, http.StatusForbidden)
+		return
+	}
+	if hasSessionCookies(r) {
+		clearSessionCookies(w, r)
+	}
+	if access == "" && refresh == "" {
+		http.Error(w, "Missing token", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now()
+	identified := false
+	var jti string
+	var exp time.Time
+	var sessions []string
+	if access != "" {
+		if token, err := parseTokenIgnoringExpiry(access); err == nil {
+			var session string
+			jti, session, exp = tokenClaims(token)
+			if session != "" {
+				sessions = append(sessions, session)
+			}
+			identified = true
+		}
+	}
+	if refresh != "" {
+		rec, err := tokenStore.UseRefresh(r.Context(), refreshTokenID(refresh), now)
+		switch {
+		case err == nil, errors.Is(err, ErrRefreshReused):
+			if len(sessions) == 0 || sessions[0] != rec.Session {
+				sessions = append(sessions, rec.Session)
+			}
+			identified = true
+		case !errors.Is(err, ErrRefreshNotFound):
+			http.Error(w, "logout failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !identified {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// 已过期的访问令牌无需再吊销
+	if jti != "" && exp.After(now) {
+		if err := tokenStore.Revoke(r.Context(), jti, exp); err != nil {
+			http.Error(w, "logout failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, session := range sessions {
+		if err := revokeSession(r.Context(), session); err != nil {
+			http.Error(w, "logout failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "logged_out"})
+}
+
+// runTokenPurger 定期删除过期的刷新令牌与吊销记录
+func runTokenPurger(ctx context.Context) {
+	ticker := time.NewTicker(tokenPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := tokenStore.PurgeExpired(ctx, time.Now()); err != nil {
+			log.Printf("[auth] purge expired tokens failed: %v", err)
+		} else if n > 0 {
+			log.Printf("[auth] purged %d expired refresh token(s) / revocation(s)", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTokenMux 在 newTestMux 的基础上注册刷新与登出路由
+func newTokenMux() *http.ServeMux {
+	mux := newTestMux()
+	mux.HandleFunc("/token/refresh", handlerRefreshToken)
+	mux.HandleFunc("/logout", handlerLogout)
+	return mux
+}
+
+// loginTokens 注册并登录，返回完整的令牌响应
+func loginTokens(t *testing.T, h http.Handler, username string) TokenResponse {
+	t.Helper()
+	creds := map[string]string{"username": username, "password": "secret"}
+	if code := doJSON(t, h, http.MethodPost, "/signup", "", creds, nil); code != http.StatusOK && code != http.StatusCreated {
+		t.Fatalf("signup %s: status %d", username, code)
+	}
+	var tok TokenResponse
+	if code := doJSON(t, h, http.MethodPost, "/login", "", creds, &tok); code != http.StatusOK {
+		t.Fatalf("login %s: status %d", username, code)
+	}
+	if tok.Token == "" || tok.RefreshToken == "" {
+		t.Fatalf("login %s: missing tokens in %+v", username, tok)
+	}
+	return tok
+}
+
+func refresh(t *testing.T, h http.Handler, refreshToken string) (TokenResponse, int) {
+	t.Helper()
+	var tok TokenResponse
+	code := doJSON(t, h, http.MethodPost, "/token/refresh", "", map[string]string{"refresh_token": refreshToken}, &tok)
+	return tok, code
+}
+
+func TestRefreshRotation(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTokenMux()
+	first := loginTokens(t, mux, "kimi")
+
+	second, code := refresh(t, mux, first.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh: status %d", code)
+	}
+	if second.RefreshToken == first.RefreshToken || second.Token == first.Token {
+		t.Error("refresh did not rotate the tokens")
+	}
+	third, code := refresh(t, mux, second.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh with the rotated token: status %d", code)
+	}
+	for _, access := range []string{first.Token, second.Token, third.Token} {
+		if code := doJSON(t, mux, http.MethodGet, "/trash", access, nil, nil); code != http.StatusOK {
+			t.Errorf("access token of the live session rejected: status %d", code)
+		}
+	}
+
+	if _, code := refresh(t, mux, "not-a-token"); code != http.StatusUnauthorized {
+		t.Errorf("unknown refresh token: status %d, want 401", code)
+	}
+	if code := doJSON(t, mux, http.MethodPost, "/token/refresh", "", map[string]string{}, nil); code != http.StatusBadRequest {
+		t.Errorf("missing refresh token: status %d, want 400", code)
+	}
+}
+
+// 已轮换掉的刷新令牌再次出现：吊销整个会话，不影响同一用户的其他会话
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTokenMux()
+	stolen := loginTokens(t, mux, "kimi")
+	var otherSession TokenResponse
+	creds := map[string]string{"username": "kimi", "password": "secret"}
+	if code := doJSON(t, mux, http.MethodPost, "/login", "", creds, &otherSession); code != http.StatusOK {
+		t.Fatalf("second login: status %d", code)
+	}
+
+	rotated, code := refresh(t, mux, stolen.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh: status %d", code)
+	}
+	if _, code := refresh(t, mux, stolen.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: status %d, want 401", code)
+	}
+
+	if _, code := refresh(t, mux, rotated.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh token issued after the stolen one still works: status %d", code)
+	}
+	for name, access := range map[string]string{"original": stolen.Token, "rotated": rotated.Token} {
+		if code := doJSON(t, mux, http.MethodGet, "/trash", access, nil, nil); code != http.StatusUnauthorized {
+			t.Errorf("%s access token of the revoked session: status %d, want 401", name, code)
+		}
+	}
+
+	if code := doJSON(t, mux, http.MethodGet, "/trash", otherSession.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("other session was revoked too: status %d", code)
+	}
+	if _, code := refresh(t, mux, otherSession.RefreshToken); code != http.StatusOK {
+		t.Errorf("other session cannot refresh: status %d", code)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTokenMux()
+	tok := loginTokens(t, mux, "kimi")
+	if code := doJSON(t, mux, http.MethodPost, "/logout", tok.Token, nil, nil); code != http.StatusOK {
+		t.Fatalf("logout: status %d", code)
+	}
+	if code := doJSON(t, mux, http.MethodGet, "/trash", tok.Token, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("access token after logout: status %d, want 401", code)
+	}
+	if _, code := refresh(t, mux, tok.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: status %d, want 401", code)
+	}
+}
+
+// expiredCopy 以相同声明（jti、sid 等）重新签发一个已经过期的访问令牌
+func expiredCopy(t *testing.T, token string) string {
+	t.Helper()
+	parsed, err := parseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := parsed.Claims.(jwt.MapClaims)
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	expired, err := signToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expired
+}
+
+// 访问令牌过期后仍能注销：凭过期的访问令牌或刷新令牌找到会话并吊销
+func TestLogoutAfterAccessExpired(t *testing.T) {
+	useMemoryStorage(t)
+	mux := newTokenMux()
+
+	tok := loginTokens(t, mux, "kimi")
+	expired := expiredCopy(t, tok.Token)
+	if code := doJSON(t, mux, http.MethodGet, "/trash", expired, nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expired access token: status %d, want 401", code)
+	}
+	if code := doJSON(t, mux, http.MethodPost, "/logout", expired, nil, nil); code != http.StatusOK {
+		t.Fatalf("logout with an expired access token: status %d", code)
+	}
+	if _, code := refresh(t, mux, tok.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: status %d, want 401", code)
+	}
+
+	// 只带刷新令牌
+	tok = loginTokens(t, mux, "lena")
+	if code := doJSON(t, mux, http.MethodPost, "/logout", "", map[string]string{"refresh_token": tok.RefreshToken}, nil); code != http.StatusOK {
+		t.Fatalf("logout with a refresh token: status %d", code)
+	}
+	if code := doJSON(t, mux, http.MethodGet, "/trash", tok.Token, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("access token after logout: status %d, want 401", code)
+	}
+	if _, code := refresh(t, mux, tok.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: status %d, want 401", code)
+	}
+
+	if code := doJSON(t, mux, http.MethodPost, "/logout", "", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("logout without credentials: status %d, want 401", code)
+	}
+	if code := doJSON(t, mux, http.MethodPost, "/logout", "", map[string]string{"refresh_token": "unknown"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("logout with an unknown refresh token: status %d, want 401", code)
+	}
+}
+
+// 内存与 SQLite 的 TokenStore 语义一致
+func TestTokenStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) TokenStore{
+		"memory": func(t *testing.T) TokenStore { return newMemoryTokenStore() },
+		"sqlite": func(t *testing.T) TokenStore { return &sqliteTokenStore{db: newTestSQLite(t).db} },
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := open(t)
+			now := time.Now()
+			for _, rec := range []*RefreshToken{
+				{ID: "a", Session: "s1", User: "kimi", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+				{ID: "b", Session: "s1", User: "kimi", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+				{ID: "old", Session: "s2", User: "kimi", CreatedAt: now, ExpiresAt: now.Add(-time.Minute)},
+			} {
+				if err := s.CreateRefresh(ctx, rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 同一令牌被并发使用时只有一个成功，其余得到 ErrRefreshReused 与令牌记录
+			var wg sync.WaitGroup
+			errs := make([]error, 8)
+			recs := make([]*RefreshToken, 8)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					recs[i], errs[i] = s.UseRefresh(ctx, "a", now)
+				}(i)
+			}
+			wg.Wait()
+			used := 0
+			for i, err := range errs {
+				switch {
+				case err == nil:
+					used++
+				case !errors.Is(err, ErrRefreshReused):
+					t.Fatalf("UseRefresh: %v", err)
+				}
+				if recs[i] == nil || recs[i].Session != "s1" || recs[i].User != "kimi" {
+					t.Errorf("UseRefresh returned record %+v", recs[i])
+				}
+			}
+			if used != 1 {
+				t.Errorf("%d concurrent uses succeeded, want 1", used)
+			}
+			if _, err := s.UseRefresh(ctx, "missing", now); !errors.Is(err, ErrRefreshNotFound) {
+				t.Errorf("UseRefresh(missing) err = %v", err)
+			}
+
+			if err := s.DeleteSession(ctx, "s1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.UseRefresh(ctx, "b", now); !errors.Is(err, ErrRefreshNotFound) {
+				t.Errorf("token of deleted session: err = %v", err)
+			}
+
+			if err := s.Revoke(ctx, "jti-1", now.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Revoke(ctx, sessionRevocationID("s2"), now.Add(-time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := s.IsRevoked(ctx, "jti-2", "jti-1"); err != nil || !ok {
+				t.Errorf("IsRevoked = %v, %v, want true", ok, err)
+			}
+			if ok, err := s.IsRevoked(ctx, "jti-2"); err != nil || ok {
+				t.Errorf("IsRevoked(jti-2) = %v, %v, want false", ok, err)
+			}
+
+			// 过期的刷新令牌 old 与过期的吊销记录 sid:s2
+			if n, err := s.PurgeExpired(ctx, now); err != nil || n != 2 {
+				t.Errorf("PurgeExpired = %d, %v, want 2", n, err)
+			}
+			if ok, _ := s.IsRevoked(ctx, "jti-1"); !ok {
+				t.Error("unexpired revocation was purged")
+			}
+		})
+	}
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 导入导出子命令（备份、环境间迁移、与 GIS 同事交换数据），使用与服务相同的 STORAGE_BACKEND 等环境变量：
+//
+//	geoconnect export [-format geojson|ndjson] [-media] [-o FILE]
+//	geoconnect import [-format geojson|ndjson|bundle] [FILE]
+//
+// 格式：
+//   - geojson：一个 FeatureCollection，每个帖子是一个 Point Feature，id 为帖子 ID，其余字段放在 properties 中
+//   - ndjson：每行一个帖子，字段与 /search 结果相同（含 id）
+//   - bundle（export -media）：tar.gz，先是 media/ 下的图片，最后是 posts.geojson 或 posts.ndjson。
+//     导入时图片按当前配置重新上传（GCS 或 LOCAL_UPLOAD_DIR），帖子的 url 改写为新地址。
+//
+// 导出时逐条写出，导入时逐条读取、每 importBatchSize 条批量写入一次，内存占用与数据量无关。
+// 导入保留原帖子 ID（已存在的同 ID 帖子会被覆盖），缺少 ID 的记录会生成新 ID；
+// 缺少 lang / tags 时按发帖规则补齐。导入不会触发保存搜索的提醒。
+
+const (
+	formatGeoJSON = "geojson"
+	formatNDJSON  = "ndjson"
+	formatBundle  = "bundle"
+
+	// importBatchSize 是导入时每次 SaveBatch 的帖子数
+	importBatchSize = 1000
+	// bundleMediaDir 是 bundle 中存放图片的目录
+	bundleMediaDir = "media/"
+)
+
+// runCommand 执行子命令；未知子命令返回错误
+func runCommand(name string, args []string) error {
+	switch name {
+	case "export":
+		return runExport(args)
+	case "import":
+		return runImport(args)
+	default:
+		return fmt.Errorf("unknown command %q (want export or import)", name)
+	}
+}
+
+// geoFeature 是 GeoJSON 中的一个帖子
+type geoFeature struct {
+	Type       string          `json:"type"`
+	ID         json.RawMessage `json:"id,omitempty"`
+	Geometry   *geoGeometry    `json:"geometry"`
+	Properties json.RawMessage `json:"properties"`
+}
+
+// geoGeometry 的 coordinates 结构随 type 变化（Point 为 [lon, lat]），先保留原始 JSON
+type geoGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// geoProperties 是 Feature 的 properties：除 location 外的全部帖子字段
+type geoProperties struct {
+	User    string   `json:"user"`
+	Message string   `json:"message"`
+	Url     string   `json:"url,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	City    string   `json:"city,omitempty"`
+	Region  string   `json:"region,omitempty"`
+	Country string   `json:"country,omitempty"`
+	Lang    string   `json:"lang,omitempty"`
+	// 发帖时间：导入后保持原来的搜索顺序
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// 编辑标记（修订历史不导出）
+	Edited   bool       `json:"edited,omitempty"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	Revision int        `json:"revision,omitempty"`
+	// 回收站中的帖子也会导出，导入后仍在回收站中
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+	// 限时帖子：已到期的帖子导入后会被清理任务删除
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// toFeature 将帖子转换为 GeoJSON Feature（坐标顺序为 [lon, lat]）
+func toFeature(p PostWithID) (geoFeature, error) {
+	id, _ := json.Marshal(p.ID)
+	coords, _ := json.Marshal([]float64{p.Location.Lon, p.Location.Lat})
+	props, err := json.Marshal(geoProperties{
+		User: p.User, Message: p.Message, Url: p.Url, Tags: p.Tags,
+		City: p.City, Region: p.Region, Country: p.Country, Lang: p.Lang, CreatedAt: p.CreatedAt,
+		Edited: p.Edited, EditedAt: p.EditedAt, Revision: p.Revision,
+		DeletedAt: p.DeletedAt, DeletedBy: p.DeletedBy, ExpiresAt: p.ExpiresAt,
+	})
+	if err != nil {
+		return geoFeature{}, err
+	}
+	return geoFeature{
+		Type:       "Feature",
+		ID:         id,
+		Geometry:   &geoGeometry{Type: "Point", Coordinates: coords},
+		Properties: props,
+	}, nil
+}
+
+// fromFeature 将 GeoJSON Feature 转换为帖子；id 可以是字符串或数字，也可以放在 properties.id 中
+func fromFeature(f geoFeature) (PostWithID, error) {
+	var coords []float64
+	if f.Geometry == nil || f.Geometry.Type != "Point" ||
+		json.Unmarshal(f.Geometry.Coordinates, &coords) != nil || len(coords) < 2 {
+		return PostWithID{}, errors.New("geometry must be a Point")
+	}
+	loc, err := validateLocation(&coords[1], &coords[0])
+	if err != nil {
+		return PostWithID{}, err
+	}
+	var props struct {
+		geoProperties
+		ID json.RawMessage `json:"id"`
+	}
+	if len(f.Properties) > 0 && string(f.Properties) != "null" {
+		if err := json.Unmarshal(f.Properties, &props); err != nil {
+			return PostWithID{}, fmt.Errorf("invalid properties: %w", err)
+		}
+	}
+	id := featureID(f.ID)
+	if id == "" {
+		id = featureID(props.ID)
+	}
+	g := props.geoProperties
+	return PostWithID{ID: id, Post: Post{
+		User: g.User, Message: g.Message, Location: loc, Url: g.Url, Tags: g.Tags,
+		City: g.City, Region: g.Region, Country: g.Country, Lang: g.Lang, CreatedAt: g.CreatedAt,
+		Edited: g.Edited, EditedAt: g.EditedAt, Revision: g.Revision,
+		DeletedAt: g.DeletedAt, DeletedBy: g.DeletedBy, ExpiresAt: g.ExpiresAt,
+	}}, nil
+}
+
+// featureID 读取字符串或数字形式的 id
+func featureID(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String()
+	}
+	return ""
+}
+
+// ---------------------------------------------------------------- export
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "", "geojson or ndjson (default: from -o extension, else geojson)")
+	out := fs.String("o", "-", "output file (- for stdout)")
+	media := fs.Bool("media", false, "bundle images with the posts into a tar.gz")
+	_ = fs.Parse(args)
+
+	if *format == "" {
+		*format = formatFromExt(*out)
+		if *format == "" || *format == formatBundle {
+			*format = formatGeoJSON
+		}
+	}
+	if *format != formatGeoJSON && *format != formatNDJSON {
+		return fmt.Errorf("unknown -format %q (want %s or %s)", *format, formatGeoJSON, formatNDJSON)
+	}
+
+	ctx := context.Background()
+	if err := openRepositories(ctx); err != nil {
+		return fmt.Errorf("open %s storage: %w", storageBackend, err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+
+	started := time.Now()
+	var (
+		n   int
+		err error
+	)
+	if *media {
+		n, err = exportBundle(ctx, bw, *format)
+	} else {
+		n, err = exportPosts(ctx, bw, *format, nil)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[export] %d post(s) from %s storage written as %s in %s", n, storageBackend, *format, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// exportPosts 将全部帖子按 format 写入 w；每写出一条帖子后调用 onPost（可为 nil）
+func exportPosts(ctx context.Context, w io.Writer, format string, onPost func(PostWithID) error) (int, error) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	n := 0
+	if format == formatGeoJSON {
+		if _, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`+"\n"); err != nil {
+			return 0, err
+		}
+	}
+	err := postRepo.Scan(ctx, func(p PostWithID) error {
+		if format == formatGeoJSON {
+			f, err := toFeature(p)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		} else if err := enc.Encode(p); err != nil {
+			return err
+		}
+		n++
+		if onPost != nil {
+			return onPost(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if format == formatGeoJSON {
+		if _, err := io.WriteString(w, "]}\n"); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// exportBundle 写出 tar.gz：遍历帖子时把引用的图片依次写入 media/，帖子先写到临时文件，最后作为
+// posts.<format> 放在包的末尾（tar 条目需要预先知道大小）。无法读取的图片会跳过并保留原 url。
+func exportBundle(ctx context.Context, w io.Writer, format string) (int, error) {
+	tmp, err := os.CreateTemp("", "geoconnect-export-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	bundled := map[string]bool{}
+	missing := 0
+	tmpw := bufio.NewWriter(tmp)
+	n, err := exportPosts(ctx, tmpw, format, func(p PostWithID) error {
+		name := mediaName(p.Url)
+		if name == "" || bundled[name] {
+			return nil
+		}
+		bundled[name] = true
+		if err := addMedia(ctx, tw, name, p.Url); err != nil {
+			log.Printf("[export] skip image of post %s (%s): %v", p.ID, p.Url, err)
+			missing++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if err := tmpw.Flush(); err != nil {
+		return n, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return n, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return n, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "posts." + format, Mode: 0o644, Size: size, ModTime: time.Now()}); err != nil {
+		return n, err
+	}
+	if _, err := io.Copy(tw, tmp); err != nil {
+		return n, err
+	}
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+	if err := gz.Close(); err != nil {
+		return n, err
+	}
+	log.Printf("[export] bundled %d image(s), %d could not be read", len(bundled)-missing, missing)
+	return n, nil
+}
+
+// mediaName 返回图片在 bundle 中的文件名（取 url 路径的最后一段，上传时已是唯一的 UUID 文件名）
+func mediaName(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// addMedia 读取图片并写入 media/<name>：/uploads/ 开头的读本地目录，http(s) 地址直接下载
+func addMedia(ctx context.Context, tw *tar.Writer, name, rawURL string) error {
+	var (
+		r    io.Reader
+		size int64
+	)
+	switch {
+	case strings.HasPrefix(rawURL, "/uploads/"):
+		f, err := os.Open(filepath.Join(localUploadDir, filepath.FromSlash(strings.TrimPrefix(rawURL, "/uploads/"))))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r, size = f, st.Size()
+	case strings.HasPrefix(rawURL, "http://") || strings.HasPrefix(rawURL, "https://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		// 响应可能没有 Content-Length，先读入内存再写 tar 条目
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(b), int64(len(b))
+	default:
+		return errors.New("unsupported url")
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: bundleMediaDir + name, Mode: 0o644, Size: size, ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// ---------------------------------------------------------------- import
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "geojson, ndjson or bundle (default: from file extension or content)")
+	_ = fs.Parse(args)
+	in := "-"
+	if fs.NArg() > 0 {
+		in = fs.Arg(0)
+	}
+
+	var r io.Reader = os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	br := bufio.NewReaderSize(r, 64<<10)
+	if *format == "" {
+		*format = formatFromExt(in)
+	}
+	if *format == "" {
+		*format = sniffFormat(br)
+	}
+	if *format != formatGeoJSON && *format != formatNDJSON && *format != formatBundle {
+		return fmt.Errorf("unknown -format %q (want %s, %s or %s)", *format, formatGeoJSON, formatNDJSON, formatBundle)
+	}
+
+	ctx := context.Background()
+	if err := openRepositories(ctx); err != nil {
+		return fmt.Errorf("open %s storage: %w", storageBackend, err)
+	}
+
+	started := time.Now()
+	imp := &importer{ctx: ctx}
+	var err error
+	if *format == formatBundle {
+		err = imp.readBundle(br)
+	} else {
+		err = imp.readPosts(br, *format)
+	}
+	// 出错时也写入已读取的帖子，与此前已写入的批次保持一致
+	if ferr := imp.flush(); err == nil {
+		err = ferr
+	}
+	log.Printf("[import] %d post(s) saved to %s storage, %d failed, in %s", imp.saved, storageBackend, imp.failed, time.Since(started).Round(time.Millisecond))
+	return err
+}
+
+// formatFromExt 按文件扩展名推断格式，无法判断时返回空字符串
+func formatFromExt(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return formatBundle
+	case strings.HasSuffix(lower, ".geojson"), strings.HasSuffix(lower, ".json"):
+		return formatGeoJSON
+	case strings.HasSuffix(lower, ".ndjson"), strings.HasSuffix(lower, ".jsonl"):
+		return formatNDJSON
+	}
+	return ""
+}
+
+// geoJSONHead 匹配 FeatureCollection 开头常见的成员（成员顺序不固定，type 可能在 features 之后）
+var geoJSONHead = regexp.MustCompile(`"type"\s*:\s*"FeatureCollection"|"features"\s*:\s*\[`)
+
+// sniffFormat 按内容推断格式：gzip 为 bundle，开头像 FeatureCollection 的为 geojson，否则为 ndjson
+func sniffFormat(br *bufio.Reader) string {
+	head, _ := br.Peek(4096)
+	switch {
+	case len(head) >= 2 && head[0] == 0x1f && head[1] == 0x8b:
+		return formatBundle
+	case geoJSONHead.Match(head):
+		return formatGeoJSON
+	default:
+		return formatNDJSON
+	}
+}
+
+// importer 累积待写入的帖子，满 importBatchSize 条时批量写入
+type importer struct {
+	ctx     context.Context
+	media   map[string]string // bundle 内图片名 -> 重新上传后的 url
+	pending []PostWithID
+	labels  []string // pending 中每条记录的位置描述，用于报错
+	saved   int
+	failed  int
+}
+
+// add 校验并补齐一条记录后加入待写入队列
+func (imp *importer) add(label string, p PostWithID, err error) error {
+	if err == nil && p.User == "" {
+		err = missingParam("user")
+	}
+	if err != nil {
+		log.Printf("[import] %s: %v", label, err)
+		imp.failed++
+		return nil
+	}
+	if p.ID == "" {
+		p.ID = uuid.New().String()
+	}
+	if p.Lang == "" {
+		p.Lang = detectLanguage(p.Message)
+	}
+	if p.Tags == nil {
+		p.Tags = extractHashtags(p.Message)
+	}
+	if newURL, ok := imp.media[mediaName(p.Url)]; ok {
+		p.Url = newURL
+	}
+	p.DistanceMeters = nil
+	imp.pending = append(imp.pending, p)
+	imp.labels = append(imp.labels, label)
+	if len(imp.pending) >= importBatchSize {
+		return imp.flush()
+	}
+	return nil
+}
+
+// flush 写入队列中的帖子
+func (imp *importer) flush() error {
+	if len(imp.pending) == 0 {
+		return nil
+	}
+	var results []SaveResult
+	_, err := writeWithChanges(imp.ctx, func(ctx context.Context) ([]ChangeEvent, error) {
+		results = postRepo.SaveBatch(ctx, imp.pending)
+		var events []ChangeEvent
+		for i, res := range results {
+			if res.Err != nil {
+				continue
+			}
+			typ := changeCreated
+			if res.Replaced {
+				typ = changeUpdated // 按 ID 覆盖了已有帖子
+			}
+			events = append(events, newChange(typ, imp.pending[i].ID, &imp.pending[i].Post, ""))
+		}
+		return events, nil
+	})
+	if err == nil || errors.Is(err, errChangesNotRecorded) {
+		for i, res := range results {
+			if res.Err != nil {
+				log.Printf("[import] %s (id %s): %v", imp.labels[i], imp.pending[i].ID, res.Err)
+				imp.failed++
+				continue
+			}
+			imp.saved++
+		}
+		log.Printf("[import] %d post(s) saved so far", imp.saved)
+	} else {
+		imp.failed += len(imp.pending)
+	}
+	imp.pending, imp.labels = imp.pending[:0], imp.labels[:0]
+	return err
+}
+
+// readPosts 逐条读取 geojson 或 ndjson 中的帖子
+func (imp *importer) readPosts(r io.Reader, format string) error {
+	if format == formatNDJSON {
+		return imp.readNDJSON(r)
+	}
+	return imp.readGeoJSON(r)
+}
+
+func (imp *importer) readNDJSON(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), maxBulkLineBytes)
+	line := 0
+	for sc.Scan() {
+		line++
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		// 坐标使用指针解码，缺失时报错而不是落在 0,0
+		var rec struct {
+			PostWithID
+			Location struct {
+				Lat *float64 `json:"lat"`
+				Lon *float64 `json:"lon"`
+			} `json:"location"`
+		}
+		err := json.Unmarshal(b, &rec)
+		p := rec.PostWithID
+		if err == nil {
+			p.Location, err = validateLocation(rec.Location.Lat, rec.Location.Lon)
+		}
+		if err := imp.add(fmt.Sprintf("line %d", line), p, err); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("line %d: %w", line+1, err)
+	}
+	return nil
+}
+
+// readGeoJSON 流式读取 FeatureCollection：只逐个解码 features 数组中的元素，其余成员跳过
+func (imp *importer) readGeoJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return errors.New("GeoJSON must be a FeatureCollection object")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if t != "features" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return errors.New("features must be an array")
+		}
+		for i := 0; dec.More(); i++ {
+			var f geoFeature
+			if err := dec.Decode(&f); err != nil {
+				return fmt.Errorf("feature %d: %w", i, err)
+			}
+			p, err := fromFeature(f)
+			if err := imp.add(fmt.Sprintf("feature %d", i), p, err); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBundle 读取 export -media 生成的 tar.gz：先重新上传 media/ 下的图片，再导入帖子文件
+func (imp *importer) readBundle(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	imp.media = map[string]string{}
+	imported := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := hdr.Name
+		switch {
+		case strings.HasPrefix(name, bundleMediaDir):
+			base := path.Base(name)
+			var newURL string
+			if useGCS {
+				newURL, err = saveToGCS(imp.ctx, BUCKET_NAME, tr, base)
+			} else {
+				newURL, err = saveToLocal(imp.ctx, localUploadDir, tr, base)
+			}
+			if err != nil {
+				return fmt.Errorf("upload %s: %w", name, err)
+			}
+			imp.media[base] = newURL
+		case formatFromExt(name) == formatGeoJSON || formatFromExt(name) == formatNDJSON:
+			log.Printf("[import] %d image(s) uploaded from bundle", len(imp.media))
+			if err := imp.readPosts(tr, formatFromExt(name)); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			imported = true
+		}
+	}
+	if !imported {
+		return errors.New("bundle contains no posts.geojson or posts.ndjson")
+	}
+	return nil
+}
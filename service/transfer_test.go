@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scanAll 返回存储中的全部帖子（按写入顺序）
+func scanAll(t *testing.T) []PostWithID {
+	t.Helper()
+	var all []PostWithID
+	if err := postRepo.Scan(context.Background(), func(p PostWithID) error {
+		all = append(all, p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return all
+}
+
+// 导出再导入到空存储后，帖子（含 ID 与全部字段）保持不变
+func TestExportImportRoundTrip(t *testing.T) {
+	edited := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	deleted := time.Date(2026, 3, 2, 8, 30, 0, 123456789, time.UTC)
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	full := at("full", 40.7128, -74.006, "coffee in manhattan #nyc")
+	full.Url, full.Tags, full.Lang = "https://example.com/a.jpg", []string{"nyc"}, langEnglish
+	full.City, full.Region, full.Country = "New York City", "New York", "US"
+	full.Edited, full.EditedAt, full.Revision = true, &edited, 2
+	full.ExpiresAt = &expires
+	trashed := at("42", -33.87, 151.21, "deleted in sydney")
+	trashed.Lang = langEnglish
+	trashed.DeletedAt, trashed.DeletedBy = &deleted, "admin"
+	cjk := at("beijing", 39.9042, 116.4074, "今天在北京喝咖啡")
+	cjk.Lang = langChinese
+	posts := []PostWithID{full, trashed, cjk}
+
+	for _, format := range []string{formatGeoJSON, formatNDJSON} {
+		t.Run(format, func(t *testing.T) {
+			useMemoryStorage(t)
+			seedPosts(t, posts...)
+			var buf bytes.Buffer
+			if n, err := exportPosts(context.Background(), &buf, format, nil); err != nil || n != len(posts) {
+				t.Fatalf("export = %d, %v", n, err)
+			}
+
+			useMemoryStorage(t)
+			imp := &importer{ctx: context.Background()}
+			if err := imp.readPosts(&buf, format); err != nil {
+				t.Fatal(err)
+			}
+			if err := imp.flush(); err != nil {
+				t.Fatal(err)
+			}
+			if imp.saved != len(posts) || imp.failed != 0 {
+				t.Fatalf("saved %d, failed %d", imp.saved, imp.failed)
+			}
+			if got := scanAll(t); !reflect.DeepEqual(got, posts) {
+				t.Errorf("imported posts differ:\n got %+v\nwant %+v", got, posts)
+			}
+		})
+	}
+}
+
+// 缺少 ID 的记录生成新 ID、缺少作者或坐标的记录计为失败；同 ID 的帖子被覆盖
+func TestImportRecords(t *testing.T) {
+	useMemoryStorage(t)
+	seedPosts(t, at("kept", 1, 1, "old message"))
+	ndjson := strings.Join([]string{
+		`{"id": "kept", "user": "kimi", "message": "replaced #new", "location": {"lat": 1, "lon": 1}}`,
+		`{"user": "kimi", "message": "no id", "location": {"lat": 2, "lon": 2}}`,
+		`{"id": "anon", "message": "no user", "location": {"lat": 3, "lon": 3}}`,
+		`{"id": "nowhere", "user": "kimi", "message": "no location"}`,
+	}, "\n")
+	imp := &importer{ctx: context.Background()}
+	if err := imp.readPosts(strings.NewReader(ndjson), formatNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := imp.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if imp.saved != 2 || imp.failed != 2 {
+		t.Errorf("saved %d, failed %d, want 2 and 2", imp.saved, imp.failed)
+	}
+	all := scanAll(t)
+	if len(all) != 2 {
+		t.Fatalf("stored %d posts, want 2", len(all))
+	}
+	if all[0].ID != "kept" || all[0].Message != "replaced #new" || !reflect.DeepEqual(all[0].Tags, []string{"new"}) {
+		t.Errorf("replaced post = %+v", all[0])
+	}
+	if all[1].ID == "" || all[1].Message != "no id" || all[1].Lang != langEnglish {
+		t.Errorf("post without id = %+v", all[1])
+	}
+}
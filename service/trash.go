@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 回收站：删除帖子只做软删除（记录 deleted_at / deleted_by），帖子随即从搜索、标签与联想中消失，
+// 但在保留期内可以恢复；保留期过后由后台任务永久删除。
+//   - GET  /trash[?limit=&offset=][&user=]：作者看到自己被删除的帖子，管理员看到全部（可用 user 过滤）
+//   - POST /trash/restore?id=<id>：管理员可恢复任意帖子；作者只能恢复自己删除的帖子（被管理员删除的需由管理员恢复）；
+//     与删除一样支持 If-Match（见 concurrency.go）
+//
+// 相关环境变量：
+//   - TRASH_RETENTION：已删除帖子的保留期（默认 720h 即 30 天，0 表示永不清除）
+//   - TRASH_PURGE_INTERVAL：清除任务的执行间隔（默认 1h）
+
+var (
+	trashRetention     = getenvDuration("TRASH_RETENTION", 30*24*time.Hour)
+	trashPurgeInterval = getenvDuration("TRASH_PURGE_INTERVAL", time.Hour)
+)
+
+const (
+	defaultTrashLimit = 50
+	maxTrashLimit     = 200
+	maxTrashOffset    = 10000
+)
+
+// TrashItem 是回收站中的一条帖子；PurgeAt 为预计永久删除的时间（保留期为 0 时省略）
+type TrashItem struct {
+	PostWithID
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+// TrashResponse 是 /trash 的响应
+type TrashResponse struct {
+	Total      int64       `json:"total"`
+	Pagination Pagination  `json:"pagination"`
+	Results    []TrashItem `json:"results"`
+}
+
+// DeleteResponse 是删除接口的响应：帖子已移入回收站，PurgeAt 之前可以恢复
+type DeleteResponse struct {
+	Status    string     `json:"status"`
+	DeletedAt *time.Time `json:"deleted_at"`
+	PurgeAt   *time.Time `json:"purge_at,omitempty"`
+}
+
+// purgeAt 返回已删除帖子的永久删除时间
+func purgeAt(p *Post) *time.Time {
+	if p.DeletedAt == nil || trashRetention <= 0 {
+		return nil
+	}
+	t := p.DeletedAt.Add(trashRetention)
+	return &t
+}
+
+// softDeletePost 将版本为 ver 的帖子移入回收站并记录 deleted 事件，使覆盖该位置的搜索缓存失效；返回新版本。
+// 返回 errChangesNotRecorded 时帖子已经移入回收站
+func softDeletePost(ctx context.Context, id string, p *Post, by string, ver PostVersion) (PostVersion, error) {
+	now := time.Now().UTC()
+	p.DeletedAt = &now
+	p.DeletedBy = by
+	var newVer PostVersion
+	events, err := writeWithChanges(ctx, func(ctx context.Context) ([]ChangeEvent, error) {
+		var err error
+		if newVer, err = postRepo.SaveIf(ctx, id, p, ver); err != nil {
+			return nil, err
+		}
+		return []ChangeEvent{newChange(changeDeleted, id, p, by)}, nil
+	})
+	if len(events) == 0 {
+		return PostVersion{}, err
+	}
+	searchCache.InvalidateAt(p.Location)
+	log.Printf("[trash] post %s moved to trash by %s", id, by)
+	return newVer, err
+}
+
+// handlerTrash：GET /trash
+func handlerTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username := usernameFromCtx(r.Context())
+	if username == "" {
+		http.Error(w, "missing user in context", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	limit, err := parseLimit("limit", q.Get("limit"), defaultTrashLimit, maxTrashLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	offset, err := parseOffset("offset", q.Get("offset"), maxTrashOffset)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// 非管理员只能看自己的帖子
+	owner := username
+	if isAdminFromCtx(r.Context()) {
+		owner = strings.TrimSpace(q.Get("user"))
+	}
+
+	posts, total, err := postRepo.ListDeleted(r.Context(), owner, limit, offset)
+	if err != nil {
+		http.Error(w, "failed to list trash: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := TrashResponse{
+		Total:      total,
+		Pagination: Pagination{Offset: offset, Limit: limit},
+		Results:    make([]TrashItem, 0, len(posts)),
+	}
+	for _, p := range posts {
+		resp.Results = append(resp.Results, TrashItem{PostWithID: p, PurgeAt: purgeAt(&p.Post)})
+	}
+	if end := offset + len(posts); int64(end) < total && end < maxTrashOffset {
+		resp.Pagination.NextOffset = &end
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handlerRestorePost：POST /trash/restore?id=<id>（id 也可放在 JSON 请求体中）
+func handlerRestorePost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username := usernameFromCtx(r.Context())
+	if username == "" {
+		http.Error(w, "missing user in context", http.StatusUnauthorized)
+		return
+	}
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	if id == "" && r.Body != nil {
+		var body struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err == nil {
+			id = strings.TrimSpace(body.ID)
+		}
+	}
+	if id == "" {
+		writeError(w, http.StatusBadRequest, missingParam("id"))
+		return
+	}
+
+	p, ver, err := postRepo.GetVersioned(r.Context(), id)
+	if errors.Is(err, ErrPostNotFound) {
+		http.Error(w, "post not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load post: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.DeletedAt == nil {
+		http.Error(w, "post is not in trash", http.StatusConflict)
+		return
+	}
+	if !isAdminFromCtx(r.Context()) {
+		if p.User != username {
+			http.Error(w, "forbidden: not the owner or admin", http.StatusForbidden)
+			return
+		}
+		if p.DeletedBy != username {
+			http.Error(w, "forbidden: post was removed by an admin; ask an admin to restore it", http.StatusForbidden)
+			return
+		}
+	}
+
+	if !checkIfMatch(w, r, ver) {
+		return
+	}
+
+	p.DeletedAt, p.DeletedBy = nil, ""
+	var newVer PostVersion
+	events, err := writeWithChanges(r.Context(), func(ctx context.Context) ([]ChangeEvent, error) {
+		var err error
+		if newVer, err = postRepo.SaveIf(ctx, id, p, ver); err != nil {
+			return nil, err
+		}
+		return []ChangeEvent{newChange(changeRestored, id, p, username)}, nil
+	})
+	if errors.Is(err, ErrVersionConflict) {
+		writeVersionConflict(w, r)
+		return
+	}
+	if len(events) == 0 {
+		http.Error(w, "restore failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	searchCache.InvalidateAt(p.Location)
+	log.Printf("[trash] post %s restored by %s", id, username)
+	if err != nil {
+		writeChangesNotRecorded(w, err)
+		return
+	}
+	w.Header().Set("ETag", newVer.ETag())
+	writeJSON(w, http.StatusOK, PostWithID{ID: id, Post: *p})
+}
+
+// runTrashPurger 定期永久删除超过保留期的帖子；TRASH_RETENTION=0 时不启动
+func runTrashPurger(ctx context.Context) {
+	if trashRetention <= 0 {
+		log.Printf("[trash] TRASH_RETENTION=0; deleted posts are kept forever")
+		return
+	}
+	interval := trashPurgeInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	log.Printf("[trash] purging posts deleted more than %s ago, every %s", trashRetention, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := purgeTrash(ctx); err != nil {
+			log.Printf("[trash] purge failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeTrash 执行一次清除：永久删除超过保留期的帖子，再删除它们（含修订历史）引用、且不再被其他帖子或修订引用的图片
+func purgeTrash(ctx context.Context) error {
+	before := time.Now().Add(-trashRetention)
+	var posts []PurgedPost
+	// 事件与帖子一起提交（sqlite）；ES 后端部分帖子删除失败时，已删除的帖子照常记录事件并清理图片
+	events, err := writeWithChanges(ctx, func(ctx context.Context) ([]ChangeEvent, error) {
+		var err error
+		posts, err = postRepo.PurgeDeleted(ctx, before)
+		events := make([]ChangeEvent, 0, len(posts))
+		for _, p := range posts {
+			events = append(events, newChange(changePurged, p.ID, &p.Post, ""))
+		}
+		return events, err
+	})
+	if len(events) == 0 {
+		return err
+	}
+	media := 0
+	for _, p := range posts {
+		media += removeMediaOf(ctx, "[trash]", p.ID, append([]string{p.Url}, p.RevisionURLs...)...)
+	}
+	log.Printf("[trash] purged %d post(s) deleted before %s, %d image(s) removed", len(posts), before.UTC().Format(time.RFC3339), media)
+	return err
+}
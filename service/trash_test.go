@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useLocalUploads 在测试期间把图片保存到临时目录，并写入 names 对应的文件
+func useLocalUploads(t *testing.T, names ...string) string {
+	t.Helper()
+	oldGCS, oldDir := useGCS, localUploadDir
+	t.Cleanup(func() { useGCS, localUploadDir = oldGCS, oldDir })
+	useGCS, localUploadDir = false, t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(localUploadDir, name), []byte("jpg"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return localUploadDir
+}
+
+// 编辑替换下来的图片仍被修订历史引用，保留到帖子连同历史被清除时再删除；其他帖子仍在用的图片不删除
+func TestReplacedImagesFollowHistory(t *testing.T) {
+	for name, remove := range map[string]func(t *testing.T, mux http.Handler, token string){
+		"trash purge": func(t *testing.T, mux http.Handler, token string) {
+			if code := doJSON(t, mux, http.MethodDelete, "/delete?id=p", token, nil, nil); code != http.StatusOK {
+				t.Fatalf("DELETE: status %d", code)
+			}
+			old := trashRetention
+			t.Cleanup(func() { trashRetention = old })
+			trashRetention = -time.Minute
+			if err := purgeTrash(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"expiry": func(t *testing.T, mux http.Handler, token string) {
+			p, err := postRepo.Get(context.Background(), "p")
+			if err != nil {
+				t.Fatal(err)
+			}
+			past := time.Now().Add(-time.Minute)
+			p.ExpiresAt = &past
+			if err := postRepo.Save(context.Background(), "p", p); err != nil {
+				t.Fatal(err)
+			}
+			if err := reapExpired(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			useMemoryStorage(t)
+			dir := useLocalUploads(t, "a.jpg", "b.jpg", "shared.jpg")
+			exists := func(name string) bool {
+				_, err := os.Stat(filepath.Join(dir, name))
+				return err == nil
+			}
+			mux := newTestMux()
+			kimi := loginAs(t, mux, "kimi")
+			p, other := at("p", 40.71, -74.0, "photo"), at("other", 40.72, -74.0, "same photo")
+			p.Url, other.Url = "/uploads/a.jpg", "/uploads/shared.jpg"
+			seedPosts(t, p, other)
+
+			for _, url := range []string{"/uploads/b.jpg", "/uploads/shared.jpg", ""} {
+				if code := doJSON(t, mux, http.MethodPatch, "/post/p", kimi, map[string]string{"url": url}, nil); code != http.StatusOK {
+					t.Fatalf("PATCH url=%q: status %d", url, code)
+				}
+			}
+			for _, name := range []string{"a.jpg", "b.jpg", "shared.jpg"} {
+				if !exists(name) {
+					t.Errorf("%s removed while the history still uses it", name)
+				}
+			}
+
+			remove(t, mux, kimi)
+			if exists("a.jpg") || exists("b.jpg") {
+				t.Error("images of the removed history were kept")
+			}
+			if !exists("shared.jpg") {
+				t.Error("image still used by another post was removed")
+			}
+		})
+	}
+}
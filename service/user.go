@@ -2,10 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"regexp"
 
-	"github.com/olivere/elastic/v7"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -23,7 +23,7 @@ type User struct {
 // 仅允许小写字母、数字、下划线
 var usernamePattern = regexp.MustCompile(`^[a-z0-9_]+$`).MatchString
 
-// signupHandler：注册新用户 → 校验用户名规则与重复 → bcrypt 哈希 → 写入 ES
+// signupHandler：注册新用户 → 校验用户名规则 → bcrypt 哈希 → 写入存储（用户名重复返回 409）
 func signupHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -46,23 +46,6 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 连接 ES
-	esClient, err := elastic.NewClient(
-		elastic.SetURL(ES_URL),
-		elastic.SetSniff(false),
-	)
-	if err != nil {
-		http.Error(w, "es not available", http.StatusInternalServerError)
-		return
-	}
-
-	// 用户名唯一性检查（按 ID）
-	getResp, err := esClient.Get().Index(USERS_INDEX).Id(in.Username).Do(r.Context())
-	if err == nil && getResp.Found {
-		http.Error(w, "username already exists", http.StatusConflict)
-		return
-	}
-
 	// 生成 bcrypt 哈希
 	hashed, err := bcrypt.GenerateFromPassword([]byte(in.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -71,14 +54,12 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	in.Password = string(hashed)
 
-	// 写入 ES：用 username 作为文档 ID，避免重复
-	_, err = esClient.Index().
-		Index(USERS_INDEX).
-		Id(in.Username).
-		BodyJson(in).
-		Refresh("true"). // 测试期立即可见
-		Do(r.Context())
-	if err != nil {
+	// 写入存储：用户名即主键，已存在时返回冲突（检查与写入是原子的）
+	if err := userRepo.Create(r.Context(), &in); err != nil {
+		if errors.Is(err, ErrUserExists) {
+			http.Error(w, "username already exists", http.StatusConflict)
+			return
+		}
 		http.Error(w, "save failed", http.StatusInternalServerError)
 		return
 	}
@@ -87,7 +68,7 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-// loginHandler：基于 ES 的登录：读取用户名密码 → 查 ES → 校验 bcrypt → 返回 JWT
+// loginHandler：读取用户名密码 → 查用户存储 → 校验 bcrypt → 返回访问令牌（JWT）与刷新令牌
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -97,6 +78,8 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	var creds struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		// Session 为 "cookie" 时令牌写入 HttpOnly Cookie（网页会话，见 cookies.go）；默认 "bearer"
+		Session string `json:"session"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
 		http.Error(w, "bad json", http.StatusBadRequest)
@@ -106,36 +89,24 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "username/password required", http.StatusBadRequest)
 		return
 	}
-
-	// 连接 ES
-	esClient, err := elastic.NewClient(
-		elastic.SetURL(ES_URL),
-		elastic.SetSniff(false),
-	)
-	if err != nil {
-		http.Error(w, "es not available", http.StatusInternalServerError)
+	if creds.Session != "" && creds.Session != sessionModeBearer && creds.Session != sessionModeCookie {
+		http.Error(w, `session must be "bearer" or "cookie"`, http.StatusBadRequest)
+		return
+	}
+	if creds.Session == sessionModeCookie && !sameOriginRequest(r) {
+		http.Error(w, "forbidden: cross-site login", http.StatusForbidden)
 		return
 	}
 
-	// 读取用户（先按 ID，再回退 term 查询，兼容性更好）
-	var u User
-	getResp, err := esClient.Get().Index(USERS_INDEX).Id(creds.Username).Do(r.Context())
-	if err == nil && getResp.Found {
-		if err := json.Unmarshal(getResp.Source, &u); err != nil {
-			http.Error(w, "decode user failed", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		term := elastic.NewTermQuery("username", creds.Username)
-		sr, err := esClient.Search().Index(USERS_INDEX).Query(term).Size(1).Do(r.Context())
-		if err != nil || sr.Hits.TotalHits.Value == 0 {
-			http.Error(w, "invalid credentials", http.StatusUnauthorized)
-			return
-		}
-		if err := json.Unmarshal(sr.Hits.Hits[0].Source, &u); err != nil {
-			http.Error(w, "decode user failed", http.StatusInternalServerError)
-			return
-		}
+	// 读取用户
+	u, err := userRepo.Get(r.Context(), creds.Username)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "load user failed", http.StatusInternalServerError)
+		return
 	}
 
 	// 校验密码（bcrypt）
@@ -144,13 +115,12 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 签发 JWT（使用 main.go 里的 generateToken）
-	tokenString, err := generateToken(u.Username)
+	// 开始新会话：签发访问令牌与刷新令牌（见 tokens.go）
+	resp, err := issueTokens(r.Context(), u.Username, "")
 	if err != nil {
 		http.Error(w, "cannot mint token", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	writeTokens(w, r, resp, creds.Session == sessionModeCookie)
 }
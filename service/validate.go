@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 参数校验错误码（写入错误响应体的 code 字段，便于前端/调用方按类型处理）
+const (
+	errCodeMissing    = "missing_parameter"
+	errCodeInvalid    = "invalid_parameter"
+	errCodeOutOfRange = "out_of_range"
+	errCodeBadBody    = "invalid_body"
+)
+
+// paramError 表示某个请求参数未通过校验，Field 指明出错的参数名
+type paramError struct {
+	Code    string
+	Field   string
+	Message string
+}
+
+func (e *paramError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+func missingParam(field string) *paramError {
+	return &paramError{Code: errCodeMissing, Field: field, Message: "is required"}
+}
+
+func invalidParam(field, msg string) *paramError {
+	return &paramError{Code: errCodeInvalid, Field: field, Message: msg}
+}
+
+func outOfRange(field, msg string) *paramError {
+	return &paramError{Code: errCodeOutOfRange, Field: field, Message: msg}
+}
+
+// errorDetail 是错误的结构化描述：code 为错误类型，field 为出错的参数名（可选）
+type errorDetail struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// errorBody 是结构化错误响应：{"error":{"code":"...","field":"lat","message":"..."}}
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+// newErrorDetail 转换错误：err 为 *paramError 时带上 code/field，否则 code 取自 HTTP 状态
+func newErrorDetail(status int, err error) errorDetail {
+	if pe, ok := err.(*paramError); ok {
+		return errorDetail{Code: pe.Code, Field: pe.Field, Message: pe.Message}
+	}
+	return errorDetail{
+		Code:    strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"),
+		Message: err.Error(),
+	}
+}
+
+// writeError 以 JSON 形式返回错误。err 为 *paramError 时带上 code/field，否则只带 message。
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorBody{Error: newErrorDetail(status, err)})
+}
+
+// writeJSON 以 JSON 返回成功结果
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// parseCoord 解析单个坐标参数：必须存在、是有限数字，且位于 [-limit, limit]
+func parseCoord(field, raw string, limit float64) (float64, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, missingParam(field)
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, invalidParam(field, "must be a number")
+	}
+	if v < -limit || v > limit {
+		return 0, outOfRange(field, fmt.Sprintf("must be between %g and %g", -limit, limit))
+	}
+	return v, nil
+}
+
+// parseLocation 解析一对经纬度参数（如 lat/lon）
+func parseLocation(latRaw, lonRaw string) (Location, error) {
+	lat, err := parseCoord("lat", latRaw, 90)
+	if err != nil {
+		return Location{}, err
+	}
+	lon, err := parseCoord("lon", lonRaw, 180)
+	if err != nil {
+		return Location{}, err
+	}
+	return Location{Lat: lat, Lon: lon}, nil
+}
+
+// validateLocation 校验 JSON 请求体里的坐标（使用指针区分“缺失”和“0”）
+func validateLocation(lat, lon *float64) (Location, error) {
+	if lat == nil {
+		return Location{}, missingParam("location.lat")
+	}
+	if lon == nil {
+		return Location{}, missingParam("location.lon")
+	}
+	if math.IsNaN(*lat) || *lat < -90 || *lat > 90 {
+		return Location{}, outOfRange("location.lat", "must be between -90 and 90")
+	}
+	if math.IsNaN(*lon) || *lon < -180 || *lon > 180 {
+		return Location{}, outOfRange("location.lon", "must be between -180 and 180")
+	}
+	return Location{Lat: *lat, Lon: *lon}, nil
+}
+
+// 距离单位与换算成米的系数；不带单位时按公里处理（兼容旧的 range=200）
+var distanceUnits = []struct {
+	suffix string
+	meters float64
+}{
+	{"km", 1000},
+	{"mi", 1609.344},
+	{"m", 1},
+}
+
+// maxDistanceMeters 是允许的最大搜索半径（约为地球周长的一半）
+const maxDistanceMeters = 20_037_509
+
+// Distance 是以米为单位的搜索半径
+type Distance float64
+
+// String 返回 ES 可直接使用的距离字符串，如 "1500m"
+func (d Distance) String() string {
+	return strconv.FormatFloat(float64(d), 'f', -1, 64) + "m"
+}
+
+// parseDistance 解析半径参数：支持 "500m"、"2.5km"、"3mi"，纯数字视为公里
+func parseDistance(field, raw string) (Distance, error) {
+	s := strings.ToLower(strings.TrimSpace(raw))
+	if s == "" {
+		return 0, missingParam(field)
+	}
+	factor := 1000.0
+	for _, u := range distanceUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			factor = u.meters
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, invalidParam(field, "must be a number with an optional unit (m, km, mi)")
+	}
+	m := v * factor
+	if m <= 0 || m > maxDistanceMeters {
+		return 0, outOfRange(field, "must be greater than 0 and at most 20037km")
+	}
+	return Distance(m), nil
+}
+
+// parseRange 解析 /search 的 range 参数，缺省为 DISTANCE
+func parseRange(q url.Values) (Distance, error) {
+	ran := DISTANCE
+	if val := q.Get("range"); val != "" {
+		ran = val
+	}
+	return parseDistance("range", ran)
+}
+
+// parseLimit 解析条数上限：缺省返回 def，必须是 [1, max] 内的整数
+func parseLimit(field, raw string, def, max int) (int, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, invalidParam(field, "must be an integer")
+	}
+	if n < 1 || n > max {
+		return 0, outOfRange(field, fmt.Sprintf("must be between 1 and %d", max))
+	}
+	return n, nil
+}
+
+// parseOffset 解析分页偏移：缺省为 0，必须是 [0, max] 内的整数
+func parseOffset(field, raw string, max int) (int, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, invalidParam(field, "must be an integer")
+	}
+	if n < 0 || n > max {
+		return 0, outOfRange(field, fmt.Sprintf("must be between 0 and %d", max))
+	}
+	return n, nil
+}
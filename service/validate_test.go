@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+// paramCode 返回 err 中 paramError 的错误码（不是 paramError 时返回空字符串）
+func paramCode(err error) string {
+	var pe *paramError
+	if errors.As(err, &pe) {
+		return pe.Code
+	}
+	return ""
+}
+
+func TestParseDistance(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Distance
+		code string
+	}{
+		{"500m", 500, ""},
+		{"2.5km", 2500, ""},
+		{"3mi", 3 * 1609.344, ""},
+		{"12", 12000, ""},
+		{" 7 KM ", 7000, ""},
+		{"1.5 mi", 1.5 * 1609.344, ""},
+		{"20037km", 20_037_000, ""},
+		{"", 0, errCodeMissing},
+		{"far", 0, errCodeInvalid},
+		{"km", 0, errCodeInvalid},
+		{"NaN", 0, errCodeInvalid},
+		{"Inf", 0, errCodeInvalid},
+		{"0", 0, errCodeOutOfRange},
+		{"-5km", 0, errCodeOutOfRange},
+		{"20038km", 0, errCodeOutOfRange},
+	}
+	for _, tt := range tests {
+		got, err := parseDistance("range", tt.raw)
+		if code := paramCode(err); code != tt.code {
+			t.Errorf("parseDistance(%q) error = %v, want code %q", tt.raw, err, tt.code)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseDistance(%q) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseRangeDefault(t *testing.T) {
+	got, err := parseRange(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := parseDistance("range", DISTANCE); got != want {
+		t.Errorf("default range = %v, want %v", got, want)
+	}
+	if got.String() != "200000m" {
+		t.Errorf("String() = %q, want %q", got.String(), "200000m")
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want int
+		code string
+	}{
+		{"", 200, ""},
+		{"  ", 200, ""},
+		{"1", 1, ""},
+		{"1000", 1000, ""},
+		{" 25 ", 25, ""},
+		{"0", 0, errCodeOutOfRange},
+		{"-1", 0, errCodeOutOfRange},
+		{"1001", 0, errCodeOutOfRange},
+		{"ten", 0, errCodeInvalid},
+		{"2.5", 0, errCodeInvalid},
+	}
+	for _, tt := range tests {
+		got, err := parseLimit("limit", tt.raw, defaultSearchLimit, maxSearchLimit)
+		if code := paramCode(err); code != tt.code {
+			t.Errorf("parseLimit(%q) error = %v, want code %q", tt.raw, err, tt.code)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseLimit(%q) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseLimitErrorNamesField(t *testing.T) {
+	_, err := parseLimit("k", "0", 10, maxSearchLimit)
+	var pe *paramError
+	if !errors.As(err, &pe) || pe.Field != "k" {
+		t.Fatalf("err = %v, want a paramError for field k", err)
+	}
+}
@@ -93,7 +93,7 @@ async function viewportSearch() {
     const res = await safeFetch(url);
     const txt = await res.text();
     if (!res.ok) { setMsg(searchMsg, "Search failed: " + txt, false); return; }
-    let arr = []; try { arr = JSON.parse(txt) || []; } catch {}
+    const arr = parseResults(txt);
     // 忽略过期响应（如果期间又发起了新的搜索）
     if (seq !== searchSeq) return;
     renderResults(arr);
@@ -105,37 +105,89 @@ async function viewportSearch() {
   }
 }
 
+// /search returns an envelope {total, returned, truncated, results, ...}; older servers return a bare array
+function parseResults(txt) {
+  try {
+    const data = JSON.parse(txt);
+    if (Array.isArray(data)) return data;
+    return (data && data.results) || [];
+  } catch {
+    return [];
+  }
+}
+
+// Bearer token from localStorage (API-style login). The UI itself logs in with session: "cookie",
+// where tokens live in HttpOnly cookies and only the CSRF token is visible to scripts.
 function getToken() {
   return localStorage.getItem("token") || localStorage.getItem("gc_token") || "";
 }
-function setToken(t) {
+function getCsrfToken() {
+  const m = document.cookie.match(/(?:^|;\s*)(?:__Host-)?gc_csrf=([^;]*)/);
+  return m ? decodeURIComponent(m[1]) : "";
+}
+function isLoggedIn() {
+  return !!(getToken() || getCsrfToken());
+}
+function setToken(t, refresh) {
   if (t) {
     localStorage.setItem("token", t);
     localStorage.setItem("gc_token", t);
+    if (refresh) localStorage.setItem("refresh_token", refresh);
   } else {
     localStorage.removeItem("token");
     localStorage.removeItem("gc_token");
+    localStorage.removeItem("refresh_token");
   }
   renderAuthState();
 }
+// Access tokens are short-lived: trade the refresh token for a new pair (the old refresh token stops working)
+let refreshing = null;
+function refreshToken() {
+  const refresh = localStorage.getItem("refresh_token");
+  const csrf = getCsrfToken();
+  if (!refresh && !csrf) return Promise.resolve(false);
+  if (!refreshing) {
+    // Cookie session: the server reads the refresh cookie, we only prove the request is ours
+    const init = refresh
+      ? { headers: { "Content-Type": "application/json" }, body: JSON.stringify({ refresh_token: refresh }) }
+      : { headers: { "X-CSRF-Token": csrf } };
+    refreshing = fetch("/token/refresh", { method: "POST", ...init })
+      .then(async (res) => {
+        if (!res.ok) { setToken(""); return false; }
+        const data = await res.json();
+        if (data.token) setToken(data.token, data.refresh_token);
+        else renderAuthState();
+        return true;
+      })
+      .catch(() => false)
+      .finally(() => { refreshing = null; });
+  }
+  return refreshing;
+}
 function renderAuthState() {
-  const t = getToken();
+  const t = isLoggedIn();
   authInfo.textContent = t ? "Logged in" : "Not logged in";
   if (btnLogout) btnLogout.style.display = t ? "inline-block" : "none";
   if (btnLoginLink) btnLoginLink.style.display = t ? "none" : "inline-block";
 }
 if (btnLogout) {
-  btnLogout.addEventListener("click", () => {
+  btnLogout.addEventListener("click", async () => {
+    if (isLoggedIn()) await safeFetch("/logout", { method: "POST" }).catch(() => {});
     setToken("");
     window.location.href = "/auth.html";
   });
 }
 
-async function safeFetch(path, init = {}) {
+async function safeFetch(path, init = {}, retried = false) {
   const token = getToken();
   const headers = new Headers(init.headers || {});
   if (token) headers.set("Authorization", "Bearer " + token);
-  return fetch(path, { ...init, headers });
+  else if ((init.method || "GET").toUpperCase() !== "GET") headers.set("X-CSRF-Token", getCsrfToken());
+  const res = await fetch(path, { ...init, headers });
+  if (res.status === 401 && isLoggedIn() && !retried && await refreshToken()) {
+    return safeFetch(path, init, true);
+  }
+  return res;
 }
 
 // Simple debounce helper to avoid spamming the backend while panning/zooming
@@ -215,7 +267,7 @@ async function stateSearch(code) {
     const res = await safeFetch(url);
     const txt = await res.text();
     if (!res.ok) { setMsg(searchMsg, "Search failed: " + txt, false); return; }
-    let arr = []; try { arr = JSON.parse(txt) || []; } catch {}
+    const arr = parseResults(txt);
     if (seq !== searchSeq) return; // 忽略过期响应
     renderResults(arr);
     renderOnMap(arr, false);       // 已手动 fit 到州范围，这里不再自动 fit
@@ -284,7 +336,7 @@ if (formLogin) {
     e.preventDefault();
     setMsg(loginMsg, "Logging in...");
     const fd = new FormData(formLogin);
-    const body = { username: fd.get("username"), password: fd.get("password") };
+    const body = { username: fd.get("username"), password: fd.get("password"), session: "cookie" };
     try {
       const res = await fetch("/login", {
         method: "POST",
@@ -293,9 +345,13 @@ if (formLogin) {
       });
       if (!res.ok) { setMsg(loginMsg, "Login failed: " + (await res.text()), false); return; }
       const data = await res.json().catch(async () => ({ token: await res.text() }));
-      const token = data.token || data || "";
-      if (!token) { setMsg(loginMsg, "No token returned.", false); return; }
-      setToken(token);
+      if (data.csrf_token) {
+        setToken(""); // drop any bearer token left from an older login
+      } else {
+        const token = data.token || data || "";
+        if (!token) { setMsg(loginMsg, "No token returned.", false); return; }
+        setToken(token, data.refresh_token);
+      }
       setMsg(loginMsg, "Login successful.", true);
       formLogin.reset();
       // Force clear in case the browser re-applies autofill right after reset
@@ -372,7 +428,7 @@ formSearch.addEventListener("submit", async (e) => {
     const res = await safeFetch(`/search?lat=${lat}&lon=${lon}&range=${range}`);
     const txt = await res.text();
     if (!res.ok) { setMsg(searchMsg, "Search failed: " + txt, false); return; }
-    let arr = []; try { arr = JSON.parse(txt) || []; } catch {}
+    const arr = parseResults(txt);
     renderResults(arr);
     renderOnMap(arr, true);
     setMsg(searchMsg, `Found ${arr.length} result(s).`, true);
@@ -441,7 +497,7 @@ async function deletePost(id, cardEl, btnEl) {
           const r = await safeFetch(`/search?lat=${lat}&lon=${lon}&range=${range}`);
           const t = await r.text();
           if (r.ok) {
-            let arr = []; try { arr = JSON.parse(t) || []; } catch {}
+            const arr = parseResults(t);
             // Re-render list and map after deletion
             renderResults(arr);
             renderOnMap(arr, false);
@@ -27,12 +27,12 @@ if (formLogin) {
       const res = await fetch("/login", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
-        body: JSON.stringify(data),
+        body: JSON.stringify({ ...data, session: "cookie" }),
       });
       const txt = await res.text();
       if (!res.ok) return setMsg(msg, txt);
-      const json = JSON.parse(txt);
-      localStorage.setItem("token", json.token);
+      // Cookie session: tokens are in HttpOnly cookies; clear any bearer token from an older login
+      ["token", "gc_token", "refresh_token"].forEach((k) => localStorage.removeItem(k));
       setMsg(msg, "Login success!", true);
       setTimeout(() => (window.location = "/"), 800);
     } catch (err) {